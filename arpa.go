@@ -1,42 +1,176 @@
 package fslm
 
-// ARPA file parsing routine using iteratees.
+// ARPA file parsing routine using iteratees and the reverse
+// conversion from a compiled model.
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"fmt"
+	"io"
+	"math"
+	"slices"
 	"strconv"
 
 	"github.com/golang/glog"
 	"github.com/kho/stream"
+	"github.com/kho/word"
 )
 
+// ARPAMode decides how strictly an ARPA file is checked.
+type ARPAMode int
+
+const (
+	// The n-gram counts in the header are ignored; n-gram sections can
+	// come in any order; duplicate n-grams silently overwrite earlier
+	// ones and missing prefixes are implicitly created.
+	ARPA_DEFAULT ARPAMode = iota
+	// The n-gram counts must be declared for orders 1, 2, ... in order
+	// and match the entries; n-gram sections must come in ascending
+	// order; each n-gram must be unique and have its prefix (i.e. its
+	// context) in the file.
+	ARPA_STRICT
+	// Same as ARPA_DEFAULT, but any lines before \data\ (e.g. headers
+	// or comments) are skipped and \end\ can be missing.
+	ARPA_LENIENT
+)
+
+// ARPAOptions controls the parsing of an ARPA file. The zero value
+// gives the default behavior.
+type ARPAOptions struct {
+	Mode ARPAMode
+	// Number of goroutines for tokenizing n-gram entries and for
+	// building the model from the resulting Builder (see
+	// Builder.SetWorkers); <= 0 means runtime.GOMAXPROCS(0). The
+	// resulting model does not depend on it.
+	Workers int
+}
+
+// ngramSink receives the n-gram entries of an ARPA file. It is
+// implemented by Builder and ExternalBuilder.
+type ngramSink interface {
+	Vocab() (*word.Vocab, string, string, word.Id, word.Id)
+	checkNgram(context []string, word string) error
+	// addNgramLine adds a checked n-gram entry read from the given line.
+	addNgramLine(line int, context []word.Id, x word.Id, weight Weight, backOff Weight) error
+}
+
+// arpaState is the parsing state shared by all the iteratees of an
+// ARPA file.
+type arpaState struct {
+	sink ngramSink
+	// The sink when it is a Builder, which can look up the n-grams
+	// added so far for the ARPA_STRICT checks; nil otherwise.
+	builder *Builder
+	opts    ARPAOptions
+	lines   *lineCounter
+	// The header of the current section, for error reporting.
+	section string
+	// The following are only used in ARPA_STRICT mode: n-gram counts
+	// declared in the header, the order of the last n-gram section, the
+	// number of entries in the last n-gram section and whether <s> has
+	// been seen as a unigram (a Builder always has it).
+	counts  []int
+	order   int
+	num     int
+	seenBos bool
+}
+
 // arpaTop builds a top-level iteratee for parsing a complete ARPA
 // file.
-func arpaTop(b *Builder) stream.Iteratee {
-	return stream.Seq(
-		stream.Match(`\data\`),
-		skipNgramCounts{},
-		stream.Star(ngramSection{b}),
-		stream.Match(`\end\`),
-		stream.EOF)
+func arpaTop(st *arpaState) stream.Iteratee {
+	var its []stream.Iteratee
+	if st.opts.Mode == ARPA_LENIENT {
+		its = append(its, skipUntil(`\data\`))
+	}
+	return stream.Seq(append(its,
+		dataHeader{st},
+		ngramCounts{st},
+		stream.Star(ngramSection{st}),
+		arpaEnd{st},
+		stream.EOF)...)
 }
 
-// skipNgramCounts skips the n-gram-count section.
-type skipNgramCounts struct{}
+// skipUntil skips lines until the given line.
+type skipUntil string
+
+func (it skipUntil) Final() error { return stream.ErrExpect(string(it)) }
+func (it skipUntil) Next(line []byte) (stream.Iteratee, bool, error) {
+	if string(line) == string(it) {
+		return nil, false, nil
+	}
+	return it, true, nil
+}
+
+// dataHeader matches \data\.
+type dataHeader struct {
+	st *arpaState
+}
 
-func (_ skipNgramCounts) Final() error { return nil }
-func (it skipNgramCounts) Next(line []byte) (stream.Iteratee, bool, error) {
+func (it dataHeader) Final() error { return stream.ErrExpect(`\data\`) }
+func (it dataHeader) Next(line []byte) (stream.Iteratee, bool, error) {
+	if string(line) != `\data\` {
+		return nil, false, stream.ErrExpect(`\data\`)
+	}
+	it.st.section = `\data\`
+	return nil, true, nil
+}
+
+// ngramCounts goes through the n-gram-count section. The counts are
+// only checked in ARPA_STRICT mode and skipped otherwise.
+type ngramCounts struct {
+	st *arpaState
+}
+
+func (_ ngramCounts) Final() error { return nil }
+func (it ngramCounts) Next(line []byte) (stream.Iteratee, bool, error) {
 	if line[0] == '\\' {
 		return nil, false, nil
 	}
+	if it.st.opts.Mode == ARPA_STRICT {
+		n, c, err := parseNgramCount(line)
+		if err != nil {
+			return nil, false, err
+		}
+		if n != len(it.st.counts)+1 {
+			return nil, false, fmt.Errorf("expect n-gram count of order %d; got order %d", len(it.st.counts)+1, n)
+		}
+		it.st.counts = append(it.st.counts, c)
+	}
 	return it, true, nil
 }
 
+// parseNgramCount parses "ngram N=C".
+func parseNgramCount(line []byte) (n, c int, err error) {
+	x, xs := tokenSplit(line)
+	if x != "ngram" {
+		return 0, 0, stream.ErrExpect(`"ngram N=C"`)
+	}
+	i := bytes.IndexByte(xs, '=')
+	if i < 0 {
+		return 0, 0, stream.ErrExpect(`"ngram N=C"`)
+	}
+	n, err = strconv.Atoi(string(bytes.TrimSpace(xs[:i])))
+	if err != nil || n <= 0 {
+		return 0, 0, stream.ErrExpect(`positive integer N in "ngram N=C"`)
+	}
+	c, err = strconv.Atoi(string(bytes.TrimSpace(xs[i+1:])))
+	if err != nil || c < 0 {
+		return 0, 0, stream.ErrExpect(`non-negative integer C in "ngram N=C"`)
+	}
+	return n, c, nil
+}
+
+// _MAX_ARPA_ORDER is the highest order of an n-gram section in any
+// mode, so that a bad section header cannot make the parser allocate a
+// huge context.
+const _MAX_ARPA_ORDER = math.MaxUint8
+
 // ngramSection goes through one n-gram section and add all the n-gram
 // entries to the builder.
 type ngramSection struct {
-	builder *Builder
+	st *arpaState
 }
 
 func (it ngramSection) Final() error { return stream.ErrExpect(`\N-grams: ...`) }
@@ -48,41 +182,283 @@ func (it ngramSection) Next(line []byte) (stream.Iteratee, bool, error) {
 	if err != nil || n <= 0 {
 		return nil, false, stream.ErrExpect(`positive integer in section header "\N-grams:"`)
 	}
-	return newNgramEntries(n, it.builder), true, nil
+	st := it.st
+	st.section = string(line)
+	if n > _MAX_ARPA_ORDER {
+		return nil, false, fmt.Errorf("%d-grams beyond the highest order %d", n, _MAX_ARPA_ORDER)
+	}
+	if st.opts.Mode == ARPA_STRICT {
+		if n != st.order+1 {
+			return nil, false, fmt.Errorf("expect section of %d-grams; got %d-grams", st.order+1, n)
+		}
+		if n > len(st.counts) {
+			return nil, false, fmt.Errorf("%d-grams not declared in \\data\\", n)
+		}
+		st.order, st.num = n, 0
+	}
+	return newNgramEntries(n, st), true, nil
 }
 
 // ngramEntries scans 0 or more n-gram entries of the given order and
-// add them to the builder.
+// add them to the builder. When more than one worker is allowed, the
+// entries are buffered and tokenized in parallel by batch, and then
+// added to the builder in their original order, so that the result is
+// the same as adding them one by one.
 type ngramEntries struct {
-	builder *Builder
-	n       int
+	st *arpaState
+	n  int
 	// These are for avoiding repeated space allocation.
 	p, bow  Weight
 	context []string
 	word    string
+	ids     []word.Id
+	// Pending entries; nil when entries are added one by one.
+	batch *ngramBatch
 }
 
 // newNgramEntries constructs a new ngramEntries with properly
 // initialized stub data.
-func newNgramEntries(n int, b *Builder) *ngramEntries {
-	return &ngramEntries{b, n, 0, 0, make([]string, n-1), ""}
+func newNgramEntries(n int, st *arpaState) *ngramEntries {
+	it := &ngramEntries{st, n, 0, 0, make([]string, n-1), "", nil, nil}
+	if st != nil && numWorkers(st.opts.Workers) > 1 {
+		it.batch = &ngramBatch{}
+	}
+	return it
+}
+
+func (it *ngramEntries) Final() error {
+	if err := it.flush(); err != nil {
+		return err
+	}
+	return it.finish()
 }
 
-func (it *ngramEntries) Final() error { return nil }
 func (it *ngramEntries) Next(line []byte) (stream.Iteratee, bool, error) {
 	if line[0] == '\\' {
+		if err := it.flush(); err != nil {
+			return nil, false, err
+		}
+		if err := it.finish(); err != nil {
+			return nil, false, err
+		}
 		if glog.V(1) {
 			glog.Infof("finished reading %d-grams", it.n)
 		}
 		return nil, false, nil
 	}
+	if it.batch != nil {
+		it.batch.Add(line, it.st.lines.line)
+		if it.batch.Len() >= arpaBatchSize {
+			if err := it.flush(); err != nil {
+				return nil, false, err
+			}
+		}
+		return it, true, nil
+	}
 	if err := it.setParts(line); err != nil {
 		return nil, false, err
 	}
-	it.builder.AddNgram(it.context, it.word, it.p, it.bow)
+	if err := it.add(it.st.lines.line, nil); err != nil {
+		return nil, false, err
+	}
 	return it, true, nil
 }
 
+// add adds the current entry from the given line to the sink. ids,
+// when not nil, holds the ids of the context words and the word that
+// are already known (word.NIL for the others).
+func (it *ngramEntries) add(line int, ids []word.Id) error {
+	st := it.st
+	if st.opts.Mode == ARPA_STRICT {
+		if err := it.check(); err != nil {
+			return err
+		}
+	}
+	if err := st.sink.checkNgram(it.context, it.word); err != nil {
+		return err
+	}
+	vocab, _, _, _, _ := st.sink.Vocab()
+	if ids == nil {
+		ids = it.ids[:0]
+		for _, x := range it.context {
+			ids = append(ids, vocab.IdOrAdd(x))
+		}
+		ids = append(ids, vocab.IdOrAdd(it.word))
+		it.ids = ids
+	} else {
+		// Unknown words are added in the same order as above.
+		for i, x := range ids[:it.n-1] {
+			if x == word.NIL {
+				ids[i] = vocab.IdOrAdd(it.context[i])
+			}
+		}
+		if ids[it.n-1] == word.NIL {
+			ids[it.n-1] = vocab.IdOrAdd(it.word)
+		}
+	}
+	return st.sink.addNgramLine(line, ids[:it.n-1], ids[it.n-1], it.p, it.bow)
+}
+
+// flush tokenizes the pending entries in parallel and then adds them
+// one by one. Errors are reported with the line of the entry.
+func (it *ngramEntries) flush() error {
+	batch := it.batch
+	if batch == nil || batch.Len() == 0 {
+		return nil
+	}
+	vocab, _, _, _, _ := it.st.sink.Vocab()
+	entries := batch.entries
+	// The vocabulary is only read during tokenizing.
+	parallelFor(len(entries), it.st.opts.Workers, func(lo, hi int) {
+		scratch := newNgramEntries(it.n, nil)
+		for i := lo; i < hi; i++ {
+			e := &entries[i]
+			if e.Err = scratch.setParts(batch.Line(i)); e.Err != nil {
+				continue
+			}
+			e.P, e.BOW = scratch.p, scratch.bow
+			e.Words = append(append(e.Words[:0], scratch.context...), scratch.word)
+			e.Ids = e.Ids[:0]
+			for _, w := range e.Words {
+				e.Ids = append(e.Ids, vocab.IdOf(w))
+			}
+		}
+	})
+	for i := range entries {
+		e := &entries[i]
+		err := e.Err
+		if err == nil {
+			copy(it.context, e.Words)
+			it.word, it.p, it.bow = e.Words[it.n-1], e.P, e.BOW
+			err = it.add(e.Line, e.Ids)
+		}
+		if err != nil {
+			return &ARPAError{e.Line, it.st.section, err}
+		}
+	}
+	batch.Reset()
+	return nil
+}
+
+// arpaBatchSize is the number of n-gram entries tokenized together by
+// ngramEntries.
+var arpaBatchSize = 1 << 14
+
+// ngramBatch holds n-gram entry lines for tokenizing.
+type ngramBatch struct {
+	// Concatenated lines and where each ends.
+	text []byte
+	ends []int
+	// One per line.
+	entries []ngramBatchEntry
+}
+
+// ngramBatchEntry is a tokenized n-gram entry.
+type ngramBatchEntry struct {
+	Line   int
+	Err    error
+	P, BOW Weight
+	Words  []string  // Context words followed by the word.
+	Ids    []word.Id // Ids of Words; word.NIL when not yet known.
+}
+
+// Add copies line into the batch.
+func (b *ngramBatch) Add(line []byte, lineNum int) {
+	b.text = append(b.text, line...)
+	b.ends = append(b.ends, len(b.text))
+	if len(b.entries) < cap(b.entries) {
+		// Reuse the space of a previous batch.
+		b.entries = b.entries[:len(b.entries)+1]
+		b.entries[len(b.entries)-1].Line = lineNum
+	} else {
+		b.entries = append(b.entries, ngramBatchEntry{Line: lineNum})
+	}
+}
+
+func (b *ngramBatch) Len() int {
+	return len(b.ends)
+}
+
+// Line returns the i-th line.
+func (b *ngramBatch) Line(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = b.ends[i-1]
+	}
+	return b.text[start:b.ends[i]]
+}
+
+// Reset empties the batch but keeps the space for reuse.
+func (b *ngramBatch) Reset() {
+	b.text = b.text[:0]
+	b.ends = b.ends[:0]
+	b.entries = b.entries[:0]
+}
+
+// check runs the ARPA_STRICT checks on the current entry.
+func (it *ngramEntries) check() error {
+	st := it.st
+	if st.num++; st.num > st.counts[it.n-1] {
+		return fmt.Errorf("more than %d %d-grams declared in \\data\\", st.counts[it.n-1], it.n)
+	}
+	if st.builder == nil {
+		// An ExternalBuilder checks for missing prefixes and duplicates
+		// once the n-grams are sorted.
+		return nil
+	}
+	// Catch invalid n-grams before looking them up.
+	if err := st.builder.checkNgram(it.context, it.word); err != nil {
+		return err
+	}
+	hasContext, hasNgram := st.builder.lookUp(it.context, it.word)
+	if !hasContext {
+		return newNgramError(it.context, it.word, "missing prefix")
+	}
+	if hasNgram {
+		// A Builder always has <s> as a unigram.
+		if it.n != 1 || it.word != st.builder.bos || st.seenBos {
+			return newNgramError(it.context, it.word, "duplicate n-gram")
+		}
+	}
+	if it.n == 1 && it.word == st.builder.bos {
+		st.seenBos = true
+	}
+	return nil
+}
+
+// finish runs the ARPA_STRICT checks at the end of the section.
+func (it *ngramEntries) finish() error {
+	st := it.st
+	if st.opts.Mode == ARPA_STRICT && st.num != st.counts[it.n-1] {
+		return fmt.Errorf("expect %d %d-grams as declared in \\data\\; got %d", st.counts[it.n-1], it.n, st.num)
+	}
+	return nil
+}
+
+// arpaEnd matches \end\, which is optional in ARPA_LENIENT mode.
+type arpaEnd struct {
+	st *arpaState
+}
+
+func (it arpaEnd) Final() error {
+	if it.st.opts.Mode == ARPA_LENIENT {
+		return nil
+	}
+	return stream.ErrExpect(`\end\`)
+}
+
+func (it arpaEnd) Next(line []byte) (stream.Iteratee, bool, error) {
+	if string(line) != `\end\` {
+		return nil, false, stream.ErrExpect(`\end\`)
+	}
+	st := it.st
+	st.section = `\end\`
+	if st.opts.Mode == ARPA_STRICT && st.order != len(st.counts) {
+		return nil, false, fmt.Errorf("missing section of %d-grams declared in \\data\\", st.order+1)
+	}
+	return nil, true, nil
+}
+
 func (it *ngramEntries) setParts(line []byte) error {
 	// p
 	x, xs := tokenSplit(line)
@@ -124,6 +500,124 @@ func (it *ngramEntries) setParts(line []byte) error {
 	return nil
 }
 
+// WriteARPA writes m out as an ARPA file. The n-grams are
+// reconstructed from the lexical transitions of each state and the
+// context the state represents (see findStateLinks).
+//
+// The weight of a pruned n-gram (one without any extension) has its
+// back-off weight folded in, and so does the back-off weight of a
+// state that backs off past a pruned n-gram. Hashed and Sorted keep
+// the source weights of such n-grams (see foldedNgrams), which are
+// written instead, so every n-gram is written with the weights it has
+// in the source ARPA file. For any other m, a pruned n-gram is
+// written with the weight of its transition and a back-off weight of
+// 0, which still assigns exactly the same score to any sentence as m
+// does.
+func WriteARPA(m IterableModel, w io.Writer) error {
+	vocab := VocabOf(m)
+	var folded []arpaEntry
+	if f, ok := m.(interface{ foldedNgrams() []arpaEntry }); ok {
+		folded = f.foldedNgrams()
+	}
+	links := findStateLinks(m)
+	var ngrams [][]arpaEntry
+	for i := 0; i < m.NumStates(); i++ {
+		p := StateId(i)
+		n := links.Order(p) + 1
+		for xqw := range m.Transitions(p) {
+			x, q := xqw.Word, xqw.State
+			e := arpaEntry{p, x, xqw.Weight, 0}
+			if j, ok := slices.BinarySearchFunc(folded, e, compareArpaEntries); ok {
+				e = folded[j]
+			} else if q != STATE_NIL && links[q] == (stateLink{p, x}) {
+				// Only the transition to the state of the n-gram itself
+				// carries the back-off weight.
+				_, e.BackOff = m.BackOff(q)
+			}
+			for len(ngrams) < n {
+				ngrams = append(ngrams, nil)
+			}
+			ngrams[n-1] = append(ngrams[n-1], e)
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, `\data\`)
+	for i, es := range ngrams {
+		fmt.Fprintf(out, "ngram %d=%d\n", i+1, len(es))
+	}
+	context := make([]word.Id, 0, len(ngrams))
+	for i, es := range ngrams {
+		fmt.Fprintf(out, "\n\\%d-grams:\n", i+1)
+		for _, e := range es {
+			context = context[:0]
+			for p := e.Context; p != _STATE_EMPTY; p = links[p].Parent {
+				context = append(context, links[p].Word)
+			}
+			out.WriteString(arpaWeight(e.Weight))
+			out.WriteByte('\t')
+			for j := len(context) - 1; j >= 0; j-- {
+				out.WriteString(vocab.StringOf(context[j]))
+				out.WriteByte(' ')
+			}
+			out.WriteString(vocab.StringOf(e.Word))
+			if e.BackOff != 0 {
+				out.WriteByte('\t')
+				out.WriteString(arpaWeight(e.BackOff))
+			}
+			out.WriteByte('\n')
+		}
+	}
+	fmt.Fprintln(out, "\n\\end\\")
+	return out.Flush()
+}
+
+// arpaEntry is a n-gram entry to be written by WriteARPA. Hashed and
+// Sorted also keep one with the source weights of each n-gram whose
+// weights are folded (see foldedNgrams).
+type arpaEntry struct {
+	Context         StateId
+	Word            word.Id
+	Weight, BackOff Weight
+}
+
+// compareArpaEntries orders n-gram entries by context and then by
+// word, which is how the folded n-grams of a model are sorted.
+func compareArpaEntries(a, b arpaEntry) int {
+	if c := cmp.Compare(a.Context, b.Context); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Word, b.Word)
+}
+
+// arpaWeight formats a weight for ARPA files. WEIGHT_LOG0 is written
+// as the value of flag fslm.log0 so that it is read back as
+// WEIGHT_LOG0.
+func arpaWeight(w Weight) string {
+	if w == WEIGHT_LOG0 {
+		w = textLog0
+	}
+	return strconv.FormatFloat(float64(w), 'g', -1, WEIGHT_SIZE)
+}
+
+// ARPAError is the error in parsing an ARPA file.
+type ARPAError struct {
+	Line    int    // Line number (1-based) where the error occurs.
+	Section string // Header of the section where the error occurs.
+	Err     error
+}
+
+func (e *ARPAError) Error() string {
+	if e.Section == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d (in %s): %v", e.Line, e.Section, e.Err)
+}
+
+func (e *ARPAError) Unwrap() error {
+	return e.Err
+}
+
 // Low-level lexer code.
 
 func isSpace(b byte) bool {
@@ -168,6 +662,24 @@ func lineSplit(data []byte, atEOF bool) (int, []byte, error) {
 	return n, data[l : r+1], nil
 }
 
+// lineCounter wraps lineSplit to keep track of the line number of
+// the last line returned.
+type lineCounter struct {
+	// The number of newlines consumed so far and the line number of the
+	// last line.
+	newlines, line int
+}
+
+func (c *lineCounter) split(data []byte, atEOF bool) (int, []byte, error) {
+	n, line, err := lineSplit(data, atEOF)
+	if line != nil {
+		// line is always a sub-slice of data; cap tells where it starts.
+		c.line = c.newlines + bytes.Count(data[:cap(data)-cap(line)], []byte{'\n'}) + 1
+	}
+	c.newlines += bytes.Count(data[:n], []byte{'\n'})
+	return n, line, err
+}
+
 func tokenSplit(line []byte) (string, []byte) {
 	// Assuming line has no leading space.
 	r := -1
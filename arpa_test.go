@@ -2,9 +2,16 @@ package fslm
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func Test_lineSplit(t *testing.T) {
@@ -124,3 +131,258 @@ func Test_ngramWeights_setParts(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteARPA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lm")
+	for _, i := range []struct {
+		LM    []ngram
+		Sents [][]token
+	}{
+		{simpleTrigramLM, simpleTrigramSents},
+		{sparseFivegramLM, sparseFivegramSents},
+		{sparserFivegramLM, sparserFivegramSents},
+		{trickyBackOffLM, trickyBackOffSents},
+	} {
+		for _, model := range []interface {
+			IterableModel
+			WriteBinary(string) error
+		}{readyBuilder(i.LM).DumpHashed(0), readyBuilder(i.LM).DumpSorted(), readyBuilder(i.LM).DumpHybrid(HybridOptions{})} {
+			if err := model.WriteBinary(path); err != nil {
+				t.Fatalf("error in writing binary: %v", err)
+			}
+			_, loaded, backing, err := FromBinary(path)
+			if err != nil {
+				t.Fatalf("error in loading binary: %v", err)
+			}
+			for _, m := range []IterableModel{model, loaded.(IterableModel)} {
+				var buf bytes.Buffer
+				if err := WriteARPA(m, &buf); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				text := buf.String()
+				if err := checkARPAWeights(text, i.LM); err != nil {
+					t.Errorf("%T: %v\n%s", m, err, text)
+				}
+				builder, err := FromARPA(&buf, ARPAOptions{Mode: ARPA_STRICT})
+				if err != nil {
+					t.Fatalf("unexpected error: %v\n%s", err, text)
+				}
+				sentTest(builder.DumpHashed(0), i.Sents, t)
+			}
+			if err := backing.Close(); err != nil {
+				t.Errorf("error in closing mapped file: %v", err)
+			}
+		}
+	}
+}
+
+// checkARPAWeights checks that every n-gram of lm has the same weight
+// and back-off weight in text, an ARPA file.
+func checkARPAWeights(text string, lm []ngram) error {
+	parse := func(s string) (Weight, error) {
+		f, err := strconv.ParseFloat(s, WEIGHT_SIZE)
+		if Weight(f) <= textLog0 {
+			return WEIGHT_LOG0, err
+		}
+		return Weight(f), err
+	}
+	written := map[string][2]Weight{}
+	for _, line := range strings.Split(text, "\n") {
+		parts := strings.Split(line, "\t")
+		if len(parts) < 2 {
+			continue
+		}
+		bow := "0"
+		if len(parts) > 2 {
+			bow = parts[2]
+		}
+		w, err := parse(parts[0])
+		if err != nil {
+			return err
+		}
+		b, err := parse(bow)
+		if err != nil {
+			return err
+		}
+		written[parts[1]] = [2]Weight{w, b}
+	}
+	for _, n := range lm {
+		c, x, w, b := n.Params()
+		if w <= textLog0 {
+			w = WEIGHT_LOG0
+		}
+		if b <= textLog0 {
+			b = WEIGHT_LOG0
+		}
+		key := strings.Join(append(c, x), " ")
+		if ws, ok := written[key]; !ok || ws != [2]Weight{w, b} {
+			return fmt.Errorf("expect n-gram %q with weights %v; got %v (found = %v)", key, [2]Weight{w, b}, ws, ok)
+		}
+	}
+	return nil
+}
+
+func TestFromARPAError(t *testing.T) {
+	for _, i := range []struct {
+		ARPA  string
+		Line  int
+		Ngram bool
+	}{
+		{"\\data\\\nngram 1=2\nngram 2=1\n\n\\1-grams:\n-1 <s>\n-1 a\n\n\\2-grams:\n-1 </s> a\n\n\\end\\\n", 10, true},
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\1-grams:\n-1 a\n\\2-grams:\n-1 a <s> b\n\\end\\\n", 7, false},
+		{"\\data\\\nngram 1=1\n\n\r\n\\1-grams:\n-1 a\n\\3-grams:\n-1 a <s> b\n\\end\\\n", 8, true},
+		{"\\data\\\nngram 1=1\n\\1-grams:\n-1 a\n", 4, false},
+	} {
+		_, err := FromARPA(strings.NewReader(i.ARPA), ARPAOptions{})
+		var arpaErr *ARPAError
+		if !errors.As(err, &arpaErr) {
+			t.Errorf("case %q: expect *ARPAError; got %v", i.ARPA, err)
+			continue
+		}
+		if arpaErr.Line != i.Line {
+			t.Errorf("case %q: expect error at line %d; got %v", i.ARPA, i.Line, err)
+		}
+		var ngramErr *NgramError
+		if errors.As(err, &ngramErr) != i.Ngram {
+			t.Errorf("case %q: expect *NgramError = %v; got %v", i.ARPA, i.Ngram, err)
+		}
+	}
+}
+
+// arpaModeTest is an ARPA file that fails to parse at the given line
+// and section in the given mode (or succeeds when Line is 0).
+type arpaModeTest struct {
+	ARPA    string
+	Mode    ARPAMode
+	Line    int // 0 for no error.
+	Section string
+}
+
+func arpaModeTests(t *testing.T) []arpaModeTest {
+	raw, err := os.ReadFile(filepath.Join("testdata", "simple.3gram.arpa"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The test file declares one more trigram than it has.
+	simple := strings.Replace(string(raw), "ngram 3=3", "ngram 3=2", 1)
+	return []arpaModeTest{
+		{string(raw), ARPA_STRICT, 20, `\3-grams:`},
+		{string(raw), ARPA_DEFAULT, 0, ""},
+		{simple, ARPA_STRICT, 0, ""},
+		{simple, ARPA_LENIENT, 0, ""},
+		{strings.Replace(simple, "\n", "\r\n", -1), ARPA_LENIENT, 0, ""},
+		{"# built by hand\n\n" + simple, ARPA_LENIENT, 0, ""},
+		{"# built by hand\n\n" + simple, ARPA_DEFAULT, 1, ""},
+		{strings.TrimSuffix(simple, "\\end\\\n"), ARPA_LENIENT, 0, ""},
+		{strings.TrimSuffix(simple, "\\end\\\n"), ARPA_DEFAULT, 18, `\3-grams:`},
+		// Wrong counts.
+		{strings.Replace(simple, "ngram 1=4", "ngram 1=5", 1), ARPA_STRICT, 12, `\1-grams:`},
+		{strings.Replace(simple, "ngram 1=4", "ngram 1=3", 1), ARPA_STRICT, 10, `\1-grams:`},
+		{strings.Replace(simple, "ngram 1=4", "ngram 1=5", 1), ARPA_DEFAULT, 0, ""},
+		{strings.Replace(simple, "ngram 1=4", "ngram  1 = 4", 1), ARPA_STRICT, 0, ""},
+		{strings.Replace(simple, "ngram 1=4", "ngram 1=x", 1), ARPA_STRICT, 2, `\data\`},
+		{strings.Replace(simple, "ngram 2=2", "ngram 3=2", 1), ARPA_STRICT, 3, `\data\`},
+		// Missing or undeclared sections.
+		{strings.Replace(simple, "ngram 3=2", "ngram 3=2\nngram 4=1", 1), ARPA_STRICT, 21, `\end\`},
+		{strings.Replace(simple, "ngram 3=2\n", "", 1), ARPA_STRICT, 15, `\3-grams:`},
+		// Sections out of order.
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\2-grams:\n-1 a b\n\\1-grams:\n-1 a\n\\end\\\n", ARPA_STRICT, 4, `\2-grams:`},
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\2-grams:\n-1 a b\n\\1-grams:\n-1 a\n\\end\\\n", ARPA_DEFAULT, 0, ""},
+		// Duplicate n-grams.
+		{"\\data\\\nngram 1=2\n\\1-grams:\n-1 a\n-2 a\n\\end\\\n", ARPA_STRICT, 5, `\1-grams:`},
+		{"\\data\\\nngram 1=2\n\\1-grams:\n-99 <s>\n-99 <s>\n\\end\\\n", ARPA_STRICT, 5, `\1-grams:`},
+		{"\\data\\\nngram 1=2\n\\1-grams:\n-1 a\n-2 a\n\\end\\\n", ARPA_DEFAULT, 0, ""},
+		// Orders beyond any model.
+		{"\\data\\\nngram 1=1\n\\1-grams:\n-1 a\n\\256-grams:\n\\end\\\n", ARPA_DEFAULT, 5, `\256-grams:`},
+		{"\\data\\\n\\1000000000000-grams:\n-1 a\n\\end\\\n", ARPA_LENIENT, 2, `\1000000000000-grams:`},
+		{"\\data\\\nngram 1=1\n\\1000000000000-grams:\n-1 a\n\\end\\\n", ARPA_STRICT, 3, `\1000000000000-grams:`},
+		// Missing prefixes.
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\1-grams:\n-1 a\n\\2-grams:\n-1 b a\n\\end\\\n", ARPA_STRICT, 7, `\2-grams:`},
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\1-grams:\n-1 </s>\n\\2-grams:\n-1 </s> a\n\\end\\\n", ARPA_STRICT, 7, `\2-grams:`},
+		{"\\data\\\nngram 1=1\nngram 2=1\n\\1-grams:\n-1 a\n\\2-grams:\n-1 b a\n\\end\\\n", ARPA_DEFAULT, 0, ""},
+	}
+}
+
+func TestFromARPAModes(t *testing.T) {
+	for _, i := range arpaModeTests(t) {
+		_, err := FromARPA(strings.NewReader(i.ARPA), ARPAOptions{Mode: i.Mode})
+		checkARPAError(i, err, t)
+	}
+}
+
+func checkARPAError(i arpaModeTest, err error, t *testing.T) {
+	if i.Line == 0 {
+		if err != nil {
+			t.Errorf("case %q (mode %d): unexpected error: %v", i.ARPA, i.Mode, err)
+		}
+		return
+	}
+	var arpaErr *ARPAError
+	if !errors.As(err, &arpaErr) {
+		t.Errorf("case %q (mode %d): expect *ARPAError; got %v", i.ARPA, i.Mode, err)
+		return
+	}
+	if arpaErr.Line != i.Line || arpaErr.Section != i.Section {
+		t.Errorf("case %q (mode %d): expect error at line %d in %s; got %v", i.ARPA, i.Mode, i.Line, i.Section, err)
+	}
+}
+
+func TestFromARPAWorkers(t *testing.T) {
+	defer func(n int) { arpaBatchSize = n }(arpaBatchSize)
+	arpaBatchSize = 100
+	arpa := syntheticARPA(200, 4, 2000, 1)
+	// A bad entry in the middle of a batch of 4-grams.
+	lines := strings.Split(arpa, "\n")
+	badLine := len(lines) - 40
+	lines[badLine-1] = "-1 w1 w2"
+	bad := strings.Join(lines, "\n")
+
+	buildTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	var hashed, sorted [][]byte
+	for _, workers := range []int{1, 2, 5} {
+		opts := ARPAOptions{Mode: ARPA_STRICT, Workers: workers}
+		builder, err := FromARPA(strings.NewReader(arpa), opts)
+		if err != nil {
+			t.Fatalf("workers = %d: unexpected error: %v", workers, err)
+		}
+		// A fixed build time so that the binaries are reproducible.
+		builder.Info().BuildTime = buildTime
+		hashed = append(hashed, binaryBytes(builder.DumpHashed(0), t))
+		builder, _ = FromARPA(strings.NewReader(arpa), opts)
+		builder.Info().BuildTime = buildTime
+		sorted = append(sorted, binaryBytes(builder.DumpSorted(), t))
+
+		_, err = FromARPA(strings.NewReader(bad), opts)
+		var arpaErr *ARPAError
+		if !errors.As(err, &arpaErr) || arpaErr.Line != badLine || arpaErr.Section != `\4-grams:` {
+			t.Errorf("workers = %d: expect error at line %d in \\4-grams:; got %v", workers, badLine, err)
+		}
+	}
+	for i := range hashed[1:] {
+		if !bytes.Equal(hashed[0], hashed[i+1]) {
+			t.Errorf("hashed binary differs with different number of workers")
+		}
+		if !bytes.Equal(sorted[0], sorted[i+1]) {
+			t.Errorf("sorted binary differs with different number of workers")
+		}
+	}
+}
+
+// binaryBytes returns the binary form of m.
+func binaryBytes(m interface{ WriteBinary(string) error }, t *testing.T) []byte {
+	f, err := os.CreateTemp("", "binary.")
+	if err != nil {
+		t.Fatalf("error in creating temporary file: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+	if err := m.WriteBinary(path); err != nil {
+		t.Fatalf("error in writing binary: %v", err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error in reading binary: %v", err)
+	}
+	return raw
+}
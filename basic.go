@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"iter"
 	"math"
 	"strconv"
 
@@ -68,6 +69,15 @@ type Model interface {
 	// <s>. The user should never explicitly query <s>, which has
 	// undefined behavior (see NextI).
 	Start() StateId
+	// StartEmpty returns the state with the empty context, i.e. the
+	// unigram state. It is used to score a fragment that does not
+	// necessarily start a sentence (a phrase, a snippet, etc.). NextI
+	// from it gives the unigram weight of x and leads to the state of
+	// the longest context ending in x, just as from any other state
+	// that has backed off to the empty context; Final from it gives the
+	// unigram weight of </s>, which should only be added when the
+	// fragment does end a sentence.
+	StartEmpty() StateId
 	// NextI finds out the next state to go from p consuming x. x can
 	// not be <s> or </s>, in which case the result is undefined, but
 	// can be word.NIL. Any x that is not part of the model's vocabulary
@@ -89,6 +99,36 @@ type Model interface {
 	Vocab() (vocab *word.Vocab, bos, eos string, bosId, eosId word.Id)
 }
 
+// Vocabulary looks up the ids of words and the words of ids. The
+// models of this package implement it by looking up words in place in
+// the binary they are loaded from, whereas their Vocab has to build a
+// word.Vocab on the first call.
+type Vocabulary interface {
+	IdOf(s string) word.Id
+	StringOf(x word.Id) string
+}
+
+// VocabOf returns m itself when it is a Vocabulary and the vocabulary
+// returned by its Vocab otherwise.
+func VocabOf(m Model) Vocabulary {
+	if v, ok := m.(Vocabulary); ok {
+		return v
+	}
+	vocab, _, _, _, _ := m.Vocab()
+	return vocab
+}
+
+// BatchModel is a language model that can look up many pairs of state
+// and word at once, which is faster than one NextI after another when
+// the pairs are independent, e.g. the hypotheses of a beam.
+type BatchModel interface {
+	Model
+	// NextBatch sets qs[i] and ws[i] to what NextI(ps[i], xs[i])
+	// returns. All four slices must be of the same length, but qs may
+	// be ps itself.
+	NextBatch(ps []StateId, xs []word.Id, qs []StateId, ws []Weight)
+}
+
 // IterableModel is a language model whose states and transitions can
 // be iterated.
 type IterableModel interface {
@@ -96,20 +136,41 @@ type IterableModel interface {
 	// NumStates returns the number of states. StateIds are always from
 	// 0 to (the number of states - 1).
 	NumStates() int
-	// Transitions returns a channel that can be used to iterate over
-	// the non-back-off transitions from a given state.
-	Transitions(p StateId) chan WordStateWeight
+	// Transitions returns an iterator over the non-back-off
+	// transitions from a given state. The iteration can be stopped at
+	// any time.
+	Transitions(p StateId) iter.Seq[WordStateWeight]
+	// NumTransitions returns the number of non-back-off transitions
+	// from a given state, i.e. the number of items Transitions(p)
+	// yields.
+	NumTransitions(p StateId) int
 	// BackOff returns the back off state and weight of p. The back off
 	// state of the empty context is STATE_NIL and its weight is
 	// arbitrary.
 	BackOff(p StateId) (q StateId, w Weight)
 }
 
+// ContextModel is an iterable language model that also knows the
+// context each state represents.
+type ContextModel interface {
+	IterableModel
+	// StateContext returns the context of p, oldest word first, e.g.
+	// [<s> a] for the state reached after consuming "a" from Start()
+	// in a trigram model with "<s> a b" in it. The context of the empty
+	// state is empty.
+	StateContext(p StateId) []word.Id
+	// StateOrder returns the length of the context of p without
+	// building it. Note the state reached by consuming a word may
+	// represent a context shorter than the n-gram that has been matched
+	// when the n-gram itself is not extended by any longer n-gram.
+	StateOrder(p StateId) int
+}
+
 // Graphviz prints out the finite-state topology of the model that can
 // be visualized with Graphviz. Mostly for debugging; could be quite
 // slow.
 func Graphviz(m IterableModel, w io.Writer) {
-	vocab, _, _, _, _ := m.Vocab()
+	vocab := VocabOf(m)
 	fmt.Fprintln(w, "digraph {")
 	fmt.Fprintln(w, "  // lexical transitions")
 	for i := 0; i < m.NumStates(); i++ {
@@ -131,10 +192,20 @@ func Graphviz(m IterableModel, w io.Writer) {
 const (
 	MODEL_HASHED = iota
 	MODEL_SORTED
+	MODEL_QUANTIZED
+	MODEL_TRIE
+	MODEL_PROBING
+	MODEL_HYBRID
 )
 
 // Magic words for binary formats.
 const (
-	MAGIC_HASHED = "#fslm.hash"
-	MAGIC_SORTED = "#fslm.sort"
+	MAGIC_HASHED    = "#fslm.hash"
+	MAGIC_SORTED    = "#fslm.sort"
+	MAGIC_QUANTIZED = "#fslm.quant"
+	MAGIC_TRIE      = "#fslm.trie"
+	MAGIC_PROBING   = "#fslm.probe"
+	MAGIC_HYBRID    = "#fslm.hybrid"
+	// Starts the block of ModelInfo.
+	MAGIC_INFO = "#fslm.info"
 )
@@ -0,0 +1,150 @@
+package fslm
+
+// Batch look-ups of Hashed and Sorted (see BatchModel).
+//
+// A look-up from a state that is not in the cache waits for the offsets
+// of the state, then for its transitions, often once more for every
+// back-off. NextBatch instead takes the pairs a chunk of batchSize at a
+// time and advances all of them by one step before any of them takes
+// the next: all the offsets are loaded, then the first transition each
+// pair probes, and so on, so that the cache misses of the pairs are
+// independent loads that the processor overlaps. The pairs that do not
+// find their word take the back-off of their state together in the
+// next step, until they reach _STATE_EMPTY, where NextI takes a single
+// load from its dense array.
+
+import (
+	"fmt"
+
+	"github.com/kho/word"
+)
+
+// batchSize is the number of pairs that advance in lockstep, about as
+// many as the cache misses a processor can have in flight several
+// times over.
+const batchSize = 32
+
+// batchPair is a pair of a batch that is still being looked up.
+type batchPair struct {
+	// The position of the pair in the arguments of NextBatch.
+	i int
+	// The word to consume from the current state p, with the weight w
+	// of the back-offs taken so far.
+	x word.Id
+	p StateId
+	w Weight
+	// Where the model is in its search of the transitions of p; each
+	// model has its own use of them.
+	lo, hi, k int
+}
+
+// batchSink takes the words of the entries that a step loads only to
+// bring them into the cache, so that the compiler keeps the loads.
+var batchSink word.Id
+
+// batchStep advances every pair of pending by one state: a pair that
+// finds its word gets its result written to qs and ws; the others take
+// the back-off of their state and are returned in the storage of
+// pending, except those backing off to _STATE_EMPTY, which NextI
+// finishes.
+type batchStep func(pending []batchPair, qs []StateId, ws []Weight) []batchPair
+
+// nextBatch implements NextBatch for a model of the given dense states
+// with step. nextI is the model's NextI, which finishes the pairs from
+// _STATE_EMPTY and the dense _STATE_START.
+func (d denseStates) nextBatch(ps []StateId, xs []word.Id, qs []StateId, ws []Weight, step batchStep, nextI func(StateId, word.Id) (StateId, Weight)) {
+	if len(xs) != len(ps) || len(qs) != len(ps) || len(ws) != len(ps) {
+		panic(fmt.Sprintf("NextBatch of %d states, %d words, %d next states and %d weights", len(ps), len(xs), len(qs), len(ws)))
+	}
+	var buf [batchSize]batchPair
+	for base := 0; base < len(ps); base += batchSize {
+		pending := buf[:0]
+		for i := base; i < min(len(ps), base+batchSize); i++ {
+			p, x := ps[i], xs[i]
+			if p == _STATE_EMPTY || p == _STATE_START && d.start != nil {
+				qs[i], ws[i] = nextI(p, x)
+			} else {
+				pending = append(pending, batchPair{i: i, x: x, p: p})
+			}
+		}
+		for len(pending) > 0 {
+			pending = step(pending, qs, ws)
+		}
+	}
+}
+
+// NextBatch looks up many pairs at once; see BatchModel.
+func (m *Hashed) NextBatch(ps []StateId, xs []word.Id, qs []StateId, ws []Weight) {
+	m.dense.nextBatch(ps, xs, qs, ws, m.nextBatchStep, m.NextI)
+}
+
+func (m *Hashed) nextBatchStep(pending []batchPair, qs []StateId, ws []Weight) []batchPair {
+	for j := range pending {
+		b := &pending[j]
+		b.lo, b.hi = int(m.offsets[b.p]), int(m.offsets[b.p+1])
+	}
+	// Touch the first bucket each search probes, so that the searches
+	// below start from the cache; probing past it is rarely needed.
+	var sink word.Id
+	for j := range pending {
+		b := &pending[j]
+		b.k = int(m.firstBucket(uint64(b.lo), uint64(b.hi), b.x))
+		sink ^= m.entries[b.k].Key
+	}
+	batchSink = sink
+	n := 0
+	for j := range pending {
+		b := &pending[j]
+		if e := m.search(uint64(b.lo), uint64(b.hi), uint64(b.k), b.x); e.Key != word.NIL {
+			qs[b.i], ws[b.i] = e.Value.State, b.w+e.Value.Weight
+		} else if e.Value.State == _STATE_EMPTY {
+			q, w := m.NextI(_STATE_EMPTY, b.x)
+			qs[b.i], ws[b.i] = q, b.w+e.Value.Weight+w
+		} else {
+			b.p, b.w = e.Value.State, b.w+e.Value.Weight
+			pending[n] = *b
+			n++
+		}
+	}
+	return pending[:n]
+}
+
+// NextBatch looks up many pairs at once; see BatchModel.
+func (m *Sorted) NextBatch(ps []StateId, xs []word.Id, qs []StateId, ws []Weight) {
+	m.dense.nextBatch(ps, xs, qs, ws, m.nextBatchStep, m.NextI)
+}
+
+func (m *Sorted) nextBatchStep(pending []batchPair, qs []StateId, ws []Weight) []batchPair {
+	for j := range pending {
+		b := &pending[j]
+		b.lo, b.hi = int(m.offsets[b.p]), int(m.offsets[b.p+1])
+	}
+	// Load the first transition each search takes, the root of the
+	// tree or the middle of the array, so that the searches below
+	// start from the cache.
+	var sink word.Id
+	for j := range pending {
+		b := &pending[j]
+		k := b.lo
+		if !m.eytzinger {
+			k += (b.hi - b.lo) >> 1
+		}
+		sink ^= m.entries[k].Word
+	}
+	batchSink = sink
+	n := 0
+	for j := range pending {
+		b := &pending[j]
+		if e := m.search(m.entries[b.lo:b.hi], b.x); e.Word != word.NIL {
+			qs[b.i], ws[b.i] = e.State, b.w+e.Weight
+		} else if e.State == _STATE_EMPTY {
+			q, w := m.NextI(_STATE_EMPTY, b.x)
+			qs[b.i], ws[b.i] = q, b.w+e.Weight+w
+		} else {
+			b.p, b.w = e.State, b.w+e.Weight
+			pending[n] = *b
+			n++
+		}
+	}
+	return pending[:n]
+}
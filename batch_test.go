@@ -0,0 +1,89 @@
+package fslm
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestNextBatch(t *testing.T) {
+	arpa := syntheticARPA(300, 4, 3000, 1)
+	var models []BatchModel
+	for _, i := range []struct {
+		Sorted, DenseStart, Layout bool
+	}{{false, false, false}, {false, true, false}, {false, true, true}, {true, false, false}, {true, true, false}, {true, true, true}} {
+		builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		builder.SetDenseStart(i.DenseStart)
+		// Robin Hood tables for Hashed and the Eytzinger layout for Sorted.
+		builder.SetRobinHood(i.Layout)
+		builder.SetEytzinger(i.Layout)
+		if i.Sorted {
+			models = append(models, builder.DumpSorted())
+		} else {
+			models = append(models, builder.DumpHashed(0))
+		}
+	}
+	// Without the dense states, as if loaded from binaries of version 1.
+	sparseHashed := withFullEmpty(models[0].(*Hashed)).(*Hashed)
+	sparseSorted := withFullEmpty(models[3].(*Sorted)).(*Sorted)
+	sparseHashed.dense, sparseSorted.dense = denseStates{}, denseStates{}
+	models = append(models, sparseHashed, sparseSorted)
+
+	r := rand.New(rand.NewSource(1))
+	for _, m := range models {
+		numStates := m.(IterableModel).NumStates()
+		for _, n := range []int{0, 1, batchSize - 1, batchSize, 3*batchSize + 5} {
+			ps, xs := make([]StateId, n), make([]word.Id, n)
+			for i := range ps {
+				ps[i] = StateId(r.Intn(numStates))
+				switch r.Intn(10) {
+				case 0, 1, 2, 3, 4:
+					// A word p has a transition for, if any.
+					for xqw := range m.(IterableModel).Transitions(ps[i]) {
+						xs[i] = xqw.Word
+						if r.Intn(4) == 0 {
+							break
+						}
+					}
+				case 5:
+					xs[i] = word.NIL
+				case 6:
+					// An OOV.
+					xs[i] = word.Id(400 + r.Intn(10))
+				default:
+					xs[i] = word.Id(r.Intn(302))
+				}
+			}
+			qs, ws := make([]StateId, n), make([]Weight, n)
+			m.NextBatch(ps, xs, qs, ws)
+			for i := range ps {
+				q, w := m.NextI(ps[i], xs[i])
+				if qs[i] != q || ws[i] != w {
+					t.Errorf("%T: expect (%d, %g) from state %d consuming %d; got (%d, %g)", m, q, w, ps[i], xs[i], qs[i], ws[i])
+				}
+			}
+			// In place.
+			m.NextBatch(ps, xs, ps, ws)
+			for i := range ps {
+				if ps[i] != qs[i] {
+					t.Errorf("%T: expect state %d in place; got %d", m, qs[i], ps[i])
+				}
+			}
+		}
+	}
+}
+
+func TestNextBatchLengths(t *testing.T) {
+	m := readyBuilder(simpleTrigramLM).DumpSorted()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expect panic with slices of different lengths")
+		}
+	}()
+	m.NextBatch(make([]StateId, 2), make([]word.Id, 2), make([]StateId, 1), make([]Weight, 2))
+}
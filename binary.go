@@ -0,0 +1,605 @@
+package fslm
+
+// Pieces of the binary format shared by the models and
+// ExternalBuilder.
+//
+// A binary consists of the following blocks (see package byteblock):
+//
+//	magic      MAGIC_HASHED, MAGIC_SORTED, MAGIC_QUANTIZED, MAGIC_TRIE,
+//	           MAGIC_PROBING or MAGIC_HYBRID
+//	info       MAGIC_INFO followed by the gob-encoded ModelInfo
+//	header     gob-encoded sentence boundary symbols, number of
+//	           entries of each state (only in version 1) and what
+//	           else the model needs
+//	vocab      the vocabulary (see vocabBlock)
+//	entries    entries of all the states in ModelInfo.Layout, which
+//	           for Hashed and Sorted start with the offsets of the
+//	           entries of each state (see sliceOffsets) and end with
+//	           the dense states (see denseStates; see Quantized, Trie,
+//	           Probing and Hybrid for theirs)
+//	links      state links (see stateLink) in ModelInfo.Layout; empty
+//	           for Trie, whose links are implicit
+//	folded     source weights of the folded n-grams (see arpaEntry) in
+//	           ModelInfo.Layout
+//	checksums  CRC-32C of each of the above blocks as little-endian
+//	           uint32 (only when ModelInfo.Checksum is CHECKSUM_CRC32C)
+//
+// Binaries of version 1 have no offsets or dense states but the number
+// of entries of each state in the header, and no vocab block but the
+// gob-encoded word.Vocab at the start of the header. They also have no
+// info and checksums blocks and may not have the links and folded
+// blocks either.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/kho/byteblock"
+	"github.com/kho/word"
+)
+
+// BINARY_VERSION is the version of the binary format written by this
+// package.
+const BINARY_VERSION = 2
+
+// Checksum algorithms for ModelInfo.Checksum.
+const (
+	CHECKSUM_NONE   = ""
+	CHECKSUM_CRC32C = "crc32c"
+)
+
+// ModelInfo describes a binary model: its format, its n-grams and how
+// it was built. Only Version is known for binaries of version 1.
+type ModelInfo struct {
+	// Version of the binary format.
+	Version int
+	// The order of the model (i.e. the length of the longest n-gram)
+	// and the number of n-grams of each order starting from unigrams,
+	// as found in the model. These are filled in when the binary is
+	// written.
+	Order  int
+	Counts []int
+	// Name (e.g. path), size in bytes and hex-encoded SHA-256 of the
+	// source ARPA file (after decompression), when known.
+	Source       string
+	SourceSize   int64
+	SourceSHA256 string
+	// Free-form description of the options the model was built with.
+	Options string
+	// The layout of entries, state links and folded n-grams (see
+	// LAYOUT_LE32); filled in when the binary is written.
+	Layout string
+	// When the binary was written; filled in when it is zero.
+	BuildTime time.Time
+	// The checksum algorithm over the blocks of the binary.
+	Checksum string
+}
+
+// encodeHeader encodes the header block of a binary model: the
+// sentence boundary symbols, the number of entries of each state
+// (whose meaning depends on the model; nil for models that record
+// their states otherwise) and extra values of the model.
+func encodeHeader(bos, eos string, sizes []int, extra ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(bos); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(eos); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(sizes); err != nil {
+		return nil, err
+	}
+	for _, i := range extra {
+		if err := enc.Encode(i); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// modelHeader is what the header and vocab blocks of a binary tell.
+type modelHeader struct {
+	vocab        *modelVocab
+	bos, eos     string
+	bosId, eosId word.Id
+	sizes        []int
+}
+
+// parseHeader parses the header and vocab blocks, decoding the extra
+// values written by encodeHeader into extra.
+func (b *binaryBlocks) parseHeader(extra ...interface{}) (*modelHeader, error) {
+	h := &modelHeader{vocab: &modelVocab{}}
+	dec := gob.NewDecoder(bytes.NewReader(b.header))
+	if b.info.Version == 1 {
+		if err := dec.Decode(&h.vocab.vocab); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if h.vocab.block, err = parseVocab(b.vocab); err != nil {
+			return nil, err
+		}
+	}
+	if err := dec.Decode(&h.bos); err != nil {
+		return nil, err
+	}
+	if err := dec.Decode(&h.eos); err != nil {
+		return nil, err
+	}
+	if h.bosId = h.vocab.IdOf(h.bos); h.bosId == word.NIL {
+		return nil, errors.New(h.bos + " not in vocabulary")
+	}
+	if h.eosId = h.vocab.IdOf(h.eos); h.eosId == word.NIL {
+		return nil, errors.New(h.eos + " not in vocabulary")
+	}
+	if err := dec.Decode(&h.sizes); err != nil {
+		return nil, err
+	}
+	for _, i := range extra {
+		if err := dec.Decode(i); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// encodeModelVocab encodes the vocab block of a model with the given
+// largest word id of its transitions.
+func encodeModelVocab(vocab interface{ StringOf(word.Id) string }, maxId, bosId, eosId word.Id) ([]byte, error) {
+	maxId = maxWordId(maxWordId(maxId, bosId), eosId)
+	return encodeVocab(vocabWords(vocab, maxId))
+}
+
+// maxWordId returns the larger of a and b, where word.NIL is taken as
+// the smallest.
+func maxWordId(a, b word.Id) word.Id {
+	if a == word.NIL || (b != word.NIL && b > a) {
+		return b
+	}
+	return a
+}
+
+// countNgrams counts the n-grams of each order in m, i.e. the lexical
+// transitions of the states by their context lengths.
+func countNgrams(m ContextModel) []int {
+	var counts []int
+	for i := 0; i < m.NumStates(); i++ {
+		p := StateId(i)
+		n := m.StateOrder(p) + 1
+		for len(counts) < n {
+			counts = append(counts, 0)
+		}
+		counts[n-1] += m.NumTransitions(p)
+	}
+	// States of the highest context lengths may only have been pruned
+	// n-grams.
+	for len(counts) > 0 && counts[len(counts)-1] == 0 {
+		counts = counts[:len(counts)-1]
+	}
+	return counts
+}
+
+// blockWriter wraps a ByteBlockWriter to keep the CRC-32C of each
+// block.
+type blockWriter struct {
+	bw   *byteblock.ByteBlockWriter
+	crcs []uint32
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func (w *blockWriter) WriteString(s string, align int64) error {
+	w.crcs = append(w.crcs, crc32.Checksum([]byte(s), crc32c))
+	return w.bw.WriteString(s, align)
+}
+
+func (w *blockWriter) Write(b []byte, align int64) error {
+	w.crcs = append(w.crcs, crc32.Checksum(b, crc32c))
+	return w.bw.Write(b, align)
+}
+
+func (w *blockWriter) NewBlock(align, size int64) error {
+	w.crcs = append(w.crcs, 0)
+	return w.bw.NewBlock(align, size)
+}
+
+func (w *blockWriter) Append(b []byte) error {
+	w.crcs[len(w.crcs)-1] = crc32.Update(w.crcs[len(w.crcs)-1], crc32c, b)
+	return w.bw.Append(b)
+}
+
+// writeBinary writes a binary model to out and returns the number of
+// bytes written. info is completed with the version, layout and build
+// time; entries appends the entries in LAYOUT_LE32, entryBytes bytes
+// in total, to the current block.
+func writeBinary(out io.Writer, magic string, info ModelInfo, header, vocab []byte, entryBytes int64, entries func(*blockWriter) error, links stateLinks, folded []arpaEntry) (n int64, err error) {
+	cw := &countingWriter{w: out}
+	defer func() { n = cw.n }()
+	w := &blockWriter{bw: byteblock.NewByteBlockWriter(cw)}
+	if err = w.WriteString(magic, 0); err != nil {
+		return
+	}
+	// Info
+	info.Version = BINARY_VERSION
+	info.Layout = LAYOUT_LE32
+	if info.BuildTime.IsZero() {
+		info.BuildTime = time.Now()
+	}
+	if info.Checksum != CHECKSUM_NONE && info.Checksum != CHECKSUM_CRC32C {
+		err = fmt.Errorf("unknown checksum algorithm %q", info.Checksum)
+		return
+	}
+	var buf bytes.Buffer
+	buf.WriteString(MAGIC_INFO)
+	if err = gob.NewEncoder(&buf).Encode(info); err != nil {
+		return
+	}
+	if err = w.Write(buf.Bytes(), 0); err != nil {
+		return
+	}
+	// Header
+	if err = w.Write(header, 0); err != nil {
+		return
+	}
+	// Vocab
+	if err = w.Write(vocab, _LAYOUT_ALIGN); err != nil {
+		return
+	}
+	// Raw entries. Ask for a large new block and then incrementally
+	// write out the data.
+	if err = w.NewBlock(_OFFSET_SIZE, entryBytes); err != nil {
+		return
+	}
+	if err = entries(w); err != nil {
+		return
+	}
+	// State links.
+	if err = writeStateLinks(w, links); err != nil {
+		return
+	}
+	// Folded n-grams.
+	if err = w.Write(arpaEntryBytes(folded), _LAYOUT_ALIGN); err != nil {
+		return
+	}
+	// Checksums.
+	if info.Checksum == CHECKSUM_CRC32C {
+		crcs := make([]byte, 0, 4*len(w.crcs))
+		for _, crc := range w.crcs {
+			crcs = binary.LittleEndian.AppendUint32(crcs, crc)
+		}
+		err = w.bw.Write(crcs, 0)
+	}
+	return
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// binaryBlocks are the blocks sliced out of a binary model.
+type binaryBlocks struct {
+	info          ModelInfo
+	magic         []byte
+	infoBlock     []byte // nil for version 1
+	header        []byte
+	vocab         []byte // nil for version 1
+	entries       []byte
+	links, folded []byte // nil when missing
+	checksums     []byte // nil when missing
+}
+
+// sliceBinary slices out the blocks of a binary model with the given
+// magic ("" for any). A binary that should have links or checksums
+// but does not is reported as truncated.
+func sliceBinary(raw []byte, magic string) (*binaryBlocks, error) {
+	bs := byteblock.NewByteBlockSlicer(raw)
+	var b binaryBlocks
+	var err error
+	if b.magic, err = bs.Slice(); err != nil {
+		return nil, err
+	}
+	if (magic != "" && string(b.magic) != magic) || (magic == "" && !isModelMagic(string(b.magic))) {
+		return nil, errors.New("not a FSLM binary file")
+	}
+	next, err := bs.Slice()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(next, []byte(MAGIC_INFO)) {
+		b.infoBlock = next
+		if err = gob.NewDecoder(bytes.NewReader(next[len(MAGIC_INFO):])).Decode(&b.info); err != nil {
+			return nil, fmt.Errorf("bad model info: %v", err)
+		}
+		if b.info.Version > BINARY_VERSION {
+			return nil, fmt.Errorf("binary format version %d is newer than the supported version %d", b.info.Version, BINARY_VERSION)
+		}
+		if b.info.Layout != LAYOUT_LE32 {
+			return nil, fmt.Errorf("unsupported binary layout %q", b.info.Layout)
+		}
+		if b.header, err = bs.Slice(); err != nil {
+			return nil, err
+		}
+	} else {
+		b.info.Version = 1
+		b.header = next
+	}
+	if b.info.Version > 1 {
+		if b.vocab, err = bs.Slice(); err != nil {
+			return nil, err
+		}
+	}
+	if b.entries, err = bs.Slice(); err != nil {
+		return nil, err
+	}
+	if b.links, err = bs.Slice(); err != nil {
+		if b.info.Version > 1 {
+			return nil, errors.New("truncated binary: missing state links")
+		}
+		b.links = nil
+	}
+	if b.folded, err = bs.Slice(); err != nil {
+		if b.info.Version > 1 {
+			return nil, errors.New("truncated binary: missing folded n-grams")
+		}
+		b.folded = nil
+	}
+	if b.info.Checksum == CHECKSUM_CRC32C {
+		if b.checksums, err = bs.Slice(); err != nil || len(b.checksums) != 4*len(b.checksummed()) {
+			return nil, errors.New("truncated binary: missing checksums")
+		}
+	}
+	return &b, nil
+}
+
+// isModelMagic tells whether magic starts a binary of one of the
+// models of this package.
+func isModelMagic(magic string) bool {
+	switch magic {
+	case MAGIC_HASHED, MAGIC_SORTED, MAGIC_QUANTIZED, MAGIC_TRIE, MAGIC_PROBING, MAGIC_HYBRID:
+		return true
+	}
+	return false
+}
+
+// checksummed returns the blocks covered by the checksums.
+func (b *binaryBlocks) checksummed() [][]byte {
+	return [][]byte{b.magic, b.infoBlock, b.header, b.vocab, b.entries, b.links, b.folded}
+}
+
+// VerifyBinary verifies the checksums of a binary model. It reads the
+// whole binary and is thus not done when loading a model. A binary
+// without checksums (see ModelInfo.Checksum) always passes.
+func VerifyBinary(raw []byte) error {
+	b, err := sliceBinary(raw, "")
+	if err != nil {
+		return err
+	}
+	if b.checksums == nil {
+		return nil
+	}
+	for i, block := range b.checksummed() {
+		expected := binary.LittleEndian.Uint32(b.checksums[4*i:])
+		if crc := crc32.Checksum(block, crc32c); crc != expected {
+			return fmt.Errorf("checksum mismatch in block %d: expect %08x; got %08x", i, expected, crc)
+		}
+	}
+	return nil
+}
+
+// checkNumEntries checks that the entry block of total entries holds
+// exactly the entries of all the states, where each state has
+// numEntries[i]+extra entries.
+func checkNumEntries(numEntries []int, extra, total int) error {
+	sum := 0
+	for i, n := range numEntries {
+		if n+extra < 0 || sum+n+extra > total {
+			return fmt.Errorf("bad binary: state %d has %d entries beyond the %d in the entry block", i, n+extra, total)
+		}
+		sum += n + extra
+	}
+	if sum != total {
+		return fmt.Errorf("bad binary: header has %d entries but the entry block has %d", sum, total)
+	}
+	return nil
+}
+
+// sliceOffsets slices the entry block of a Hashed or Sorted binary
+// into the offsets of the entries of numStates states, which are
+// numStates + 1 little-endian uint64 with the last one being the total
+// number of entries, and the entries of the given size following them.
+// Both are backed by raw on little-endian hosts. Only the last offset
+// is checked; see validateOffsets for the rest.
+func sliceOffsets(raw []byte, numStates, entrySize int) ([]uint64, []byte, error) {
+	if numStates < 0 || uint64(numStates) >= uint64(len(raw))/_OFFSET_SIZE {
+		return nil, nil, fmt.Errorf("bad binary: entry block of %d bytes for %d states", len(raw), numStates)
+	}
+	n := (numStates + 1) * _OFFSET_SIZE
+	offsets, entries := parseOffsets(raw[:n]), raw[n:]
+	if last := offsets[numStates]; last != uint64(len(entries)/entrySize) || len(entries)%entrySize != 0 {
+		return nil, nil, fmt.Errorf("bad binary: offsets end at %d but the entry block has %d bytes of entries", last, len(entries))
+	}
+	return offsets, entries, nil
+}
+
+// sizesToOffsets finds the offsets of the entries of each state from
+// the header of a binary of version 1, which has the number of entries
+// of each state less extra.
+func sizesToOffsets(sizes []int, extra, total int) ([]uint64, error) {
+	if err := checkNumEntries(sizes, extra, total); err != nil {
+		return nil, err
+	}
+	offsets := make([]uint64, len(sizes)+1)
+	for i, n := range sizes {
+		offsets[i+1] = offsets[i] + uint64(n+extra)
+	}
+	return offsets, nil
+}
+
+// validateOffsets checks that the offsets of the entries of each state
+// start from 0 and that every state has at least min entries.
+func validateOffsets(offsets []uint64, min uint64) error {
+	if offsets[0] != 0 {
+		return fmt.Errorf("bad binary: entries start at %d", offsets[0])
+	}
+	for i := 1; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] || offsets[i]-offsets[i-1] < min {
+			return fmt.Errorf("bad binary: state %d has entries from %d to %d", i-1, offsets[i-1], offsets[i])
+		}
+	}
+	return nil
+}
+
+// parseEntries parses the header and entry blocks of a Hashed or
+// Sorted binary, every state of which has at least min entries, into
+// the header, the offsets and the dense states, which version 1 does
+// not have. parse parses the entries between the offsets and the dense
+// states and returns their number. The extra values of the model after
+// the dense header are decoded into extra unless the binary is of
+// version 1, which has none.
+func (b *binaryBlocks) parseEntries(min int, parse func(raw []byte) int, extra ...interface{}) (*modelHeader, []uint64, denseStates, error) {
+	if b.info.Version == 1 {
+		h, err := b.parseHeader()
+		if err != nil {
+			return nil, nil, denseStates{}, err
+		}
+		offsets, err := sizesToOffsets(h.sizes, min, parse(b.entries))
+		return h, offsets, denseStates{}, err
+	}
+	var (
+		numStates int
+		dh        denseHeader
+	)
+	h, err := b.parseHeader(append([]interface{}{&numStates, &dh}, extra...)...)
+	if err != nil {
+		return nil, nil, denseStates{}, err
+	}
+	dense, raw, err := sliceDenseStates(b.entries, dh)
+	if err != nil {
+		return nil, nil, denseStates{}, err
+	}
+	offsets, entries, err := sliceOffsets(raw, numStates, _ENTRY_SIZE)
+	if err != nil {
+		return nil, nil, denseStates{}, err
+	}
+	parse(entries)
+	return h, offsets, dense, nil
+}
+
+// parseLinks parses the links block of a Hashed or Sorted binary with
+// the given offsets. Binaries written before state links were stored
+// do not have them, in which case they are recovered from the
+// transitions of m once the offsets are checked against min.
+func (b *binaryBlocks) parseLinks(m IterableModel, offsets []uint64, min int) (stateLinks, error) {
+	numStates := len(offsets) - 1
+	if b.links == nil {
+		if err := validateOffsets(offsets, uint64(min)); err != nil {
+			return nil, err
+		}
+		return findStateLinks(m), nil
+	}
+	links := parseStateLinks(b.links, numStates, b.info.Layout)
+	if links == nil {
+		return nil, fmt.Errorf("bad binary: links block of %d bytes for %d states", len(b.links), numStates)
+	}
+	return links, nil
+}
+
+// validateStates checks the parts common to all models loaded from a
+// binary: there are at least _STATE_EMPTY and _STATE_START, following
+// the back-offs or the links from any state leads to _STATE_EMPTY,
+// _STATE_EMPTY links to STATE_NIL and every other state links by a
+// word below vocabBound. backOff is not called on _STATE_EMPTY, whose
+// back-off is never followed.
+func validateStates(numStates int, backOff func(StateId) StateId, links stateLinks, vocabBound word.Id) error {
+	if numStates <= int(_STATE_START) {
+		return fmt.Errorf("bad binary: only %d states", numStates)
+	}
+	if links[_STATE_EMPTY].Parent != STATE_NIL {
+		return errors.New("bad binary: link of the empty state is not nil")
+	}
+	for i, l := range links[_STATE_EMPTY+1:] {
+		if l.Word >= vocabBound {
+			return fmt.Errorf("bad binary: state %d links by word %d, out of %d words", i+1, l.Word, vocabBound)
+		}
+	}
+	for _, i := range []struct {
+		What string
+		Next func(StateId) StateId
+	}{
+		{"back-off", backOff},
+		{"link", func(p StateId) StateId { return links[p].Parent }},
+	} {
+		if err := validateChains(numStates, i.What, i.Next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChains checks that following next from any state eventually
+// leads to _STATE_EMPTY.
+func validateChains(numStates int, what string, next func(StateId) StateId) error {
+	const (
+		unknown = iota
+		visiting
+		done
+	)
+	marks := make([]byte, numStates)
+	marks[_STATE_EMPTY] = done
+	var path []StateId
+	for i := range marks {
+		p := StateId(i)
+		for marks[p] == unknown {
+			marks[p] = visiting
+			path = append(path, p)
+			q := next(p)
+			if int64(q) >= int64(numStates) {
+				return fmt.Errorf("bad binary: %s of state %d is %d, out of %d states", what, p, q, numStates)
+			}
+			p = q
+		}
+		if marks[p] == visiting {
+			return fmt.Errorf("bad binary: state %d is on a cycle of %ss", p, what)
+		}
+		for _, q := range path {
+			marks[q] = done
+		}
+		path = path[:0]
+	}
+	return nil
+}
+
+// validateTransition checks that a lexical transition from p consumes
+// a word below vocabBound and leads to an existing state, or to
+// STATE_NIL when it consumes eos.
+func validateTransition(p StateId, xqw WordStateWeight, numStates int, vocabBound, eosId word.Id) error {
+	if xqw.Word == word.NIL {
+		return fmt.Errorf("bad binary: state %d has a lexical transition consuming nil", p)
+	}
+	if xqw.Word >= vocabBound {
+		return fmt.Errorf("bad binary: state %d has a lexical transition consuming %d, out of %d words", p, xqw.Word, vocabBound)
+	}
+	if xqw.State == STATE_NIL && xqw.Word == eosId {
+		return nil
+	}
+	if int64(xqw.State) >= int64(numStates) {
+		return fmt.Errorf("bad binary: transition of state %d consuming %d leads to state %d, out of %d states", p, xqw.Word, xqw.State, numStates)
+	}
+	return nil
+}
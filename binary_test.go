@@ -0,0 +1,408 @@
+package fslm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kho/byteblock"
+	"github.com/kho/word"
+)
+
+// binaryModel is implemented by both Hashed and Sorted.
+type binaryModel interface {
+	ContextModel
+	WriteBinary(string) error
+	UnsafeParseBinary([]byte) error
+	ParseBinary([]byte) error
+	Validate() error
+	Info() ModelInfo
+}
+
+// dumps dumps a builder into each kind of binaryModel, in the same
+// order as loadedModels.
+var dumps = []func(*Builder) binaryModel{
+	func(b *Builder) binaryModel { return b.DumpHashed(0) },
+	func(b *Builder) binaryModel { return b.DumpSorted() },
+}
+
+// loadedModels returns empty models to load binaries into.
+func loadedModels() []binaryModel {
+	return []binaryModel{new(Hashed), new(Sorted)}
+}
+
+func TestModelInfo(t *testing.T) {
+	arpa := syntheticARPA(50, 3, 300, 1)
+	for i, dump := range dumps {
+		builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		builder.Info().Source = "synthetic"
+		builder.Info().Options = "some options"
+		model := dump(builder)
+		loaded := loadedModels()[i]
+		if err := loaded.UnsafeParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("error in loading binary: %v", err)
+		}
+		info := loaded.Info()
+		if info.Version != BINARY_VERSION {
+			t.Errorf("expect version %d; got %d", BINARY_VERSION, info.Version)
+		}
+		// syntheticARPA always has n-grams of the highest order.
+		if expected := countNgrams(model); info.Order != 3 || !reflect.DeepEqual(info.Counts, expected) {
+			t.Errorf("expect order 3 and counts %v; got %d and %v", expected, info.Order, info.Counts)
+		}
+		if info.Source != "synthetic" || info.Options != "some options" || info.Checksum != CHECKSUM_CRC32C {
+			t.Errorf("unexpected info %+v", info)
+		}
+		if info.SourceSize != int64(len(arpa)) || len(info.SourceSHA256) != 64 {
+			t.Errorf("expect source size %d and a SHA-256; got %d and %q", len(arpa), info.SourceSize, info.SourceSHA256)
+		}
+		if time.Since(info.BuildTime) > time.Hour {
+			t.Errorf("unexpected build time %v", info.BuildTime)
+		}
+	}
+}
+
+func TestVerifyBinary(t *testing.T) {
+	for _, checksum := range []string{CHECKSUM_CRC32C, CHECKSUM_NONE} {
+		for _, dump := range dumps {
+			builder := readyBuilder(simpleTrigramLM)
+			builder.Info().Checksum = checksum
+			model := dump(builder)
+			raw := binaryBytes(model, t)
+			if err := VerifyBinary(raw); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			// Flip a bit in the entries.
+			blocks, err := sliceBinary(raw, "")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			blocks.entries[len(blocks.entries)/2] ^= 1
+			if err := VerifyBinary(raw); checksum == CHECKSUM_CRC32C && err == nil {
+				t.Errorf("expect checksum mismatch")
+			} else if checksum == CHECKSUM_NONE && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+func TestTruncatedBinary(t *testing.T) {
+	for i, dump := range dumps {
+		loaded := loadedModels()[i]
+		raw := binaryBytes(dump(readyBuilder(simpleTrigramLM)), t)
+		for _, n := range []int{1, len(raw) / 2, len(raw) - 1} {
+			if err := loaded.UnsafeParseBinary(raw[:n]); err == nil {
+				t.Errorf("expect error on binary truncated to %d out of %d bytes", n, len(raw))
+			}
+		}
+	}
+}
+
+// TestLoadAllocs checks that loading a binary allocates nothing per
+// state.
+func TestLoadAllocs(t *testing.T) {
+	if !nativeLE32 {
+		t.Skip("host is not compatible with LAYOUT_LE32")
+	}
+	for i, dump := range dumps {
+		var allocs []uint64
+		for _, numNgrams := range []int{100, 3000} {
+			builder, err := FromARPA(strings.NewReader(syntheticARPA(numNgrams/10, 3, numNgrams, 1)), ARPAOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			raw := binaryBytes(dump(builder), t)
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			for range 10 {
+				if err := loadedModels()[i].UnsafeParseBinary(raw); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			allocs = append(allocs, (after.TotalAlloc-before.TotalAlloc)/10)
+		}
+		// Allow for the larger vocab and counts in the gob blocks.
+		if allocs[1] > allocs[0]+1024 {
+			t.Errorf("model %d: expect about the same bytes allocated for any size; got %v", i, allocs)
+		}
+	}
+}
+
+func TestBinaryVersion1(t *testing.T) {
+	for i, dump := range dumps {
+		// Version 1 has no dense states, so the entries of _STATE_EMPTY
+		// have all its transitions.
+		model := withFullEmpty(dump(readyBuilder(simpleTrigramLM)))
+		vocab, _, _, _, _ := model.Vocab()
+		blocks, err := sliceBinary(binaryBytes(model, t), "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var (
+			numStates int
+			dh        denseHeader
+		)
+		h, err := blocks.parseHeader(&numStates, &dh)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, raw, err := sliceDenseStates(blocks.entries, dh)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// Version 1 has the number of buckets of each Hashed state or of
+		// lexical transitions of each Sorted state in the header instead
+		// of the offsets.
+		offsets, entries, err := sliceOffsets(raw, numStates, _ENTRY_SIZE)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sizes := make([]int, numStates)
+		for p := range sizes {
+			sizes[p] = int(offsets[p+1] - offsets[p])
+			if _, ok := model.(*Sorted); ok {
+				sizes[p]--
+			}
+		}
+		// Version 1 has neither info nor checksums, and its header
+		// starts with the vocabulary. The oldest binaries have no links
+		// or folded n-grams either.
+		var header bytes.Buffer
+		enc := gob.NewEncoder(&header)
+		enc.Encode(vocab)
+		enc.Encode(h.bos)
+		enc.Encode(h.eos)
+		enc.Encode(sizes)
+		var buf bytes.Buffer
+		w := byteblock.NewByteBlockWriter(&buf)
+		w.Write(blocks.magic, 0)
+		w.Write(header.Bytes(), 0)
+		w.Write(entries, 8)
+		loaded := loadedModels()[i]
+		if err := loaded.ParseBinary(buf.Bytes()); err != nil {
+			t.Fatalf("error in loading binary: %v", err)
+		}
+		if info := loaded.Info(); !reflect.DeepEqual(info, ModelInfo{Version: 1}) {
+			t.Errorf("expect only version 1 in info; got %+v", info)
+		}
+		sentTest(loaded, simpleTrigramSents, t)
+		if err := checkContexts(loaded); err != nil {
+			t.Errorf("check contexts failed with error %v", err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// Each corruption is made on a model freshly loaded from a
+	// binary, whose entries are backed by the raw bytes and have all
+	// the transitions of _STATE_EMPTY for the cases to corrupt.
+	hashedBackOff := func(m *Hashed, p StateId) *StateWeight {
+		return &m.buckets(p).FindEntry(word.NIL).Value
+	}
+	hashedLexical := func(m *Hashed, p StateId) *xqwEntry {
+		for i := range m.buckets(p) {
+			if m.buckets(p)[i].Key != word.NIL {
+				return &m.buckets(p)[i]
+			}
+		}
+		panic("no lexical transition")
+	}
+	hashedCases := []func(*Hashed){
+		// No free bucket.
+		func(m *Hashed) {
+			for i := range m.buckets(_STATE_START) {
+				if e := &m.buckets(_STATE_START)[i]; e.Key == word.NIL {
+					e.Key = 0
+				}
+			}
+		},
+		func(m *Hashed) { hashedLexical(m, _STATE_EMPTY).Value.State = StateId(m.NumStates()) },
+		func(m *Hashed) { hashedLexical(m, _STATE_EMPTY).Value.State = STATE_NIL },
+		func(m *Hashed) { hashedBackOff(m, _STATE_START).State = _STATE_START },
+		func(m *Hashed) { hashedBackOff(m, _STATE_START).State = STATE_NIL },
+		func(m *Hashed) { m.links[_STATE_START].Parent = _STATE_START },
+		func(m *Hashed) { m.links[_STATE_EMPTY].Parent = _STATE_START },
+		func(m *Hashed) { m.offsets[1], m.offsets[2] = m.offsets[2], m.offsets[1] },
+		func(m *Hashed) { m.dense.empty[0].State = StateId(m.NumStates()) },
+		// Word ids out of the vocabulary.
+		func(m *Hashed) { hashedLexical(m, _STATE_EMPTY).Key = word.Id(m.vocab.block.numWords) },
+		func(m *Hashed) { m.links[m.NumStates()-1].Word = word.Id(m.vocab.block.numWords) },
+	}
+	sortedCases := []func(*Sorted){
+		func(m *Sorted) {
+			next := m.next(_STATE_EMPTY)
+			next[0], next[1] = next[1], next[0]
+		},
+		func(m *Sorted) { m.next(_STATE_EMPTY)[0].State = StateId(m.NumStates()) },
+		func(m *Sorted) {
+			next := m.next(_STATE_START)
+			next[len(next)-1].Word = 0
+		},
+		func(m *Sorted) {
+			next := m.next(_STATE_START)
+			next[len(next)-1].State = _STATE_START
+		},
+		func(m *Sorted) { m.links[_STATE_START].Parent = STATE_NIL },
+		// No back-off.
+		func(m *Sorted) { m.offsets[_STATE_START+1] = m.offsets[_STATE_START] },
+		func(m *Sorted) { m.dense.empty[0].State = STATE_NIL },
+		// Word ids out of the vocabulary.
+		func(m *Sorted) {
+			next := m.next(_STATE_EMPTY)
+			// The last transition is the back-off.
+			next[len(next)-2].Word = word.Id(m.vocab.block.numWords)
+		},
+		func(m *Sorted) { m.links[m.NumStates()-1].Word = word.Id(m.vocab.block.numWords) },
+	}
+	for i, corrupt := range hashedCases {
+		var m Hashed
+		if err := m.ParseBinary(binaryBytes(withFullEmpty(readyBuilder(simpleTrigramLM).DumpHashed(0)), t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("hashed case %d: expect error", i)
+		}
+	}
+	robinHoodCases := []func(*Hashed){
+		// The back-off is not before the table.
+		func(m *Hashed) { m.entries[m.offsets[_STATE_START]].Key = 0 },
+		// No table.
+		func(m *Hashed) { m.offsets[_STATE_START+1] = m.offsets[_STATE_START] + 1 },
+		// A table without a free bucket, whose words are in order.
+		func(m *Hashed) {
+			for p := 0; p < m.NumStates(); p++ {
+				buckets := m.buckets(StateId(p))
+				if len(buckets) != 2 {
+					continue
+				}
+				for j, e := range buckets {
+					if e.Key != word.NIL {
+						continue
+					}
+					for x := word.Id(0); ; x++ {
+						if x != buckets[1-j].Key && robinHoodStart(x, 2) == j {
+							buckets[j].Key = x
+							return
+						}
+					}
+				}
+			}
+		},
+		// A word after a free bucket away from its home.
+		func(m *Hashed) {
+			buckets := m.buckets(_STATE_EMPTY)
+			for i, e := range buckets {
+				if j := (i + 1) % len(buckets); e.Key != word.NIL && buckets[j].Key == word.NIL {
+					buckets[i], buckets[j] = buckets[j], buckets[i]
+					return
+				}
+			}
+		},
+	}
+	for i, corrupt := range robinHoodCases {
+		builder := readyBuilder(simpleTrigramLM)
+		builder.SetRobinHood(true)
+		var m Hashed
+		if err := m.ParseBinary(binaryBytes(withFullEmpty(builder.DumpHashed(0)), t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("robin hood case %d: expect error", i)
+		}
+	}
+	for i, corrupt := range sortedCases {
+		var m Sorted
+		if err := m.ParseBinary(binaryBytes(withFullEmpty(readyBuilder(simpleTrigramLM).DumpSorted()), t)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("sorted case %d: expect error", i)
+		}
+	}
+}
+
+func TestParseBinaryCorrupt(t *testing.T) {
+	// Also Hashed with Robin Hood tables.
+	robinHood := func(b *Builder) binaryModel {
+		b.SetRobinHood(true)
+		return b.DumpHashed(0)
+	}
+	loaded := func() []binaryModel { return append(loadedModels(), new(Hashed)) }
+	for i, dump := range append(dumps, robinHood) {
+		raw := binaryBytes(dump(readyBuilder(simpleTrigramLM)), t)
+		for j := range raw {
+			corrupt := append([]byte(nil), raw...)
+			corrupt[j] ^= 0xff
+			m := loaded()[i]
+			if m.ParseBinary(corrupt) != nil {
+				continue
+			}
+			// Anything that passes validation is safe to use.
+			for _, sent := range simpleTrigramSents {
+				p := m.Start()
+				for _, tok := range sent[:len(sent)-1] {
+					p, _ = m.NextS(p, tok.Word)
+				}
+				m.Final(p)
+			}
+			for p := 0; p < m.NumStates(); p++ {
+				m.StateContext(StateId(p))
+			}
+		}
+		// A links block of the wrong size with a bad offset of state 1,
+		// so that recovering the links by walking the entries before
+		// validating them would crash.
+		blocks, err := sliceBinary(raw, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		entries := append([]byte(nil), blocks.entries...)
+		binary.LittleEndian.PutUint64(entries[2*_OFFSET_SIZE:], 1<<40)
+		var buf bytes.Buffer
+		w := byteblock.NewByteBlockWriter(&buf)
+		w.Write(blocks.magic, 0)
+		w.Write(blocks.infoBlock, 0)
+		w.Write(blocks.header, 0)
+		w.Write(blocks.vocab, _LAYOUT_ALIGN)
+		w.Write(entries, _OFFSET_SIZE)
+		w.Write(blocks.links[:len(blocks.links)-1], _LAYOUT_ALIGN)
+		w.Write(blocks.folded, _LAYOUT_ALIGN)
+		w.Write(blocks.checksums, 0)
+		if err := loaded()[i].ParseBinary(buf.Bytes()); err == nil {
+			t.Errorf("model %d: expect error with a bad links block", i)
+		}
+	}
+}
+
+func TestCheckNumEntries(t *testing.T) {
+	for _, i := range []struct {
+		NumEntries   []int
+		Extra, Total int
+		OK           bool
+	}{
+		{[]int{1, 2, 3}, 0, 6, true},
+		{[]int{1, 2, 3}, 1, 9, true},
+		{[]int{0, -1}, 1, 1, true},
+		{[]int{1, 2, 3}, 0, 5, false},
+		{[]int{1, 2, 3}, 0, 7, false},
+		{[]int{1, -2, 3}, 1, 5, false},
+		{[]int{1 << 62, 1 << 62, 1 << 62}, 0, 10, false},
+	} {
+		if err := checkNumEntries(i.NumEntries, i.Extra, i.Total); (err == nil) != i.OK {
+			t.Errorf("checkNumEntries(%v, %d, %d): expect ok = %t; got error %v", i.NumEntries, i.Extra, i.Total, i.OK, err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package fslm
 import (
 	"fmt"
 	"io"
+	"iter"
+	"slices"
 	"sort"
 
 	"github.com/golang/glog"
@@ -12,11 +14,22 @@ import (
 // Builder builds a language model from n-grams (e.g. estimated by
 // SRILM). Must be constrcuted using NewBuilder().
 type Builder struct {
-	vocab        *word.Vocab
-	bos, eos     string
-	bosId, eosId word.Id
-	transitions  []*xqwMap
-	backoff      []StateWeight
+	ngramVocab
+	transitions []*xqwMap
+	backoff     []StateWeight
+	links       stateLinks
+	info        ModelInfo
+	// Number of goroutines for the Dump* methods; see SetWorkers.
+	workers int
+	// Whether Hashed and Sorted get a dense _STATE_START; see
+	// SetDenseStart.
+	denseStart bool
+	// Whether DumpSorted uses the Eytzinger layout; see SetEytzinger.
+	eytzinger bool
+	// Whether DumpHashed uses Robin Hood tables; see SetRobinHood.
+	robinHood bool
+	// Scratch space for AddNgram.
+	ids []word.Id
 }
 
 // NewBuilder constrcuts a new Builder. vocab is the base vocabulary
@@ -25,9 +38,49 @@ type Builder struct {
 // created. Otherwise, bos and eos are used to query the sentence
 // boundary symbols from the vocab. Subsequent calls from Builder will
 // not modify outside vocab (i.e. a copy is made when vocab != nil).
-func NewBuilder(vocab *word.Vocab, bos, eos string) *Builder {
+func NewBuilder(vocab *word.Vocab, bos, eos string) (*Builder, error) {
 	var builder Builder
+	var err error
+	if builder.ngramVocab, err = newNgramVocab(vocab, bos, eos); err != nil {
+		return nil, err
+	}
+	builder.info.Checksum = CHECKSUM_CRC32C
+
+	// _STATE_EMPTY and _STATE_START.
+	builder.newState(STATE_NIL, word.NIL)
+	builder.newState(_STATE_EMPTY, builder.bosId)
+	builder.setTransition(_STATE_EMPTY, builder.bosId, _STATE_START, 0)
+	return &builder, nil
+}
+
+// NgramError is the error for an n-gram entry that cannot be added to
+// a Builder.
+type NgramError struct {
+	Context []string
+	Word    string
+	Reason  string
+}
+
+// newNgramError makes a copy of context since the caller may reuse
+// it.
+func newNgramError(context []string, word, reason string) *NgramError {
+	return &NgramError{append([]string(nil), context...), word, reason}
+}
 
+func (e *NgramError) Error() string {
+	return fmt.Sprintf("%s: context %q, word %q", e.Reason, e.Context, e.Word)
+}
+
+// ngramVocab is the vocabulary and the sentence boundary symbols that
+// n-grams are added with. It is shared by Builder and ExternalBuilder.
+type ngramVocab struct {
+	vocab        *word.Vocab
+	bos, eos     string
+	bosId, eosId word.Id
+}
+
+// newNgramVocab sets up the vocabulary as described in NewBuilder.
+func newNgramVocab(vocab *word.Vocab, bos, eos string) (ngramVocab, error) {
 	if vocab == nil {
 		vocab = word.NewVocab([]string{"<s>", "</s>"})
 		bos = "<s>"
@@ -35,34 +88,68 @@ func NewBuilder(vocab *word.Vocab, bos, eos string) *Builder {
 	} else {
 		vocab = vocab.Copy()
 	}
-	builder.vocab = vocab
-	if bos != eos {
-		builder.bos = bos
-		builder.eos = eos
-	} else {
-		glog.Fatalf("begin-of-sentence and end-of-sentence are the same word %q", bos)
+	if bos == eos {
+		return ngramVocab{}, fmt.Errorf("begin-of-sentence and end-of-sentence are the same word %q", bos)
 	}
-
-	if builder.bosId = vocab.IdOf(bos); builder.bosId == word.NIL {
-		glog.Fatalf("%q not in vocabulary", bos)
+	v := ngramVocab{vocab: vocab, bos: bos, eos: eos}
+	if v.bosId = vocab.IdOf(bos); v.bosId == word.NIL {
+		return ngramVocab{}, fmt.Errorf("%q not in vocabulary", bos)
 	}
-	if builder.eosId = vocab.IdOf(eos); builder.eosId == word.NIL {
-		glog.Fatalf("%q not in vocabulary", eos)
+	if v.eosId = vocab.IdOf(eos); v.eosId == word.NIL {
+		return ngramVocab{}, fmt.Errorf("%q not in vocabulary", eos)
 	}
-
-	// _STATE_EMPTY and _STATE_START.
-	builder.newState()
-	builder.newState()
-	builder.setTransition(_STATE_EMPTY, builder.bosId, _STATE_START, 0)
-	return &builder
+	return v, nil
 }
 
 // AddNgram adds an n-gram entry. The order of adding n-gram entry
 // does not matter with regard to the final model size. For certain
 // problematic input, warnings will be logged. The weights are changed
 // to WEIGHT_LOG0 when they are no greater than the value of flag
-// fslm.log0.
-func (b *Builder) AddNgram(context []string, word string, weight Weight, backOff Weight) {
+// fslm.log0. An invalid entry (e.g. one with </s> in its context) is
+// rejected with a *NgramError, in which case the Builder is left
+// unchanged.
+func (b *Builder) AddNgram(context []string, word string, weight Weight, backOff Weight) error {
+	if err := b.checkNgram(context, word); err != nil {
+		return err
+	}
+	b.ids = b.idsOf(b.ids, context, word)
+	n := len(context)
+	b.addNgram(b.ids[:n], b.ids[n], weight, backOff)
+	return nil
+}
+
+// AddNgramI is similar to AddNgram but takes word ids from the
+// Builder's vocabulary (see Vocab), which saves the vocabulary look-up
+// when the caller already has the ids.
+func (b *Builder) AddNgramI(context []word.Id, x word.Id, weight Weight, backOff Weight) error {
+	if err := b.checkNgramI(context, x); err != nil {
+		return err
+	}
+	b.addNgram(context, x, weight, backOff)
+	return nil
+}
+
+// Vocab returns the Builder's vocabulary and sentence boundary
+// symbols. The vocabulary grows as new words are added by AddNgram; it
+// can also be extended by the caller before calling AddNgramI.
+func (b *Builder) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return b.vocab, b.bos, b.eos, b.bosId, b.eosId
+}
+
+// idsOf maps the words of an n-gram to ids in order, adding unknown
+// words to the vocabulary. The result reuses buf.
+func (v *ngramVocab) idsOf(buf []word.Id, context []string, x string) []word.Id {
+	buf = buf[:0]
+	for _, i := range context {
+		buf = append(buf, v.vocab.IdOrAdd(i))
+	}
+	return append(buf, v.vocab.IdOrAdd(x))
+}
+
+// weights changes weight and backOff to WEIGHT_LOG0 when they are no
+// greater than the value of flag fslm.log0 and warns about problematic
+// entries.
+func (v *ngramVocab) weights(context []word.Id, x word.Id, weight Weight, backOff Weight) (Weight, Weight) {
 	if weight <= textLog0 {
 		weight = WEIGHT_LOG0
 	}
@@ -70,39 +157,104 @@ func (b *Builder) AddNgram(context []string, word string, weight Weight, backOff
 		backOff = WEIGHT_LOG0
 	}
 
+	if len(context) > 0 && x == v.bosId && weight > -10 {
+		glog.Warningf("there is a non-unigram ending in %q with weight %g (such n-gram should have -inf weight or not occur in the LM)", v.bos, weight)
+	}
+	if x == v.eosId && backOff != 0 {
+		glog.Warningf("non-zero back-off %g for a n-gram ending in %q", backOff, v.eos)
+	}
+	return weight, backOff
+}
+
+// addNgramLine implements ngramSink; the line is not needed.
+func (b *Builder) addNgramLine(_ int, context []word.Id, x word.Id, weight Weight, backOff Weight) error {
+	b.addNgram(context, x, weight, backOff)
+	return nil
+}
+
+func (b *Builder) addNgram(context []word.Id, x word.Id, weight Weight, backOff Weight) {
+	weight, backOff = b.weights(context, x, weight, backOff)
+	p := b.findState(_STATE_EMPTY, context)
+	q := STATE_NIL
+	// Only use a valid destination state when word is not </s>.
+	if x != b.eosId {
+		q = b.findNextState(p, x)
+		b.setBackOffWeight(q, backOff)
+	}
+	b.setTransition(p, x, q, weight)
+}
+
+// checkNgram checks whether the n-gram can be added.
+func (v *ngramVocab) checkNgram(context []string, word string) error {
 	if len(context) > 0 {
-		if context[0] == b.eos {
-			glog.Fatalf("end-of-sentence in context %q", context)
+		if context[0] == v.eos {
+			return newNgramError(context, word, "end-of-sentence in context")
 		}
 		for _, i := range context[1:] {
-			if i == b.bos {
-				glog.Fatalf("begin-of-sentence not in the beginning of context %q", context)
+			if i == v.bos {
+				return newNgramError(context, word, "begin-of-sentence not in the beginning of context")
 			}
-			if i == b.eos {
-				glog.Fatalf("end-of-sentence in context %q", context)
+			if i == v.eos {
+				return newNgramError(context, word, "end-of-sentence in context")
 			}
 		}
 	}
+	return nil
+}
 
-	if len(context) > 0 && word == b.bos && weight > -10 {
-		glog.Warningf("there is a non-unigram ending in %q with weight %g (such n-gram should have -inf weight or not occur in the LM)", word, weight)
+// checkNgramI is checkNgram on word ids.
+func (v *ngramVocab) checkNgramI(context []word.Id, x word.Id) error {
+	if x == word.NIL {
+		return v.newNgramErrorI(context, x, "invalid word id")
 	}
-	if word == b.eos && backOff != 0 {
-		glog.Warningf("non-zero back-off %g for a n-gram ending in %q", backOff, word)
+	for i, c := range context {
+		switch {
+		case c == word.NIL:
+			return v.newNgramErrorI(context, x, "invalid word id")
+		case c == v.eosId:
+			return v.newNgramErrorI(context, x, "end-of-sentence in context")
+		case i > 0 && c == v.bosId:
+			return v.newNgramErrorI(context, x, "begin-of-sentence not in the beginning of context")
+		}
 	}
+	return nil
+}
 
-	p := b.findState(_STATE_EMPTY, context)
-	x := b.vocab.IdOrAdd(word)
-	q := STATE_NIL
-	// Only use a valid destination state when word is not </s>.
-	if x != b.eosId {
-		q = b.findNextState(p, x)
-		b.setBackOffWeight(q, backOff)
+func (v *ngramVocab) newNgramErrorI(context []word.Id, x word.Id, reason string) *NgramError {
+	strs := make([]string, len(context))
+	for i, c := range context {
+		strs[i] = v.vocab.StringOf(c)
 	}
-	b.setTransition(p, x, q, weight)
+	return &NgramError{strs, v.vocab.StringOf(x), reason}
+}
+
+// lookUp finds out whether the context and the n-gram are already in
+// b without changing b. Note a context is also added when an n-gram
+// extending it is added.
+func (b *Builder) lookUp(context []string, x string) (hasContext, hasNgram bool) {
+	p := _STATE_EMPTY
+	for _, i := range context {
+		qw := b.findTransition(p, b.vocab.IdOf(i))
+		if qw == nil || qw.State == STATE_NIL {
+			return false, false
+		}
+		p = qw.State
+	}
+	return true, b.findTransition(p, b.vocab.IdOf(x)) != nil
 }
 
-func (b *Builder) newState() StateId {
+// findTransition finds the transition from p consuming x, or nil if
+// there is none.
+func (b *Builder) findTransition(p StateId, x word.Id) *StateWeight {
+	if x == word.NIL || b.transitions[p] == nil {
+		return nil
+	}
+	return b.transitions[p].Find(x)
+}
+
+// newState creates a new state whose context is that of p extended
+// by x.
+func (b *Builder) newState(p StateId, x word.Id) StateId {
 	s := StateId(len(b.backoff))
 	// A large number of states may not have any out-going transition at
 	// all. Delay construction of the map to save space.
@@ -110,6 +262,7 @@ func (b *Builder) newState() StateId {
 	// Back-off is initialized to STATE_NIL to signify an "unknown"
 	// back-off.
 	b.backoff = append(b.backoff, StateWeight{STATE_NIL, 0})
+	b.links = append(b.links, stateLink{p, x})
 	return s
 }
 
@@ -132,18 +285,55 @@ func (b *Builder) findNextState(p StateId, x word.Id) StateId {
 	if qw != nil {
 		return qw.State
 	}
-	q := b.newState()
+	q := b.newState(p, x)
 	b.setTransition(p, x, q, 0)
 	return q
 }
 
-func (b *Builder) findState(p StateId, ws []string) StateId {
-	for _, w := range ws {
-		p = b.findNextState(p, b.vocab.IdOrAdd(w))
+func (b *Builder) findState(p StateId, xs []word.Id) StateId {
+	for _, x := range xs {
+		p = b.findNextState(p, x)
 	}
 	return p
 }
 
+// Info returns the information that goes with the model dumped from
+// b, which the caller may complete (e.g. with Source and Options)
+// before dumping. By default, the binary has CRC-32C checksums.
+func (b *Builder) Info() *ModelInfo {
+	return &b.info
+}
+
+// SetWorkers sets the number of goroutines the Dump* methods use to
+// link and move states; n <= 0 (the default) means
+// runtime.GOMAXPROCS(0). The result does not depend on n.
+func (b *Builder) SetWorkers(n int) {
+	b.workers = n
+}
+
+// SetDenseStart sets whether DumpHashed and DumpSorted also store the
+// transitions of the start state as a dense array indexed by word id,
+// like those of the empty state always are. This speeds up the first
+// word of each sentence at the cost of 8 bytes per word.
+func (b *Builder) SetDenseStart(dense bool) {
+	b.denseStart = dense
+}
+
+// SetEytzinger sets whether DumpSorted lays out the transitions of each
+// state in the Eytzinger order (see eytzinger.go) instead of sorted,
+// which speeds up the search in states with many transitions. The
+// model and its Transitions are otherwise the same.
+func (b *Builder) SetEytzinger(eytzinger bool) {
+	b.eytzinger = eytzinger
+}
+
+// SetRobinHood sets whether DumpHashed uses Robin Hood hashing (see
+// robinhood.go) instead of linear probing, so that looking up a word
+// that a state has no transition for ends early.
+func (b *Builder) SetRobinHood(robinHood bool) {
+	b.robinHood = robinHood
+}
+
 // DumpHashed creates the result Hashed model and invalidates the
 // internal data of b. Subsequent calls to b.AddNgram() will have
 // undefined behavior (probably panic and will definitely not give you
@@ -153,9 +343,10 @@ func (b *Builder) findState(p StateId, ws []string) StateId {
 // speeds up the final model's look up at the cost of using more
 // memory.
 func (b *Builder) DumpHashed(scale float64) *Hashed {
-	b.link()
-	oldToNew, numStates := b.prune()
-	return b.moveHashed(oldToNew, numStates, scale)
+	oldToNew, numStates, folded := b.linkAndPrune()
+	m := b.moveHashed(oldToNew, numStates, scale)
+	m.folded = folded
+	return m
 }
 
 // DumpSorted creates the result Sorted model and invalidates the
@@ -163,34 +354,117 @@ func (b *Builder) DumpHashed(scale float64) *Hashed {
 // undefined behavior (probably panic and will definitely not give you
 // a correct model).
 func (b *Builder) DumpSorted() *Sorted {
+	oldToNew, numStates, folded := b.linkAndPrune()
+	m := b.moveSorted(oldToNew, numStates)
+	m.folded = folded
+	return m
+}
+
+// DumpTrie creates the result Trie model (see NewTrie for bits) and
+// invalidates the internal data of b like DumpSorted. The Trie is made
+// directly from the pruned states of b.
+func (b *Builder) DumpTrie(bits int) (*Trie, error) {
+	oldToNew, numStates, folded := b.linkAndPrune()
+	t := &Trie{vocab: &modelVocab{vocab: b.vocab}, bos: b.bos, eos: b.eos, bosId: b.bosId, eosId: b.eosId, info: b.info}
+	links := b.moveLinks(oldToNew, numStates)
+	err := t.build(newPrunedBuilder(b, oldToNew, numStates), links, folded, bits)
+	// Free the rest of Builder data.
+	b.vocab, b.backoff, b.transitions = nil, nil, nil
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// DumpProbing creates the result Probing model (see NewProbing for
+// scale) and invalidates the internal data of b like DumpSorted.
+func (b *Builder) DumpProbing(scale float64) *Probing {
+	return NewProbing(b.DumpSorted(), scale)
+}
+
+// linkAndPrune links and prunes the states (see link and prune) and
+// also returns the source weights of the n-grams whose weights are
+// folded by then (see foldedNgrams), with their contexts in the pruned
+// state space.
+func (b *Builder) linkAndPrune() (oldToNew []StateId, numStates int, folded []arpaEntry) {
+	bows := make([]Weight, len(b.backoff))
+	for i, backoff := range b.backoff {
+		bows[i] = backoff.Weight
+	}
 	b.link()
-	oldToNew, numStates := b.prune()
-	return b.moveSorted(oldToNew, numStates)
+	oldToNew, numStates = b.prune()
+	for o, n := range oldToNew {
+		if n == STATE_NIL || b.transitions[o] == nil {
+			continue
+		}
+		for xqw := range b.transitions[o].Range() {
+			q := xqw.Value.State
+			if q == STATE_NIL {
+				continue
+			}
+			// A pruned n-gram has its back-off weight folded into the
+			// weight of its transition (see moveHashed) and a kept one
+			// may have those of the states it backs off past folded
+			// into its back-off weight (see linkTransition).
+			if w := b.backoff[q].Weight; w != bows[q] || oldToNew[q] == STATE_NIL && w != 0 {
+				folded = append(folded, arpaEntry{n, xqw.Key, xqw.Value.Weight, bows[q]})
+			}
+		}
+	}
+	slices.SortFunc(folded, compareArpaEntries)
+	return
+}
+
+// DumpHybrid creates the result Hybrid model (see NewHybrid for opts)
+// and invalidates the internal data of b like DumpSorted.
+func (b *Builder) DumpHybrid(opts HybridOptions) *Hybrid {
+	return NewHybrid(b.DumpSorted(), opts)
 }
 
 // link links each state p to the first state q with at least one
-// lexical transition along p's back-off chain.
+// lexical transition along p's back-off chain. States are linked in
+// the order of increasing context length, so that linking a state only
+// reads states that are already linked; states of the same context
+// length are thus linked in parallel.
 func (b *Builder) link() {
-	// Children of _STATE_EMPTY directly backs off the _STATE_EMPTY.
-	for xqw := range b.transitions[_STATE_EMPTY].Range() {
-		q := xqw.Value.State
-		if q != STATE_NIL {
-			b.backoff[q].State = _STATE_EMPTY
-		}
-	}
-	// States are created with STATE_NIL as the default back-off. Except
-	// for _STATE_EMPTY, having a STATE_NIL back-off means the back-off
-	// is yet to be computed.
-	for i, es := range b.transitions[_STATE_EMPTY+1:] {
-		if es != nil {
-			for xqw := range es.Range() {
-				p, x, q := StateId(i+1), word.Id(xqw.Key), xqw.Value.State
-				if q != STATE_NIL {
+	for _, level := range b.levels() {
+		parallelFor(len(level), b.workers, func(lo, hi int) {
+			for _, q := range level[lo:hi] {
+				p, x := b.links[q].Parent, b.links[q].Word
+				if p == _STATE_EMPTY {
+					// Children of _STATE_EMPTY directly backs off the
+					// _STATE_EMPTY.
+					b.backoff[q].State = _STATE_EMPTY
+				} else {
 					b.linkTransition(p, x, q)
 				}
 			}
+		})
+	}
+}
+
+// levels groups the states other than _STATE_EMPTY by the length of
+// their contexts.
+func (b *Builder) levels() [][]StateId {
+	// A state is always created after its parent.
+	order := make([]int32, len(b.links))
+	var counts []int
+	for q := _STATE_EMPTY + 1; int(q) < len(b.links); q++ {
+		n := order[b.links[q].Parent] + 1
+		order[q] = n
+		for len(counts) < int(n) {
+			counts = append(counts, 0)
 		}
+		counts[n-1]++
 	}
+	levels := make([][]StateId, len(counts))
+	for i, c := range counts {
+		levels[i] = make([]StateId, 0, c)
+	}
+	for q := _STATE_EMPTY + 1; int(q) < len(b.links); q++ {
+		levels[order[q]-1] = append(levels[order[q]-1], q)
+	}
+	return levels
 }
 
 // linkTransition recursively link q to the lowest back-off state with
@@ -260,113 +534,277 @@ func (b *Builder) prune() (oldToNew []StateId, numStates int) {
 func (b *Builder) moveHashed(oldToNew []StateId, numStates int, scale float64) *Hashed {
 	if scale <= 1 {
 		scale = 1.5
-	} else {
-		scale = scale
 	}
 	var m Hashed
-	m.vocab, b.vocab = b.vocab, nil // Steal!
+	m.robinHood = b.robinHood
+	m.vocab, b.vocab = &modelVocab{vocab: b.vocab}, nil // Steal!
 	m.bos, m.eos, m.bosId, m.eosId = b.bos, b.eos, b.bosId, b.eosId
-	m.transitions = make([]xqwBuckets, numStates)
-	// Copy transitions and apply the mapping.
+	m.info = b.info
+	m.links = b.moveLinks(oldToNew, numStates)
+	empty := b.moveEmpty(oldToNew)
+	// Lay out the hash tables one after another.
+	m.offsets = make([]uint64, numStates+1)
 	for o, n := range oldToNew {
-		if n == STATE_NIL {
-			continue
-		}
-		// Steal Builder's data.
-		next := b.transitions[o]
-		if next == nil {
-			// Possible only for _STATE_START.
-			next = newXqwMap(0, 0)
-		}
-		next.Resize(int(float64(next.Size()) * scale))
-		b.transitions[o] = nil
-		// Walk over the buckets. If it holds an edge, pre-walk to the
-		// proper destination state. If it does not hold an edge, set it
-		// to the back-off.
-		backoff := b.backoff[o]
-		if backoff.State != STATE_NIL {
-			backoff.State = oldToNew[backoff.State]
-		}
-		buckets := next.buckets
-		for j, xqw := range buckets {
-			if xqw.Key != word.NIL {
-				q, w := xqw.Value.State, xqw.Value.Weight
-				if q != STATE_NIL {
-					oldQ := q
-					q = oldToNew[oldQ]
-					if q == STATE_NIL {
-						s := &b.backoff[oldQ]
-						q = oldToNew[s.State]
-						w += s.Weight
-					}
-				}
-				xqw.Value = StateWeight{q, w}
+		if n != STATE_NIL {
+			size := 0
+			if b.transitions[o] != nil {
+				size = b.transitions[o].Size()
+			}
+			if m.robinHood {
+				m.offsets[n+1] = uint64(robinHoodSize(size, scale))
 			} else {
-				xqw.Value = backoff
+				m.offsets[n+1] = uint64(hashedSize(size, scale))
 			}
-			buckets[j] = xqw
 		}
-		m.transitions[n] = buckets
 	}
+	for i := 1; i <= numStates; i++ {
+		m.offsets[i] += m.offsets[i-1]
+	}
+	m.entries = make([]xqwEntry, m.offsets[numStates])
+	// Copy transitions and apply the mapping. States are independent
+	// of each other and thus moved in parallel.
+	parallelFor(len(oldToNew), b.workers, func(lo, hi int) {
+		for o := lo; o < hi; o++ {
+			b.moveHashedState(&m, oldToNew, o)
+		}
+	})
+	_, startBackOff := m.BackOff(_STATE_START)
+	m.dense = newDenseStates(slices.Values(empty), m.Transitions(_STATE_START), startBackOff, b.denseStart)
 	// Free last two pieces of Builder data.
 	b.backoff = nil
 	b.transitions = nil
 	return &m
 }
 
+// hashedSize returns the number of buckets of a state with n lexical
+// transitions in a Hashed model of the given scale, which is what
+// xqwMap.Resize gives.
+func hashedSize(n int, scale float64) int {
+	return max(int(float64(n)*scale), n+1)
+}
+
+// moveHashedState moves the transitions of old state o to its buckets
+// in m, which are inserted to in the same order as xqwMap.Resize does.
+func (b *Builder) moveHashedState(m *Hashed, oldToNew []StateId, o int) {
+	n := oldToNew[o]
+	if n == STATE_NIL {
+		return
+	}
+	buckets := m.buckets(n)
+	for i := range buckets {
+		buckets[i].Key = word.NIL
+	}
+	// Possibly nil only for _STATE_EMPTY and _STATE_START.
+	if next := b.transitions[o]; next != nil {
+		for _, e := range next.buckets {
+			if e.Key == word.NIL {
+				continue
+			}
+			if m.robinHood {
+				robinHoodInsert(buckets, e)
+			} else {
+				*buckets.nextAvailable(e.Key) = e
+			}
+		}
+	}
+	b.transitions[o] = nil
+	// Walk over the buckets. If it holds an edge, pre-walk to the
+	// proper destination state. If it does not hold an edge, set it
+	// to the back-off.
+	backoff := b.backoff[o]
+	if backoff.State != STATE_NIL {
+		backoff.State = oldToNew[backoff.State]
+	}
+	for j, xqw := range buckets {
+		if xqw.Key != word.NIL {
+			q, w := b.moveTransition(oldToNew, xqw.Value.State, xqw.Value.Weight)
+			xqw.Value = StateWeight{q, w}
+		} else {
+			xqw.Value = backoff
+		}
+		buckets[j] = xqw
+	}
+	if m.robinHood {
+		m.entries[m.offsets[n]] = xqwEntry{word.NIL, backoff}
+	}
+}
+
 // moveSorted moves the contents to a Sorted model.
 func (b *Builder) moveSorted(oldToNew []StateId, numStates int) *Sorted {
 	var m Sorted
-	m.vocab, b.vocab = b.vocab, nil // Steal!
+	m.eytzinger = b.eytzinger
+	m.vocab, b.vocab = &modelVocab{vocab: b.vocab}, nil // Steal!
 	m.bos, m.eos, m.bosId, m.eosId = b.bos, b.eos, b.bosId, b.eosId
-	m.transitions = make([][]WordStateWeight, numStates)
-	// Copy transitions and apply the mapping.
+	m.info = b.info
+	m.links = b.moveLinks(oldToNew, numStates)
+	empty := b.moveEmpty(oldToNew)
+	// Lay out the transitions, each state with its back-off, one after
+	// another.
+	m.offsets = make([]uint64, numStates+1)
 	for o, n := range oldToNew {
-		if n == STATE_NIL {
-			continue
-		}
-		// Copy Builder's data.
-		var next []WordStateWeight
-		// Walk over the transitions, if necessary pre-walk to the proper
-		// destination state.
-		if b.transitions[o] == nil {
-			// Possible only for _STATE_START.
-			next = make([]WordStateWeight, 0, 1)
-		} else {
-			next = make([]WordStateWeight, 0, b.transitions[o].Size()+1)
-			for xqw := range b.transitions[o].Range() {
-				q, w := xqw.Value.State, xqw.Value.Weight
-				if q != STATE_NIL {
-					oldQ := q
-					q = oldToNew[oldQ]
-					if q == STATE_NIL {
-						s := &b.backoff[oldQ]
-						q = oldToNew[s.State]
-						w += s.Weight
-					}
-				}
-				xqw.Value = StateWeight{q, w}
-				next = append(next, WordStateWeight{xqw.Key, q, w})
+		if n != STATE_NIL {
+			size := 1
+			if b.transitions[o] != nil {
+				size += b.transitions[o].Size()
 			}
+			m.offsets[n+1] = uint64(size)
 		}
-		// Append the back-off transition.
-		backoff := b.backoff[o]
-		if backoff.State != STATE_NIL {
-			backoff.State = oldToNew[backoff.State]
-		}
-		next = append(next, WordStateWeight{word.NIL, backoff.State, backoff.Weight})
-		// Done for this state.
-		sort.Sort(byWord(next))
-		m.transitions[n] = next
-		// Free up some memory.
-		b.transitions[o] = nil
 	}
+	for i := 1; i <= numStates; i++ {
+		m.offsets[i] += m.offsets[i-1]
+	}
+	m.entries = make([]WordStateWeight, m.offsets[numStates])
+	// Copy transitions and apply the mapping. States are independent
+	// of each other and thus moved in parallel.
+	parallelFor(len(oldToNew), b.workers, func(lo, hi int) {
+		for o := lo; o < hi; o++ {
+			b.moveSortedState(&m, oldToNew, o)
+		}
+	})
+	_, startBackOff := m.BackOff(_STATE_START)
+	m.dense = newDenseStates(slices.Values(empty), m.Transitions(_STATE_START), startBackOff, b.denseStart)
 	// Free last two pieces of Builder data.
 	b.backoff = nil
 	b.transitions = nil
 	return &m
 }
 
+// moveSortedState moves the transitions of old state o to m.
+func (b *Builder) moveSortedState(m *Sorted, oldToNew []StateId, o int) {
+	n := oldToNew[o]
+	if n == STATE_NIL {
+		return
+	}
+	// Copy Builder's data into the transitions of n, which take
+	// exactly its capacity.
+	next := m.next(n)
+	next = next[:0:len(next)]
+	// Walk over the transitions, if necessary pre-walk to the proper
+	// destination state. There may be none only for _STATE_EMPTY and
+	// _STATE_START.
+	if b.transitions[o] != nil {
+		for xqw := range b.transitions[o].Range() {
+			q, w := b.moveTransition(oldToNew, xqw.Value.State, xqw.Value.Weight)
+			next = append(next, WordStateWeight{xqw.Key, q, w})
+		}
+	}
+	// Append the back-off transition.
+	backoff := b.backoff[o]
+	if backoff.State != STATE_NIL {
+		backoff.State = oldToNew[backoff.State]
+	}
+	next = append(next, WordStateWeight{word.NIL, backoff.State, backoff.Weight})
+	// Done for this state.
+	sort.Sort(byWord(next))
+	if m.eytzinger {
+		eytzinger(next[:len(next)-1])
+	}
+	// Free up some memory.
+	b.transitions[o] = nil
+}
+
+// moveEmpty returns the transitions of _STATE_EMPTY mapped to the
+// pruned state space, from which to make its dense array, and only
+// leaves in b those the array cannot tell from missing words (see
+// denseMissing), which are all its sparse transitions keep.
+func (b *Builder) moveEmpty(oldToNew []StateId) []WordStateWeight {
+	var (
+		empty   []WordStateWeight
+		missing *xqwMap
+	)
+	for xqw := range b.transitions[_STATE_EMPTY].Range() {
+		q, w := b.moveTransition(oldToNew, xqw.Value.State, xqw.Value.Weight)
+		empty = append(empty, WordStateWeight{xqw.Key, q, w})
+		if denseMissing(q, w) {
+			if missing == nil {
+				missing = newXqwMap(0, 0)
+			}
+			*missing.FindOrInsert(xqw.Key) = xqw.Value
+		}
+	}
+	b.transitions[_STATE_EMPTY] = missing
+	return empty
+}
+
+// moveTransition maps a transition to q of weight w to the pruned
+// state space, pre-walking to the back-off of q when q is pruned.
+func (b *Builder) moveTransition(oldToNew []StateId, q StateId, w Weight) (StateId, Weight) {
+	if q != STATE_NIL {
+		oldQ := q
+		q = oldToNew[oldQ]
+		if q == STATE_NIL {
+			s := &b.backoff[oldQ]
+			q = oldToNew[s.State]
+			w += s.Weight
+		}
+	}
+	return q, w
+}
+
+// prunedBuilder is the pruned state space of a Builder as the source
+// of Trie.build, whose transitions are mapped as they are iterated.
+type prunedBuilder struct {
+	b                  *Builder
+	oldToNew, newToOld []StateId
+}
+
+func newPrunedBuilder(b *Builder, oldToNew []StateId, numStates int) prunedBuilder {
+	newToOld := make([]StateId, numStates)
+	for o, n := range oldToNew {
+		if n != STATE_NIL {
+			newToOld[n] = StateId(o)
+		}
+	}
+	return prunedBuilder{b, oldToNew, newToOld}
+}
+
+func (m prunedBuilder) NumStates() int {
+	return len(m.newToOld)
+}
+
+func (m prunedBuilder) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		// There may be none only for _STATE_START.
+		next := m.b.transitions[m.newToOld[p]]
+		if next == nil {
+			return
+		}
+		for xqw := range next.Range() {
+			q, w := m.b.moveTransition(m.oldToNew, xqw.Value.State, xqw.Value.Weight)
+			if !yield(WordStateWeight{xqw.Key, q, w}) {
+				return
+			}
+		}
+	}
+}
+
+func (m prunedBuilder) BackOff(p StateId) (StateId, Weight) {
+	backoff := m.b.backoff[m.newToOld[p]]
+	if backoff.State != STATE_NIL {
+		backoff.State = m.oldToNew[backoff.State]
+	}
+	return backoff.State, backoff.Weight
+}
+
+// moveLinks maps the state links to the pruned state space. Since a
+// state with lexical transitions always has its parent kept, the
+// mapped links never point to pruned states.
+func (b *Builder) moveLinks(oldToNew []StateId, numStates int) stateLinks {
+	links := make(stateLinks, numStates)
+	for o, n := range oldToNew {
+		if n == STATE_NIL {
+			continue
+		}
+		link := b.links[o]
+		if link.Parent != STATE_NIL {
+			link.Parent = oldToNew[link.Parent]
+		}
+		links[n] = link
+	}
+	b.links = nil
+	return links
+}
+
 // Graphviz visuallizes the current internal topology of the Builder.
 func (b *Builder) Graphviz(w io.Writer) {
 	fmt.Fprintln(w, "digraph {")
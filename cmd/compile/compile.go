@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"runtime/pprof"
 
@@ -20,8 +21,20 @@ func main() {
 	}
 	cpuprofile := flag.String("cpuprofile", "", "path to write CPU profile")
 	memprofile := flag.String("memprofile", "", "path to write memory profile")
-	format := easy.StringChoice("fslm.format", []string{"hash", "sort"}, "output format")
-	scale := flag.Float64("fslm.scale", 1.5, "scale multiplier for deciding the hash table size; only active in hash format")
+	format := easy.StringChoice("fslm.format", []string{"hash", "sort", "quant", "trie", "probe", "hybrid"}, "output format")
+	scale := flag.Float64("fslm.scale", 1.5, "scale multiplier for deciding the hash table size; only active in hash, probe and hybrid formats")
+	bits := flag.Int("fslm.bits", 0, "bits of each quantized weight: 8 (the default) or 16 in quant format; 0 (exact weights, the default) to 16 in trie format")
+	maxLinear := flag.Int("fslm.max_linear", 8, "states with at most this many transitions are scanned linearly in hybrid format")
+	maxSorted := flag.Int("fslm.max_sorted", 64, "states with at most this many transitions (and more than -fslm.max_linear) are binary searched in hybrid format; the rest are hash tables")
+	mode := easy.StringChoice("arpa.mode", []string{"default", "strict", "lenient"}, "how strictly the input ARPA file is checked")
+	workers := flag.Int("fslm.workers", 0, "number of goroutines for parsing and building; <= 0 means GOMAXPROCS")
+	external := flag.Bool("fslm.external", false, "sort n-grams on disk and write the model without building it in memory; for LMs too large for the memory")
+	tmpDir := flag.String("fslm.tmpdir", "", "directory for temporary files of -fslm.external; empty means the system default")
+	chunk := flag.Int("fslm.chunk", 256, "megabytes of n-grams sorted in memory at a time by -fslm.external")
+	denseStart := flag.Bool("fslm.dense_start", false, "also store the transitions of the start state as a dense array; only active in hash, sort and hybrid formats")
+	eytzinger := flag.Bool("fslm.eytzinger", false, "lay out the transitions of each state in the Eytzinger (breadth-first) order, which is faster to search in states with many transitions; only active in sort format")
+	robinHood := flag.Bool("fslm.robin_hood", false, "use Robin Hood hashing, with which looking up a word a state has no transition for ends early; only active in hash format")
+	checksum := easy.StringChoice("fslm.checksum", []string{fslm.CHECKSUM_CRC32C, "none"}, "checksum algorithm over the blocks of the output")
 	easy.ParseFlagsAndArgs(&args)
 
 	if *cpuprofile != "" {
@@ -41,10 +54,52 @@ func main() {
 		}()
 	}
 
-	builder, err := fslm.FromARPA(os.Stdin)
+	opts := fslm.ARPAOptions{Workers: *workers}
+	switch *mode {
+	case "default":
+		opts.Mode = fslm.ARPA_DEFAULT
+	case "strict":
+		opts.Mode = fslm.ARPA_STRICT
+	case "lenient":
+		opts.Mode = fslm.ARPA_LENIENT
+	default:
+		glog.Fatalf("unknown ARPA mode %q", *mode)
+	}
+
+	info := func(info *fslm.ModelInfo) {
+		info.Source = "<stdin>"
+		info.Options = fmt.Sprintf("format=%s scale=%g bits=%d arpa.mode=%s external=%t dense_start=%t", *format, *scale, *bits, *mode, *external, *denseStart)
+		if *format == "hybrid" {
+			info.Options += fmt.Sprintf(" max_linear=%d max_sorted=%d", *maxLinear, *maxSorted)
+		}
+		if *format == "sort" {
+			info.Options += fmt.Sprintf(" eytzinger=%t", *eytzinger)
+		}
+		if *format == "hash" {
+			info.Options += fmt.Sprintf(" robin_hood=%t", *robinHood)
+		}
+		if *checksum == "none" {
+			info.Checksum = fslm.CHECKSUM_NONE
+		} else {
+			info.Checksum = *checksum
+		}
+	}
+
+	hybrid := fslm.HybridOptions{MaxLinear: *maxLinear, MaxSorted: *maxSorted, Scale: *scale, DenseStart: *denseStart}
+
+	if *external {
+		compileExternal(opts, fslm.ExternalOptions{TempDir: *tmpDir, ChunkBytes: *chunk << 20, DenseStart: *denseStart, Eytzinger: *eytzinger && *format == "sort", RobinHood: *robinHood}, info, *format, *scale, *bits, hybrid, args.Out)
+		return
+	}
+
+	builder, err := fslm.FromARPA(os.Stdin, opts)
 	if err != nil {
 		glog.Fatal(err)
 	}
+	info(builder.Info())
+	builder.SetDenseStart(*denseStart)
+	builder.SetEytzinger(*eytzinger)
+	builder.SetRobinHood(*robinHood)
 
 	var model CanWriteBinary
 
@@ -53,6 +108,19 @@ func main() {
 		model = builder.DumpHashed(*scale)
 	case "sort":
 		model = builder.DumpSorted()
+	case "quant":
+		model = convert(builder.DumpSorted(), *format, *scale, *bits, hybrid)
+	case "trie":
+		t, err := builder.DumpTrie(*bits)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		logCodebooks(t.Codebooks())
+		model = t
+	case "probe":
+		model = builder.DumpProbing(*scale)
+	case "hybrid":
+		model = builder.DumpHybrid(hybrid)
 	default:
 		glog.Fatalf("unknown format %q", *format)
 	}
@@ -61,3 +129,91 @@ func main() {
 		glog.Fatal(err)
 	}
 }
+
+func compileExternal(opts fslm.ARPAOptions, ext fslm.ExternalOptions, info func(*fslm.ModelInfo), format string, scale float64, bits int, hybrid fslm.HybridOptions, out string) {
+	builder, err := fslm.FromARPAExternal(os.Stdin, opts, ext)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	defer builder.Close()
+	info(builder.Info())
+	switch format {
+	case "hash":
+		err = builder.WriteHashed(out, scale)
+	case "sort":
+		err = builder.WriteSorted(out)
+	case "quant", "trie", "probe", "hybrid":
+		err = convertExternal(builder, ext.TempDir, format, scale, bits, hybrid, out)
+	default:
+		glog.Fatalf("unknown format %q", format)
+	}
+	if err != nil {
+		builder.Close()
+		glog.Fatal(err)
+	}
+}
+
+// convert converts model to the quant, trie, probe or hybrid format and
+// logs the quantization error.
+func convert(model fslm.ContextModel, format string, scale float64, bits int, hybrid fslm.HybridOptions) CanWriteBinary {
+	switch format {
+	case "quant":
+		if bits == 0 {
+			bits = 8
+		}
+		q, err := fslm.Quantize(model, bits)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		logCodebooks(q.Codebooks())
+		return q
+	case "trie":
+		t, err := fslm.NewTrie(model, bits)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		logCodebooks(t.Codebooks())
+		return t
+	case "probe":
+		return fslm.NewProbing(model, scale)
+	case "hybrid":
+		return fslm.NewHybrid(model, hybrid)
+	}
+	glog.Fatalf("cannot convert to format %q", format)
+	return nil
+}
+
+// logCodebooks logs the quantization error of each codebook.
+func logCodebooks(codebooks []fslm.Codebook) {
+	for _, c := range codebooks {
+		kind := "probabilities"
+		if c.BackOff {
+			kind = "back-offs"
+		}
+		glog.Infof("quantized %d %d-gram %s to %d values: mean error %g, max error %g", c.Count, c.Order, kind, len(c.Weights), c.MeanError, c.MaxError)
+	}
+}
+
+// convertExternal writes a sorted binary to a temporary file in tmpDir
+// and converts it, mapped rather than loaded into memory, to format in
+// out. Only the final model is renamed to out.
+func convertExternal(builder *fslm.ExternalBuilder, tmpDir, format string, scale float64, bits int, hybrid fslm.HybridOptions, out string) error {
+	f, err := os.CreateTemp(tmpDir, "fslm-sorted-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = builder.WriteSortedTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	model, err := fslm.Open(f.Name(), fslm.OpenOptions{})
+	if err != nil {
+		return err
+	}
+	defer model.Close()
+	return convert(model.(fslm.ContextModel), format, scale, bits, hybrid).WriteBinary(out)
+}
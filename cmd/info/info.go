@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kho/easy"
+	"github.com/kho/fslm"
+)
+
+func main() {
+	var args struct {
+		Model string `name:"model" usage:"LM file"`
+	}
+	verify := flag.Bool("verify", false, "also verify the checksums and validate the whole model")
+	probes := flag.Bool("probes", false, "also print the histograms of the number of buckets probed by the look-ups of a hash model, which takes a scan over the whole model")
+	easy.ParseFlagsAndArgs(&args)
+
+	model, err := fslm.Open(args.Model, fslm.OpenOptions{Validate: *verify})
+	if err != nil {
+		glog.Fatal("error in loading model: ", err)
+	}
+	defer model.Close()
+
+	switch model.Kind() {
+	case fslm.MODEL_HASHED:
+		fmt.Println("format:", "hash")
+	case fslm.MODEL_SORTED:
+		fmt.Println("format:", "sort")
+	case fslm.MODEL_QUANTIZED:
+		fmt.Println("format:", "quant")
+	case fslm.MODEL_TRIE:
+		fmt.Println("format:", "trie")
+	case fslm.MODEL_PROBING:
+		fmt.Println("format:", "probe")
+	case fslm.MODEL_HYBRID:
+		fmt.Println("format:", "hybrid")
+	default:
+		fmt.Println("format:", model.Kind())
+	}
+	info := model.Info()
+	fmt.Println("version:", info.Version)
+	if info.Version > 1 {
+		fmt.Println("order:", info.Order)
+		for i, n := range info.Counts {
+			fmt.Printf("ngram %d=%d\n", i+1, n)
+		}
+		fmt.Println("source:", info.Source)
+		fmt.Println("source size:", info.SourceSize)
+		fmt.Println("source sha256:", info.SourceSHA256)
+		fmt.Println("options:", info.Options)
+		fmt.Println("build time:", info.BuildTime.Format(time.RFC3339))
+		checksum := info.Checksum
+		if checksum == fslm.CHECKSUM_NONE {
+			checksum = "none"
+		}
+		fmt.Println("checksum:", checksum)
+	}
+	var codebooks []fslm.Codebook
+	switch m := model.(type) {
+	case *fslm.Quantized:
+		fmt.Println("bits:", m.Bits())
+		codebooks = m.Codebooks()
+	case *fslm.Trie:
+		codebooks = m.Codebooks()
+	case *fslm.Hybrid:
+		linear, sorted, hashed := m.NumLayouts()
+		fmt.Printf("states: %d linear, %d sorted, %d hashed\n", linear, sorted, hashed)
+	case *fslm.Hashed:
+		hashing := "linear probing"
+		if m.RobinHood() {
+			hashing = "robin hood"
+		}
+		fmt.Println("hashing:", hashing)
+		if *probes {
+			printProbes(m.ProbeStats())
+		}
+	}
+	for _, c := range codebooks {
+		kind := "prob"
+		if c.BackOff {
+			kind = "backoff"
+		}
+		fmt.Printf("codebook %d-gram %s: %d values, %d weights, mean error %g, max error %g\n", c.Order, kind, len(c.Weights), c.Count, c.MeanError, c.MaxError)
+	}
+
+	if *verify {
+		m, err := fslm.OpenMappedFile(args.Model)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		defer m.Close()
+		if err := fslm.VerifyBinary(m.Data()); err != nil {
+			glog.Fatal("verification failed: ", err)
+		}
+		fmt.Println("verified: ok")
+	}
+}
+
+// printProbes prints the mean and maximum number of probes of hits and
+// misses followed by their histograms.
+func printProbes(s fslm.ProbeStats) {
+	for _, i := range []struct {
+		Kind string
+		Hist []int
+	}{{"hit", s.Hits}, {"miss", s.Misses}} {
+		total, count := 0, 0
+		for n, c := range i.Hist {
+			total += n * c
+			count += c
+		}
+		fmt.Printf("probes per %s: mean %.3f, max %d\n", i.Kind, float64(total)/float64(max(count, 1)), len(i.Hist)-1)
+	}
+	for n := 1; n < max(len(s.Hits), len(s.Misses)); n++ {
+		var hits, misses int
+		if n < len(s.Hits) {
+			hits = s.Hits[n]
+		}
+		if n < len(s.Misses) {
+			misses = s.Misses[n]
+		}
+		fmt.Printf("probes %d: %d hits, %d misses\n", n, hits, misses)
+	}
+}
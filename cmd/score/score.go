@@ -18,10 +18,29 @@ import (
 	"github.com/kho/word"
 )
 
-var unkScore fslm.Weight
+var (
+	unkScore fslm.Weight
+	fragment bool
+	noEOS    bool
+)
 
 func init() {
 	flag.Var(&unkScore, "unk", "score for <unk>")
+	flag.BoolVar(&fragment, "fragment", false, "score each line as a fragment that does not start a sentence (i.e. without <s>)")
+	flag.BoolVar(&noEOS, "fragment.noeos", false, "in fragment mode, also do not end each line with </s>")
+}
+
+// start returns the state to start each line from.
+func start(model fslm.Model) fslm.StateId {
+	if fragment {
+		return model.StartEmpty()
+	}
+	return model.Start()
+}
+
+// withEOS tells whether each line should be ended with </s>.
+func withEOS() bool {
+	return !(fragment && noEOS)
 }
 
 func main() {
@@ -52,11 +71,11 @@ func main() {
 	var before, after runtime.MemStats
 	runtime.GC()
 	runtime.ReadMemStats(&before)
-	kind, modelI, file, err := fslm.FromBinary(args.Model)
+	model, err := fslm.Open(args.Model, fslm.OpenOptions{})
 	if err != nil {
 		glog.Fatal("error in loading model: ", err)
 	}
-	defer file.Close()
+	defer model.Close()
 	runtime.GC()
 	runtime.ReadMemStats(&after)
 	glog.Infof("LM memory overhead: %.2fMB", float64(after.Alloc-before.Alloc)/float64(1<<20))
@@ -67,29 +86,35 @@ func main() {
 		numWords, numSents, numOOVs int
 	)
 
-	glog.Info("loading corpus took ", easy.Timed(func() { corpus = LoadCorpus(os.Stdin, modelI) }))
+	glog.Info("loading corpus took ", easy.Timed(func() { corpus = LoadCorpus(os.Stdin, model) }))
 
 	numSents = len(corpus)
 	for _, i := range corpus {
 		numWords += len(i)
 	}
+	// The number of scored tokens including </s>.
+	numTokens := numWords
+	if withEOS() {
+		numTokens += numSents
+	}
 
 	elapsed := easy.Timed(func() {
-		score, numOOVs = ScoreCorpus(kind, modelI, corpus)
+		score, numOOVs = ScoreCorpus(model, corpus)
 	})
-	glog.Infof("scoring took %v; %g QPS", elapsed, float64(numSents+numWords)*float64(time.Second)/float64(elapsed))
+	glog.Infof("scoring took %v; %g QPS", elapsed, float64(numTokens)*float64(time.Second)/float64(elapsed))
 
 	if numWords > 0 {
 		fmt.Printf("%d sents, %d words, %d OOVs\n", numSents, numWords, numOOVs)
 		fmt.Printf("logprob=%g ppl=%g ppl1=%g\n",
-			score, math.Exp(-float64(score)/float64(numSents+numWords)*math.Log(10)),
+			score, math.Exp(-float64(score)/float64(numTokens)*math.Log(10)),
 			math.Exp(-float64(score)/float64(numWords)*math.Log(10)))
 	}
 }
 
-func LoadCorpus(r io.Reader, modelI interface{}) (sents [][]word.Id) {
+func LoadCorpus(r io.Reader, model fslm.Model) (sents [][]word.Id) {
 	in := bufio.NewScanner(r)
-	vocab, _, _, _, _ := modelI.(fslm.Model).Vocab()
+	// Loaded models look up words in place without building a vocab.
+	vocab := fslm.VocabOf(model)
 	for in.Scan() {
 		var sent []word.Id
 		for _, i := range bytes.Fields(in.Bytes()) {
@@ -103,23 +128,23 @@ func LoadCorpus(r io.Reader, modelI interface{}) (sents [][]word.Id) {
 	return
 }
 
-func ScoreCorpus(kind int, modelI interface{}, corpus [][]word.Id) (score float64, numOOVs int) {
+func ScoreCorpus(model fslm.Model, corpus [][]word.Id) (score float64, numOOVs int) {
 	if glog.V(1) {
-		return VerboseScoreCorpus(modelI.(fslm.Model), corpus)
+		return VerboseScoreCorpus(model, corpus)
 	} else {
-		switch kind {
-		case fslm.MODEL_HASHED:
-			return SilentScoreCorpusHashed(modelI.(*fslm.Hashed), corpus)
-		case fslm.MODEL_SORTED:
-			return SilentScoreCorpusSorted(modelI.(*fslm.Sorted), corpus)
+		switch model := model.(type) {
+		case fslm.BatchModel:
+			// Hashed and Sorted.
+			return SilentScoreCorpusBatch(model, corpus)
+		default:
+			return SilentScoreCorpus(model, corpus)
 		}
 	}
-	return
 }
 
 func VerboseScoreCorpus(model fslm.Model, corpus [][]word.Id) (total float64, numOOVs int) {
 	for _, sent := range corpus {
-		p := model.Start()
+		p := start(model)
 		for _, x := range sent {
 			var w fslm.Weight
 			p, w = model.NextI(p, x)
@@ -133,16 +158,22 @@ func VerboseScoreCorpus(model fslm.Model, corpus [][]word.Id) (total float64, nu
 			total += float64(w)
 			fmt.Printf("\t%g\t%g\n", w, total)
 		}
-		w := model.Final(p)
-		total += float64(w)
-		fmt.Printf("</s>\t%g\t%g\n\n", w, total)
+		if withEOS() {
+			w := model.Final(p)
+			total += float64(w)
+			fmt.Printf("</s>\t%g\t%g\n", w, total)
+		}
+		fmt.Println()
 	}
 	return
 }
 
-func SilentScoreCorpusHashed(model *fslm.Hashed, corpus [][]word.Id) (total float64, numOOVs int) {
+// SilentScoreCorpus works with any model through the slower Model
+// interface.
+func SilentScoreCorpus(model fslm.Model, corpus [][]word.Id) (total float64, numOOVs int) {
+	s, eos := start(model), withEOS()
 	for _, sent := range corpus {
-		p := model.Start()
+		p := s
 		for _, x := range sent {
 			var w fslm.Weight
 			p, w = model.NextI(p, x)
@@ -152,26 +183,95 @@ func SilentScoreCorpusHashed(model *fslm.Hashed, corpus [][]word.Id) (total floa
 			}
 			total += float64(w)
 		}
-		w := model.Final(p)
-		total += float64(w)
+		if eos {
+			total += float64(model.Final(p))
+		}
 	}
 	return
 }
 
-func SilentScoreCorpusSorted(model *fslm.Sorted, corpus [][]word.Id) (total float64, numOOVs int) {
-	for _, sent := range corpus {
-		p := model.Start()
-		for _, x := range sent {
-			var w fslm.Weight
-			p, w = model.NextI(p, x)
+// scoreBatch is the number of sentences SilentScoreCorpusBatch scores
+// at once.
+const scoreBatch = 256
+
+// SilentScoreCorpusBatch scores up to scoreBatch sentences at a time
+// with NextBatch, taking a word from each of them at every step. The
+// total is summed in the same order as SilentScoreCorpus so that the
+// two give the same score.
+func SilentScoreCorpusBatch(model fslm.BatchModel, corpus [][]word.Id) (total float64, numOOVs int) {
+	s, eos := start(model), withEOS()
+	// The weight of every word of the corpus, sentence after sentence,
+	// and that of </s> after each sentence.
+	offsets := make([]int, len(corpus)+1)
+	for i, sent := range corpus {
+		offsets[i+1] = offsets[i] + len(sent)
+	}
+	weights := make([]fslm.Weight, offsets[len(corpus)])
+	finals := make([]fslm.Weight, len(corpus))
+
+	// Slot j scores the word at pos[j] of sentence sents[j] from ps[j].
+	var (
+		sents, pos [scoreBatch]int
+		ps         [scoreBatch]fslm.StateId
+		xs         [scoreBatch]word.Id
+		ws         [scoreBatch]fslm.Weight
+	)
+	n, next := 0, 0
+	// fill puts the next non-empty sentence in slot j, unless there is
+	// none left.
+	fill := func(j int) bool {
+		for ; next < len(corpus); next++ {
+			if len(corpus[next]) > 0 {
+				sents[j], pos[j], ps[j] = next, 0, s
+				next++
+				return true
+			}
+			if eos {
+				finals[next] = model.Final(s)
+			}
+		}
+		return false
+	}
+	for n < scoreBatch && fill(n) {
+		n++
+	}
+	for n > 0 {
+		for j := 0; j < n; j++ {
+			xs[j] = corpus[sents[j]][pos[j]]
+		}
+		model.NextBatch(ps[:n], xs[:n], ps[:n], ws[:n])
+		for j := 0; j < n; {
+			i := sents[j]
+			weights[offsets[i]+pos[j]] = ws[j]
+			pos[j]++
+			if pos[j] < len(corpus[i]) {
+				j++
+				continue
+			}
+			if eos {
+				finals[i] = model.Final(ps[j])
+			}
+			if fill(j) {
+				j++
+				continue
+			}
+			// No sentence left; move the last slot here.
+			n--
+			sents[j], pos[j], ps[j], ws[j] = sents[n], pos[n], ps[n], ws[n]
+		}
+	}
+
+	for i := range corpus {
+		for _, w := range weights[offsets[i]:offsets[i+1]] {
 			if w == fslm.WEIGHT_LOG0 {
 				w = unkScore
 				numOOVs++
 			}
 			total += float64(w)
 		}
-		w := model.Final(p)
-		total += float64(w)
+		if eos {
+			total += float64(finals[i])
+		}
 	}
 	return
 }
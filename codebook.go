@@ -0,0 +1,121 @@
+package fslm
+
+// Codebooks of quantized weights, which are shared by Quantized and
+// Trie.
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// Codebook maps codes to the quantized probabilities or back-off
+// weights of the n-grams of one order.
+type Codebook struct {
+	Order   int
+	BackOff bool
+	// The weight of each code. WEIGHT_LOG0 is kept exact.
+	Weights []Weight
+	// The number of weights quantized with the codebook and their
+	// mean and maximum absolute error.
+	Count               int
+	MeanError, MaxError float64
+}
+
+// makeCodebooks makes the codebooks of at most size weights of the
+// lexical transitions and back-offs of the states of each order.
+func makeCodebooks(probs, backOffs [][]Weight, size int) (codebooks []Codebook) {
+	for order := range probs {
+		codebooks = append(codebooks, makeCodebook(order+1, false, probs[order], size))
+		if order > 0 {
+			codebooks = append(codebooks, makeCodebook(order, true, backOffs[order], size))
+		}
+	}
+	return
+}
+
+// makeCodebook quantizes weights (which are reordered) to a codebook
+// of at most size weights. The weights are split into bins of equal
+// sizes and each bin is quantized to its mean, as KenLM does; weights
+// with no more distinct values than size are kept exact.
+func makeCodebook(order int, backOff bool, weights []Weight, size int) Codebook {
+	c := Codebook{Order: order, BackOff: backOff, Count: len(weights)}
+	slices.Sort(weights)
+	finite := weights
+	for len(finite) > 0 && finite[0] == WEIGHT_LOG0 {
+		finite = finite[1:]
+	}
+	if len(finite) < len(weights) {
+		c.Weights = append(c.Weights, WEIGHT_LOG0)
+		size--
+	}
+	if distinct := slices.Compact(slices.Clone(finite)); len(distinct) <= size {
+		c.Weights = append(c.Weights, distinct...)
+	} else {
+		for i := 0; i < size; i++ {
+			bin := finite[i*len(finite)/size : (i+1)*len(finite)/size]
+			sum := 0.0
+			for _, w := range bin {
+				sum += float64(w)
+			}
+			c.Weights = append(c.Weights, Weight(sum/float64(len(bin))))
+		}
+		c.Weights = slices.Compact(c.Weights)
+	}
+	for _, w := range weights {
+		if w == WEIGHT_LOG0 {
+			continue
+		}
+		e := math.Abs(float64(c.Weights[quantizeWeight(c.Weights, w)] - w))
+		c.MeanError += e
+		c.MaxError = max(c.MaxError, e)
+	}
+	if len(weights) > 0 {
+		c.MeanError /= float64(len(weights))
+	}
+	return c
+}
+
+// quantizeWeight returns the code of the closest weight to w in book,
+// which is sorted.
+func quantizeWeight(book []Weight, w Weight) int {
+	i := sort.Search(len(book), func(i int) bool { return book[i] >= w })
+	if i == len(book) || (i > 0 && w-book[i-1] < book[i]-w) {
+		i--
+	}
+	return i
+}
+
+// indexCodebooks returns the weights of the codebooks by the order of
+// the state whose lexical transitions or back-off they are for.
+func indexCodebooks(codebooks []Codebook) (probs, backOffs [][]Weight) {
+	for _, c := range codebooks {
+		order := c.Order
+		if !c.BackOff {
+			order--
+		}
+		for len(probs) <= order {
+			probs = append(probs, nil)
+			backOffs = append(backOffs, nil)
+		}
+		if c.BackOff {
+			backOffs[order] = c.Weights
+		} else {
+			probs[order] = c.Weights
+		}
+	}
+	return
+}
+
+// checkCodebooks checks that the codebooks loaded from a binary can be
+// indexed.
+func checkCodebooks(codebooks []Codebook) error {
+	for _, c := range codebooks {
+		// See indexCodebooks.
+		if order := c.Order - 1; order < 0 || order > math.MaxUint8 {
+			return fmt.Errorf("bad binary: codebook of order %d", c.Order)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package fslm
+
+// Bookkeeping of the context represented by each state.
+
+import (
+	"github.com/kho/word"
+)
+
+// stateLink links a state to the state of its context without the
+// last word. Following the links from any state eventually leads to
+// _STATE_EMPTY, whose link is {STATE_NIL, word.NIL}.
+type stateLink struct {
+	Parent StateId
+	Word   word.Id
+}
+
+type stateLinks []stateLink
+
+// Context returns the context of p, oldest word first.
+func (s stateLinks) Context(p StateId) []word.Id {
+	context := make([]word.Id, s.Order(p))
+	for i := len(context) - 1; i >= 0; i-- {
+		context[i] = s[p].Word
+		p = s[p].Parent
+	}
+	return context
+}
+
+// Order returns the length of the context of p.
+func (s stateLinks) Order(p StateId) (n int) {
+	for p != _STATE_EMPTY {
+		p = s[p].Parent
+		n++
+	}
+	return
+}
+
+// findStateLinks recovers the links of a model by walking its lexical
+// transitions from the empty context in the order of increasing
+// context length. The context of a state is given by the shortest path
+// leading to it, since any other transition reaching it has been
+// redirected there by pruning. Transitions to states out of range are
+// ignored, which is for Validate to report.
+func findStateLinks(m IterableModel) stateLinks {
+	links := make(stateLinks, m.NumStates())
+	for i := range links {
+		links[i] = stateLink{STATE_NIL, word.NIL}
+	}
+	for queue := []StateId{_STATE_EMPTY}; len(queue) > 0; queue = queue[1:] {
+		p := queue[0]
+		for xqw := range m.Transitions(p) {
+			x, q := xqw.Word, xqw.State
+			if int64(q) < int64(len(links)) && q != _STATE_EMPTY && links[q].Parent == STATE_NIL {
+				links[q] = stateLink{p, x}
+				queue = append(queue, q)
+			}
+		}
+	}
+	return links
+}
+
+// writeStateLinks writes links as a single block.
+func writeStateLinks(w *blockWriter, links stateLinks) error {
+	return w.Write(linkBytes(links), _LAYOUT_ALIGN)
+}
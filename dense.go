@@ -0,0 +1,218 @@
+package fslm
+
+// Dense arrays of the transitions of _STATE_EMPTY and _STATE_START.
+
+import (
+	"fmt"
+	"iter"
+	"sort"
+
+	"github.com/kho/word"
+)
+
+// denseState is what NextI gives from a state for each word, indexed
+// directly by the word id, so that a look-up is a single array load.
+// Words without a transition (including those beyond the array) lead
+// to _STATE_EMPTY with WEIGHT_LOG0.
+type denseState []StateWeight
+
+func (d denseState) next(x word.Id) (StateId, Weight) {
+	if uint64(x) < uint64(len(d)) {
+		e := d[x]
+		return e.State, e.Weight
+	}
+	return _STATE_EMPTY, WEIGHT_LOG0
+}
+
+// denseMissing tells whether (q, w), what a denseState gives for a
+// word, is that of a word without a transition. A transition to
+// _STATE_EMPTY of weight WEIGHT_LOG0 looks the same, so when a model
+// has a dense _STATE_EMPTY, its sparse transitions only keep such
+// transitions, while the others are only in the dense array. NextI
+// gives the same either way.
+func denseMissing(q StateId, w Weight) bool {
+	return q == _STATE_EMPTY && w == WEIGHT_LOG0
+}
+
+// missingTransitions returns the transitions in next that a dense
+// array cannot tell from missing words (see denseMissing), which are
+// all the sparse transitions of _STATE_EMPTY keep next to its dense
+// array.
+func missingTransitions(next []WordStateWeight) []WordStateWeight {
+	var missing []WordStateWeight
+	for _, xqw := range next {
+		if denseMissing(xqw.State, xqw.Weight) {
+			missing = append(missing, xqw)
+		}
+	}
+	return missing
+}
+
+// transitions gives the transitions of the state of d sorted by word,
+// taking those d cannot tell from missing words (see denseMissing)
+// from sparse, the sparse transitions of the state.
+func (d denseState) transitions(sparse iter.Seq[WordStateWeight]) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		var extra []WordStateWeight
+		for xqw := range sparse {
+			if denseMissing(xqw.State, xqw.Weight) {
+				extra = append(extra, xqw)
+			}
+		}
+		sort.Sort(byWord(extra))
+		for i, qw := range d {
+			x := word.Id(i)
+			if denseMissing(qw.State, qw.Weight) {
+				for len(extra) > 0 && extra[0].Word < x {
+					extra = extra[1:]
+				}
+				if len(extra) == 0 || extra[0].Word != x {
+					continue
+				}
+			}
+			if !yield(WordStateWeight{x, qw.State, qw.Weight}) {
+				return
+			}
+		}
+		for _, xqw := range extra {
+			if xqw.Word >= word.Id(len(d)) && !yield(xqw) {
+				return
+			}
+		}
+	}
+}
+
+// numTransitions returns the number of transitions d.transitions
+// gives.
+func (d denseState) numTransitions(sparse iter.Seq[WordStateWeight]) int {
+	n := 0
+	for range d.transitions(sparse) {
+		n++
+	}
+	return n
+}
+
+// denseStates are the dense states of a Hashed or Sorted model. Every
+// back-off chain ends at _STATE_EMPTY, so empty turns its look-up into
+// an array load; start, which is optional, does the same for the first
+// word of a sentence. Both are nil for models loaded from binaries of
+// version 1, which then look up the sparse transitions instead.
+type denseStates struct {
+	empty, start denseState
+}
+
+// emptyLexical is the lexical transition of _STATE_EMPTY consuming x
+// in empty; ok is false when there is no empty or x has to be looked
+// up in the sparse transitions instead (see denseMissing).
+func (d denseStates) emptyLexical(x word.Id) (q StateId, w Weight, ok bool) {
+	if d.empty == nil {
+		return _STATE_EMPTY, WEIGHT_LOG0, false
+	}
+	q, w = d.empty.next(x)
+	return q, w, !denseMissing(q, w)
+}
+
+// maxId returns the largest word with an entry in d, or word.NIL if
+// there is none.
+func (d denseStates) maxId() word.Id {
+	if n := max(len(d.empty), len(d.start)); n > 0 {
+		return word.Id(n - 1)
+	}
+	return word.NIL
+}
+
+// denseHeader is the header of the dense states of a binary, which
+// take the end of the entry block with empty followed by start.
+type denseHeader struct {
+	NumEmpty, NumStart int
+}
+
+// newDenseStates makes the dense states from the lexical transitions
+// of _STATE_EMPTY and, when withStart is set, those of _STATE_START,
+// whose back-off to _STATE_EMPTY has weight startBackOff.
+func newDenseStates(empty, start iter.Seq[WordStateWeight], startBackOff Weight, withStart bool) denseStates {
+	numWords := 0
+	for xqw := range empty {
+		numWords = max(numWords, int(xqw.Word)+1)
+	}
+	d := denseStates{empty: newDenseState(numWords)}
+	for xqw := range empty {
+		d.empty[xqw.Word] = StateWeight{xqw.State, xqw.Weight}
+	}
+	if !withStart {
+		return d
+	}
+	for xqw := range start {
+		numWords = max(numWords, int(xqw.Word)+1)
+	}
+	d.start = newDenseState(numWords)
+	for x, qw := range d.empty {
+		d.start[x] = StateWeight{qw.State, startBackOff + qw.Weight}
+	}
+	for xqw := range start {
+		d.start[xqw.Word] = StateWeight{xqw.State, xqw.Weight}
+	}
+	return d
+}
+
+func newDenseState(numWords int) denseState {
+	d := make(denseState, numWords)
+	for i := range d {
+		d[i] = StateWeight{_STATE_EMPTY, WEIGHT_LOG0}
+	}
+	return d
+}
+
+// header returns the header of d in a binary.
+func (d denseStates) header() denseHeader {
+	return denseHeader{len(d.empty), len(d.start)}
+}
+
+// numBytes returns the size of d in a binary.
+func (d denseStates) numBytes() int64 {
+	return int64(_STATE_WEIGHT_SIZE * (len(d.empty) + len(d.start)))
+}
+
+// write appends d in LAYOUT_LE32 to the current block of w.
+func (d denseStates) write(w *blockWriter) error {
+	if err := w.Append(stateWeightBytes(d.empty)); err != nil {
+		return err
+	}
+	return w.Append(stateWeightBytes(d.start))
+}
+
+// sliceDenseStates slices the dense states of the given header off the
+// end of raw and returns them with the rest of raw. They are backed by
+// raw on little-endian hosts.
+func sliceDenseStates(raw []byte, h denseHeader) (denseStates, []byte, error) {
+	if h.NumEmpty < 0 || h.NumStart < 0 || uint64(h.NumEmpty)+uint64(h.NumStart) > uint64(len(raw))/_STATE_WEIGHT_SIZE {
+		return denseStates{}, nil, fmt.Errorf("bad binary: entry block of %d bytes for dense states of %d and %d words", len(raw), h.NumEmpty, h.NumStart)
+	}
+	startAt := len(raw) - _STATE_WEIGHT_SIZE*h.NumStart
+	emptyAt := startAt - _STATE_WEIGHT_SIZE*h.NumEmpty
+	var d denseStates
+	if h.NumEmpty > 0 {
+		d.empty = parseStateWeights(raw[emptyAt:startAt])
+	}
+	if h.NumStart > 0 {
+		d.start = parseStateWeights(raw[startAt:])
+	}
+	return d, raw[:emptyAt], nil
+}
+
+// validate checks that the dense states only consume words below
+// vocabBound and lead to existing states, or to STATE_NIL when
+// consuming eosId.
+func (d denseStates) validate(numStates int, vocabBound, eosId word.Id) error {
+	for _, i := range []struct {
+		p StateId
+		d denseState
+	}{{_STATE_EMPTY, d.empty}, {_STATE_START, d.start}} {
+		for x, qw := range i.d {
+			if err := validateTransition(i.p, WordStateWeight{word.Id(x), qw.State, qw.Weight}, numStates, vocabBound, eosId); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package fslm
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestDenseStates(t *testing.T) {
+	arpa := syntheticARPA(300, 3, 3000, 1)
+	for _, denseStart := range []bool{false, true} {
+		for i, dump := range dumps {
+			builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			builder.SetDenseStart(denseStart)
+			model := dump(builder)
+			loaded := loadedModels()[i]
+			if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+				t.Fatalf("error in loading binary: %v", err)
+			}
+			// The same model without the dense states, as loaded from
+			// binaries of version 1.
+			sparse := withFullEmpty(loaded)
+			var dense denseStates
+			switch m := sparse.(type) {
+			case *Hashed:
+				dense, m.dense = m.dense, denseStates{}
+			case *Sorted:
+				dense, m.dense = m.dense, denseStates{}
+			}
+			if dense.empty == nil || (dense.start != nil) != denseStart {
+				t.Errorf("model %d: unexpected dense states of %d and %d words", i, len(dense.empty), len(dense.start))
+			}
+			for _, m := range []binaryModel{model, loaded} {
+				for _, p := range []StateId{_STATE_EMPTY, _STATE_START} {
+					for x := word.Id(0); x < word.Id(len(dense.empty)+2); x++ {
+						q, w := m.NextI(p, x)
+						expectedQ, expectedW := sparse.NextI(p, x)
+						if q != expectedQ || w != expectedW {
+							t.Errorf("model %d: expect (%d, %g) from state %d consuming %d; got (%d, %g)", i, expectedQ, expectedW, p, x, q, w)
+						}
+					}
+				}
+				if _, w := m.NextI(_STATE_EMPTY, word.NIL); w != WEIGHT_LOG0 {
+					t.Errorf("model %d: expect %g for nil; got %g", i, WEIGHT_LOG0, w)
+				}
+			}
+		}
+	}
+}
+
+func TestDenseStart(t *testing.T) {
+	for _, lm := range []struct {
+		ngrams []ngram
+		sents  [][]token
+	}{
+		{simpleTrigramLM, simpleTrigramSents},
+		{sparseFivegramLM, sparseFivegramSents},
+		{trickyBackOffLM, trickyBackOffSents},
+	} {
+		for _, dump := range dumps {
+			builder := readyBuilder(lm.ngrams)
+			builder.SetDenseStart(true)
+			model := dump(builder)
+			if err := checkModel(model); err != nil {
+				t.Errorf("check model failed with error %v", err)
+			}
+			sentTest(model, lm.sents, t)
+		}
+	}
+}
+
+func TestExternalDenseStart(t *testing.T) {
+	arpa := syntheticARPA(100, 3, 1000, 1)
+	builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	builder.SetDenseStart(true)
+	expected := builder.DumpSorted()
+	ext, err := FromARPAExternal(strings.NewReader(arpa), ARPAOptions{}, ExternalOptions{TempDir: t.TempDir(), DenseStart: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ext.Close()
+	var buf bytes.Buffer
+	if _, err := ext.WriteSortedTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var loaded Sorted
+	if err := loaded.ParseBinary(buf.Bytes()); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if loaded.dense.start == nil {
+		t.Fatalf("expect a dense start state")
+	}
+	// States are numbered differently, so only compare the weights.
+	for _, p := range []StateId{_STATE_EMPTY, _STATE_START} {
+		for x := word.Id(0); x < word.Id(len(loaded.dense.start)); x++ {
+			_, w := loaded.NextI(p, x)
+			_, expectedW := expected.NextI(p, x)
+			if w != expectedW {
+				t.Errorf("expect %g from state %d consuming %d; got %g", expectedW, p, x, w)
+			}
+		}
+	}
+}
+
+func TestDenseMissing(t *testing.T) {
+	// The pruned unigram c of log 0 leads to _STATE_EMPTY with
+	// WEIGHT_LOG0, which the dense array cannot tell from a missing
+	// word and thus stays in the sparse transitions of _STATE_EMPTY.
+	arpa := `\data\
+ngram 1=4
+
+\1-grams:
+-99	<s>	-1
+-1	</s>
+-2	a
+-99	c
+\end\
+`
+	for i, dump := range dumps {
+		builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		model := dump(builder)
+		loaded := loadedModels()[i]
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("error in loading binary: %v", err)
+		}
+		vocab, _, _, _, _ := model.Vocab()
+		a, c := vocab.IdOf("a"), vocab.IdOf("c")
+		for _, m := range []binaryModel{model, loaded} {
+			var (
+				sparse []WordStateWeight
+				prob   func([]word.Id, word.Id) (Weight, int)
+			)
+			switch m := m.(type) {
+			case *Hashed:
+				sparse, prob = slices.Collect(m.sparseTransitions(_STATE_EMPTY)), m.Prob
+			case *Sorted:
+				sparse, prob = slices.Collect(m.sparseTransitions(_STATE_EMPTY)), m.Prob
+			}
+			if expected := []WordStateWeight{{c, _STATE_EMPTY, WEIGHT_LOG0}}; !slices.Equal(sparse, expected) {
+				t.Errorf("model %d: expect sparse transitions %v of the empty state; got %v", i, expected, sparse)
+			}
+			if n := m.NumTransitions(_STATE_EMPTY); n != 4 {
+				t.Errorf("model %d: expect 4 transitions of the empty state; got %d", i, n)
+			}
+			found := false
+			for xqw := range m.Transitions(_STATE_EMPTY) {
+				found = found || xqw == WordStateWeight{c, _STATE_EMPTY, WEIGHT_LOG0}
+			}
+			if !found {
+				t.Errorf("model %d: expect the transition of c from the empty state", i)
+			}
+			if w, order := prob(nil, c); w != WEIGHT_LOG0 || order != 1 {
+				t.Errorf("model %d: expect (%g, 1) for c; got (%g, %d)", i, WEIGHT_LOG0, w, order)
+			}
+			if w, order := prob(nil, a); w != -2 || order != 1 {
+				t.Errorf("model %d: expect (-2, 1) for a; got (%g, %d)", i, w, order)
+			}
+		}
+	}
+}
+
+// withFullEmpty returns a copy of m, a Hashed or Sorted model, whose
+// sparse transitions of _STATE_EMPTY are all of its transitions, as in
+// binaries of version 1.
+func withFullEmpty(m binaryModel) binaryModel {
+	next := slices.Collect(m.Transitions(_STATE_EMPTY))
+	sort.Sort(byWord(next))
+	next = append(next, WordStateWeight{word.NIL, STATE_NIL, 0})
+	switch m := m.(type) {
+	case *Hashed:
+		c := *m
+		layout := hashedLayout(next, hashedSize(len(next)-1, 0))
+		if m.robinHood {
+			layout = robinHoodLayout(next, robinHoodSize(len(next)-1, 0))
+		}
+		c.entries, c.offsets = replaceFirstState(m.entries, m.offsets, parseBuckets(layout, LAYOUT_LE32))
+		return &c
+	case *Sorted:
+		c := *m
+		layout := sortedLayout
+		if m.eytzinger {
+			layout = eytzingerLayout
+		}
+		c.entries, c.offsets = replaceFirstState(m.entries, m.offsets, parseTransitions(layout(next, 0), LAYOUT_LE32))
+		return &c
+	}
+	panic("not a Hashed or Sorted model")
+}
+
+// replaceFirstState returns entries with those of the first state
+// replaced by first, and the offsets of the states in it.
+func replaceFirstState[E any](entries []E, offsets []uint64, first []E) ([]E, []uint64) {
+	newOffsets := make([]uint64, len(offsets))
+	for i := 1; i < len(offsets); i++ {
+		newOffsets[i] = offsets[i] - offsets[1] + uint64(len(first))
+	}
+	return append(slices.Clone(first), entries[offsets[1]:]...), newOffsets
+}
@@ -0,0 +1,1035 @@
+package fslm
+
+// Building a binary model from n-grams sorted on disk, for language
+// models too large to be built in memory by a Builder.
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/kho/word"
+)
+
+// ExternalOptions controls the temporary files of an
+// ExternalBuilder. The zero value gives the default behavior.
+type ExternalOptions struct {
+	// Directory for the temporary files; "" means os.TempDir().
+	TempDir string
+	// Number of bytes of n-gram records (4 bytes per word plus 16) that
+	// are kept in memory before they are sorted and written out as a
+	// run; <= 0 means 256MB.
+	ChunkBytes int
+	// Whether the binary has a dense _STATE_START; see
+	// Builder.SetDenseStart.
+	DenseStart bool
+	// Whether a Sorted binary is in the Eytzinger layout; see
+	// Builder.SetEytzinger.
+	Eytzinger bool
+	// Whether a Hashed binary uses Robin Hood tables; see
+	// Builder.SetRobinHood.
+	RobinHood bool
+}
+
+// ExternalBuilder builds a language model like Builder, but keeps the
+// n-grams on disk in sorted runs instead of in memory and writes the
+// model directly as a binary file. Only the vocabulary, a few numbers
+// per state and the lexical transitions of the states below the
+// highest order (which are needed to find the back-off states) are
+// kept in memory; the transitions of the states of the highest order,
+// which usually make up most of a model, go straight to disk.
+//
+// The resulting model scores the same as the one dumped from a Builder
+// given the same n-grams, but its states are numbered differently:
+// _STATE_EMPTY and _STATE_START are followed by the other states in
+// the order of increasing context length and then of the word ids of
+// their contexts.
+//
+// Must be constructed using NewExternalBuilder() and closed after use
+// to remove the temporary files.
+type ExternalBuilder struct {
+	ngramVocab
+	opts ExternalOptions
+	// Directory of the temporary files.
+	dir string
+	// N-gram records by order - 1.
+	orders []*externalOrder
+	// Total bytes of records not yet written out.
+	pending int
+	// Sequence number of the last n-gram added.
+	seq uint64
+	// Whether missing prefixes and duplicate n-grams are errors, as in
+	// ARPA_STRICT mode.
+	strict bool
+	info   ModelInfo
+	// Set by prepare. counts[k] holds the number of lexical transitions
+	// of each state of context length k other than _STATE_START, in the
+	// order of their contexts; startCount is that of _STATE_START.
+	counts     [][]uint32
+	startCount uint32
+	// Scratch space for AddNgram.
+	ids []word.Id
+}
+
+// NewExternalBuilder constructs a new ExternalBuilder, whose temporary
+// files are put in a new directory under opts.TempDir. See NewBuilder
+// for vocab, bos and eos.
+func NewExternalBuilder(vocab *word.Vocab, bos, eos string, opts ExternalOptions) (*ExternalBuilder, error) {
+	v, err := newNgramVocab(vocab, bos, eos)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ChunkBytes <= 0 {
+		opts.ChunkBytes = 256 << 20
+	}
+	dir, err := os.MkdirTemp(opts.TempDir, "fslm-")
+	if err != nil {
+		return nil, err
+	}
+	b := &ExternalBuilder{ngramVocab: v, opts: opts, dir: dir}
+	b.info.Checksum = CHECKSUM_CRC32C
+	// Like a Builder, there is always <s> as a unigram. It is added as
+	// an implicit prefix so that an actual entry takes over.
+	if err := b.add(0, nil, b.bosId, 0, 0); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// FromARPAExternal reads an ARPA file into a new ExternalBuilder as
+// specified by opts (opts.Workers only affects the parsing). Errors in
+// the content of the file are reported as *ARPAError, including
+// missing prefixes and duplicate n-grams in ARPA_STRICT mode, which are
+// found after all the n-grams are sorted.
+func FromARPAExternal(in io.Reader, opts ARPAOptions, ext ExternalOptions) (*ExternalBuilder, error) {
+	builder, err := NewExternalBuilder(nil, "", "", ext)
+	if err != nil {
+		return nil, err
+	}
+	builder.strict = opts.Mode == ARPA_STRICT
+	if err := readARPA(in, &arpaState{sink: builder, opts: opts}, &builder.info); err != nil {
+		builder.Close()
+		return nil, err
+	}
+	if err := builder.prepare(); err != nil {
+		builder.Close()
+		return nil, err
+	}
+	return builder, nil
+}
+
+// AddNgram adds an n-gram entry just like Builder.AddNgram, except
+// that write errors of the temporary files are also returned.
+func (b *ExternalBuilder) AddNgram(context []string, word string, weight Weight, backOff Weight) error {
+	if err := b.checkNgram(context, word); err != nil {
+		return err
+	}
+	b.ids = b.idsOf(b.ids, context, word)
+	n := len(context)
+	b.seq++
+	return b.add(b.seq, b.ids[:n], b.ids[n], weight, backOff)
+}
+
+// AddNgramI is similar to AddNgram but takes word ids from the
+// builder's vocabulary (see Vocab).
+func (b *ExternalBuilder) AddNgramI(context []word.Id, x word.Id, weight Weight, backOff Weight) error {
+	if err := b.checkNgramI(context, x); err != nil {
+		return err
+	}
+	b.seq++
+	return b.add(b.seq, context, x, weight, backOff)
+}
+
+// Info returns the information that goes with the written model; see
+// Builder.Info.
+func (b *ExternalBuilder) Info() *ModelInfo {
+	return &b.info
+}
+
+// Vocab returns the builder's vocabulary and sentence boundary
+// symbols; see Builder.Vocab.
+func (b *ExternalBuilder) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return b.vocab, b.bos, b.eos, b.bosId, b.eosId
+}
+
+// addNgramLine implements ngramSink. The line serves as the sequence
+// number so that errors found after sorting can be located.
+func (b *ExternalBuilder) addNgramLine(line int, context []word.Id, x word.Id, weight Weight, backOff Weight) error {
+	b.seq = uint64(line)
+	return b.add(b.seq, context, x, weight, backOff)
+}
+
+func (b *ExternalBuilder) add(seq uint64, context []word.Id, x word.Id, weight Weight, backOff Weight) error {
+	if b.counts != nil {
+		return errors.New("n-gram added after the ExternalBuilder is prepared")
+	}
+	weight, backOff = b.weights(context, x, weight, backOff)
+	o := b.order(len(context) + 1)
+	l := len(o.chunk)
+	o.chunk = appendNgramRecord(o.chunk, context, x, seq, weight, backOff)
+	b.pending += len(o.chunk) - l
+	if b.pending >= b.opts.ChunkBytes {
+		return b.spill()
+	}
+	return nil
+}
+
+// order returns the records of order n, extending b.orders when
+// necessary.
+func (b *ExternalBuilder) order(n int) *externalOrder {
+	for len(b.orders) < n {
+		b.orders = append(b.orders, &externalOrder{n: len(b.orders) + 1})
+	}
+	return b.orders[n-1]
+}
+
+// spill writes out all pending records as sorted runs.
+func (b *ExternalBuilder) spill() error {
+	for _, o := range b.orders {
+		if len(o.chunk) == 0 {
+			continue
+		}
+		size := o.recordSize()
+		recs := make([]ngramRecord, len(o.chunk)/size)
+		for i := range recs {
+			recs[i] = ngramRecord(o.chunk[i*size : (i+1)*size])
+		}
+		sort.Slice(recs, func(i, j int) bool {
+			return bytes.Compare(recs[i].key(), recs[j].key()) < 0
+		})
+		w, err := b.newRun(o)
+		if err != nil {
+			return err
+		}
+		for _, r := range recs {
+			if _, err := w.Write(r); err != nil {
+				w.Close()
+				return err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		o.chunk = o.chunk[:0]
+	}
+	b.pending = 0
+	return nil
+}
+
+// Close removes the temporary files.
+func (b *ExternalBuilder) Close() error {
+	b.orders = nil
+	return os.RemoveAll(b.dir)
+}
+
+// externalOrder holds the records of the n-grams of order n: those
+// still in memory and the runs already written out.
+type externalOrder struct {
+	n     int
+	chunk []byte
+	runs  []string
+}
+
+func (o *externalOrder) recordSize() int {
+	return 4*o.n + 16
+}
+
+// ngramRecord is an n-gram entry as stored in the runs: the word ids,
+// the sequence number of the entry (0 for implicitly added prefixes),
+// the weight and the back-off weight, all big-endian, so that the
+// records sort by n-gram and then by sequence number as bytes.
+type ngramRecord []byte
+
+func appendNgramRecord(buf []byte, context []word.Id, x word.Id, seq uint64, weight, backOff Weight) []byte {
+	for _, c := range context {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(c))
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(x))
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	buf = binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(weight)))
+	return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(backOff)))
+}
+
+// key is what records are sorted by.
+func (r ngramRecord) key() []byte { return r[:len(r)-8] }
+
+// ngram is the encoded word ids, which is also the encoded context of
+// the n-grams extending r.
+func (r ngramRecord) ngram() []byte { return r[:len(r)-16] }
+
+// context is the encoded context words.
+func (r ngramRecord) context() []byte { return r[:len(r)-20] }
+
+func (r ngramRecord) Order() int { return len(r.ngram()) / 4 }
+
+// Id returns the i-th word id.
+func (r ngramRecord) Id(i int) word.Id {
+	return word.Id(binary.BigEndian.Uint32(r[4*i:]))
+}
+
+func (r ngramRecord) Word() word.Id { return r.Id(r.Order() - 1) }
+func (r ngramRecord) Seq() uint64   { return binary.BigEndian.Uint64(r[len(r)-16:]) }
+func (r ngramRecord) Weight() Weight {
+	return Weight(math.Float32frombits(binary.BigEndian.Uint32(r[len(r)-8:])))
+}
+func (r ngramRecord) BackOff() Weight {
+	return Weight(math.Float32frombits(binary.BigEndian.Uint32(r[len(r)-4:])))
+}
+
+// runWriter writes a new run of records.
+type runWriter struct {
+	*bufio.Writer
+	file  *os.File
+	order *externalOrder
+}
+
+func (b *ExternalBuilder) newRun(o *externalOrder) (*runWriter, error) {
+	f, err := os.Create(filepath.Join(b.dir, fmt.Sprintf("%d-%d", o.n, len(o.runs))))
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{bufio.NewWriter(f), f, o}, nil
+}
+
+// Close finishes the run and adds it to its order.
+func (w *runWriter) Close() error {
+	err := w.Flush()
+	if err2 := w.file.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		w.order.runs = append(w.order.runs, w.file.Name())
+	}
+	return err
+}
+
+// runReader reads the records of a run one by one.
+type runReader struct {
+	file *os.File
+	in   *bufio.Reader
+	rec  ngramRecord
+}
+
+func (r *runReader) next() (bool, error) {
+	if _, err := io.ReadFull(r.in, r.rec); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runHeap orders the runs by their current records.
+type runHeap []*runReader
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return bytes.Compare(h[i].rec.key(), h[j].rec.key()) < 0 }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// ngramStream merges the runs of one order into a sorted stream of
+// unique n-grams. Of duplicate n-grams, the one added last is kept,
+// just as the last one added to a Builder takes over.
+type ngramStream struct {
+	runs runHeap
+	// Whether there is a current record; the current record; and the
+	// sequence number of the last duplicate of it that is not an
+	// implicit prefix (0 when there is none).
+	ok  bool
+	rec ngramRecord
+	dup uint64
+}
+
+// open opens a stream of the n-grams of order n positioned at the
+// first n-gram.
+func (b *ExternalBuilder) open(n int) (*ngramStream, error) {
+	o := b.order(n)
+	s := &ngramStream{rec: make(ngramRecord, o.recordSize())}
+	for _, path := range o.runs {
+		f, err := os.Open(path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		r := &runReader{f, bufio.NewReader(f), make(ngramRecord, o.recordSize())}
+		ok, err := r.next()
+		if err != nil {
+			f.Close()
+			s.Close()
+			return nil, err
+		}
+		if ok {
+			s.runs = append(s.runs, r)
+		} else {
+			f.Close()
+		}
+	}
+	heap.Init(&s.runs)
+	if err := s.Next(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next moves to the next unique n-gram.
+func (s *ngramStream) Next() error {
+	s.ok, s.dup = false, 0
+	for len(s.runs) > 0 {
+		r := s.runs[0]
+		if s.ok && !bytes.Equal(r.rec.ngram(), s.rec.ngram()) {
+			break
+		}
+		if s.ok && s.rec.Seq() != 0 {
+			s.dup = r.rec.Seq()
+		}
+		copy(s.rec, r.rec)
+		s.ok = true
+		if ok, err := r.next(); err != nil {
+			return err
+		} else if ok {
+			heap.Fix(&s.runs, 0)
+		} else {
+			heap.Pop(&s.runs)
+			r.file.Close()
+		}
+	}
+	return nil
+}
+
+// seekContext moves to the first n-gram whose context is no less than
+// context and reports whether its context is context.
+func (s *ngramStream) seekContext(context []byte) (bool, error) {
+	for s.ok && bytes.Compare(s.rec.context(), context) < 0 {
+		if err := s.Next(); err != nil {
+			return false, err
+		}
+	}
+	return s.ok && bytes.Equal(s.rec.context(), context), nil
+}
+
+// seekNgram is seekContext on the n-gram itself.
+func (s *ngramStream) seekNgram(ngram []byte) (bool, error) {
+	for s.ok && bytes.Compare(s.rec.ngram(), ngram) < 0 {
+		if err := s.Next(); err != nil {
+			return false, err
+		}
+	}
+	return s.ok && bytes.Equal(s.rec.ngram(), ngram), nil
+}
+
+func (s *ngramStream) Close() {
+	for _, r := range s.runs {
+		r.file.Close()
+	}
+	s.runs = nil
+}
+
+// isStart tells whether the encoded context is that of _STATE_START.
+func (b *ExternalBuilder) isStart(context []byte) bool {
+	return len(context) == 4 && word.Id(binary.BigEndian.Uint32(context)) == b.bosId
+}
+
+// prepare goes through the orders from the highest down, adding the
+// missing prefixes of each order as implicit n-grams of the order
+// below (or reporting them in strict mode), and counts the lexical
+// transitions of each state. It is done only once.
+func (b *ExternalBuilder) prepare() error {
+	if b.counts != nil {
+		return nil
+	}
+	if err := b.spill(); err != nil {
+		return err
+	}
+	counts := make([][]uint32, len(b.orders))
+	for n := len(b.orders); n > 0; n-- {
+		var err error
+		if counts[n-1], err = b.prepareOrder(n); err != nil {
+			return err
+		}
+	}
+	b.counts = counts
+	if glog.V(1) {
+		numStates := 2
+		for _, c := range counts[1:] {
+			numStates += len(c)
+		}
+		glog.Infof("%d states", numStates)
+	}
+	return nil
+}
+
+// prepareOrder prepares the n-grams of order n and returns the counts
+// of the states of order n - 1 (see ExternalBuilder.counts).
+func (b *ExternalBuilder) prepareOrder(n int) (counts []uint32, err error) {
+	ngrams, err := b.open(n)
+	if err != nil {
+		return nil, err
+	}
+	defer ngrams.Close()
+	var prefixes *ngramStream
+	var implicit *runWriter
+	if n > 1 {
+		if prefixes, err = b.open(n - 1); err != nil {
+			return nil, err
+		}
+		defer prefixes.Close()
+		if implicit, err = b.newRun(b.order(n - 1)); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err2 := implicit.Close(); err == nil {
+				err = err2
+			}
+		}()
+	}
+	var context []byte
+	count, started := uint32(0), false
+	endGroup := func() {
+		if n == 2 && b.isStart(context) {
+			b.startCount = count
+		} else {
+			counts = append(counts, count)
+		}
+	}
+	for ngrams.ok {
+		r := ngrams.rec
+		if b.strict && ngrams.dup != 0 {
+			return nil, b.recordError(ngrams.dup, r, "duplicate n-gram")
+		}
+		if c := r.context(); !started || !bytes.Equal(c, context) {
+			if started {
+				endGroup()
+			}
+			context, count, started = append(context[:0], c...), 0, true
+			if n > 1 {
+				found, err := prefixes.seekNgram(c)
+				if err != nil {
+					return nil, err
+				}
+				if !found {
+					if b.strict {
+						return nil, b.recordError(r.Seq(), r, "missing prefix")
+					}
+					// Same as those implicitly created by a Builder.
+					// An all-zero sequence number, weight and back-off weight.
+					if _, err := implicit.Write(append(append([]byte(nil), c...), make([]byte, 16)...)); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		count++
+		if err := ngrams.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if started {
+		endGroup()
+	}
+	return counts, nil
+}
+
+// recordError reports an error of the n-gram of r found at the given
+// sequence number as an *ARPAError.
+func (b *ExternalBuilder) recordError(seq uint64, r ngramRecord, reason string) error {
+	n := r.Order()
+	context := make([]word.Id, n-1)
+	for i := range context {
+		context[i] = r.Id(i)
+	}
+	return &ARPAError{int(seq), fmt.Sprintf("\\%d-grams:", n), b.newNgramErrorI(context, r.Word(), reason)}
+}
+
+// WriteHashed writes the model as a Hashed binary to path, which is
+// replaced atomically like Hashed.WriteBinary does.
+func (b *ExternalBuilder) WriteHashed(path string, scale float64) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := b.WriteHashedTo(w, scale)
+		return err
+	})
+}
+
+// WriteSorted writes the model as a Sorted binary to path, which is
+// replaced atomically like Sorted.WriteBinary does.
+func (b *ExternalBuilder) WriteSorted(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := b.WriteSortedTo(w)
+		return err
+	})
+}
+
+// WriteHashedTo writes the model as a Hashed binary to w; see
+// Builder.DumpHashed for scale.
+func (b *ExternalBuilder) WriteHashedTo(w io.Writer, scale float64) (int64, error) {
+	if scale <= 1 {
+		scale = 1.5
+	}
+	size, layout := func(n int) int { return hashedSize(n, scale) }, hashedLayout
+	if b.opts.RobinHood {
+		size = func(n int) int { return robinHoodSize(n, scale) }
+		layout = robinHoodLayout
+	}
+	return b.write(w, externalFormat{
+		MAGIC_HASHED,
+		size,
+		layout,
+		[]interface{}{b.opts.RobinHood},
+	})
+}
+
+// WriteSortedTo writes the model as a Sorted binary to w.
+func (b *ExternalBuilder) WriteSortedTo(w io.Writer) (int64, error) {
+	layout := sortedLayout
+	if b.opts.Eytzinger {
+		layout = eytzingerLayout
+	}
+	return b.write(w, externalFormat{
+		MAGIC_SORTED,
+		func(n int) int { return n + 1 },
+		layout,
+		[]interface{}{b.opts.Eytzinger},
+	})
+}
+
+// externalFormat describes the entries of a binary model.
+type externalFormat struct {
+	magic string
+	// The number of entries of a state with n lexical transitions.
+	size func(n int) int
+	// layout lays out the entries of a state of the given size, given
+	// its lexical transitions sorted by word followed by its back-off
+	// transition, and returns them in LAYOUT_LE32.
+	layout func(next []WordStateWeight, size int) []byte
+	// Extra values of the header after the dense header.
+	header []interface{}
+}
+
+func hashedLayout(next []WordStateWeight, size int) []byte {
+	buckets := xqwInitBuckets(size)
+	backoff := next[len(next)-1]
+	for _, xqw := range next[:len(next)-1] {
+		*buckets.nextAvailable(xqw.Word) = xqwEntry{xqw.Word, StateWeight{xqw.State, xqw.Weight}}
+	}
+	for i := range buckets {
+		if buckets[i].Key == word.NIL {
+			buckets[i].Value = StateWeight{backoff.State, backoff.Weight}
+		}
+	}
+	return bucketBytes(buckets)
+}
+
+func robinHoodLayout(next []WordStateWeight, size int) []byte {
+	backoff := next[len(next)-1]
+	entries := xqwInitBuckets(size)
+	entries[0].Value = StateWeight{backoff.State, backoff.Weight}
+	buckets := entries[1:]
+	for _, xqw := range next[:len(next)-1] {
+		robinHoodInsert(buckets, xqwEntry{xqw.Word, StateWeight{xqw.State, xqw.Weight}})
+	}
+	for i := range buckets {
+		if buckets[i].Key == word.NIL {
+			buckets[i].Value = entries[0].Value
+		}
+	}
+	return bucketBytes(entries)
+}
+
+func sortedLayout(next []WordStateWeight, _ int) []byte {
+	return transitionBytes(next)
+}
+
+func eytzingerLayout(next []WordStateWeight, _ int) []byte {
+	tree := slices.Clone(next)
+	eytzinger(tree[:len(tree)-1])
+	return transitionBytes(tree)
+}
+
+// externalBuild is the state of ExternalBuilder.write.
+type externalBuild struct {
+	*ExternalBuilder
+	format externalFormat
+	// The first state of each context length.
+	base []StateId
+	// The back-off transition and link of each state.
+	backoff []StateWeight
+	links   stateLinks
+	// The raw entries of all the states but _STATE_EMPTY, and where
+	// those of _STATE_START and of the first state of each context
+	// length start in it (in entries).
+	entries      *os.File
+	startOffset  int64
+	offsets      []int64
+	numEntries   int64
+	stateOffsets []uint64 // Where the entries of each state start.
+	maxId        word.Id  // The largest word of all transitions.
+	numLowStates StateId
+	// The lexical transitions (followed by the back-off transition) of
+	// the states below numLowStates, which are all of a context length
+	// less than the highest, laid out one after another as in Sorted,
+	// where those of each state start, and the back-off weight of the
+	// n-gram of each transition that is a pruned state (0 for other
+	// transitions).
+	low        []WordStateWeight
+	lowOffsets []int64
+	lowFolded  []Weight
+	// The source weights of the n-grams whose weights are folded (see
+	// foldedNgrams), sorted only before writing.
+	folded []arpaEntry
+	// The lexical transitions of _STATE_EMPTY and _STATE_START for the
+	// dense states.
+	emptyNext, startNext []WordStateWeight
+	// The raw entries of _STATE_EMPTY, which only keep the transitions
+	// its dense array cannot tell from missing words (see
+	// missingTransitions) and thus have a size only known after
+	// building from the unigrams; they go before the entries of the
+	// other states.
+	emptyEntries []byte
+}
+
+// write builds the model going through the orders from the lowest up,
+// where the n-grams of order n give the lexical transitions of states
+// of order n - 1, and then writes it out in the given format.
+func (b *ExternalBuilder) write(out io.Writer, format externalFormat) (int64, error) {
+	if err := b.prepare(); err != nil {
+		return 0, err
+	}
+	entries, err := os.CreateTemp(b.dir, "entries-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(entries.Name())
+	defer entries.Close()
+
+	c := b.newExternalBuild(format, entries)
+	for n := 1; n <= len(b.orders); n++ {
+		if err := c.buildOrder(n); err != nil {
+			return 0, err
+		}
+		if glog.V(1) {
+			glog.Infof("finished building from %d-grams", n)
+		}
+	}
+	if b.startCount == 0 {
+		next := []WordStateWeight{{word.NIL, c.backoff[_STATE_START].State, c.backoff[_STATE_START].Weight}}
+		if err := c.writeState(_STATE_START, next, c.startOffset); err != nil {
+			return 0, err
+		}
+	}
+	return c.writeBinary(out)
+}
+
+func (b *ExternalBuilder) newExternalBuild(format externalFormat, entries *os.File) *externalBuild {
+	c := &externalBuild{ExternalBuilder: b, format: format, entries: entries, maxId: word.NIL}
+	// base[0] is _STATE_EMPTY and base[1] follows _STATE_START.
+	c.base = []StateId{_STATE_EMPTY, _STATE_START + 1}
+	for _, counts := range b.counts[1:] {
+		c.base = append(c.base, c.base[len(c.base)-1]+StateId(len(counts)))
+	}
+	numStates := int(c.base[len(c.base)-1])
+	c.backoff = make([]StateWeight, numStates)
+	c.links = make(stateLinks, numStates)
+	c.backoff[_STATE_EMPTY] = StateWeight{STATE_NIL, 0}
+	c.links[_STATE_EMPTY] = stateLink{STATE_NIL, word.NIL}
+
+	c.stateOffsets = make([]uint64, 1, numStates+1)
+	addState := func(count uint32) {
+		c.numEntries += int64(format.size(int(count)))
+		c.stateOffsets = append(c.stateOffsets, uint64(c.numEntries))
+	}
+	c.stateOffsets = append(c.stateOffsets, 0) // See emptyEntries.
+	c.startOffset = c.numEntries
+	addState(b.startCount)
+	for _, counts := range b.counts[1:] {
+		c.offsets = append(c.offsets, c.numEntries)
+		for _, count := range counts {
+			addState(count)
+		}
+	}
+
+	// Keep all but the highest order for finding back-off states.
+	if len(c.base) > 2 {
+		c.numLowStates = c.base[len(c.base)-2]
+	}
+	c.lowOffsets = make([]int64, c.numLowStates+1)
+	for p := StateId(0); p < c.numLowStates; p++ {
+		c.lowOffsets[p+1] = c.lowOffsets[p] + int64(c.count(p)) + 1
+	}
+	c.low = make([]WordStateWeight, c.lowOffsets[c.numLowStates])
+	c.lowFolded = make([]Weight, len(c.low))
+	return c
+}
+
+// count returns the number of lexical transitions of p.
+func (c *externalBuild) count(p StateId) uint32 {
+	switch p {
+	case _STATE_EMPTY:
+		return c.counts[0][0]
+	case _STATE_START:
+		return c.startCount
+	}
+	n := c.stateOrder(p)
+	return c.counts[n][p-c.base[n]]
+}
+
+// stateOrder returns the context length of p.
+func (c *externalBuild) stateOrder(p StateId) int {
+	if p <= _STATE_START {
+		return int(p)
+	}
+	return sort.Search(len(c.base), func(i int) bool { return c.base[i] > p }) - 1
+}
+
+// buildOrder adds the n-grams of order n as the lexical transitions of
+// the states of order n - 1, which are complete afterwards.
+func (c *externalBuild) buildOrder(n int) error {
+	ngrams, err := c.open(n)
+	if err != nil {
+		return err
+	}
+	defer ngrams.Close()
+	// The n-grams extending those of order n, which decide whether the
+	// latter are states.
+	var extensions *ngramStream
+	if n < len(c.orders) {
+		if extensions, err = c.open(n + 1); err != nil {
+			return err
+		}
+		defer extensions.Close()
+	}
+
+	var (
+		context      []byte
+		started      bool
+		p            StateId
+		next         []WordStateWeight
+		folded       []Weight
+		offset       int64
+		nextP, nextQ StateId
+	)
+	if n > 1 {
+		offset, nextP = c.offsets[n-2], c.base[n-1]
+	}
+	if n < len(c.base) {
+		nextQ = c.base[n]
+	}
+	endState := func() error {
+		next = append(next, WordStateWeight{word.NIL, c.backoff[p].State, c.backoff[p].Weight})
+		folded = append(folded, 0)
+		if p < c.numLowStates {
+			copy(c.low[c.lowOffsets[p]:], next)
+			copy(c.lowFolded[c.lowOffsets[p]:], folded)
+		}
+		switch p {
+		case _STATE_EMPTY:
+			return c.writeState(p, next, 0)
+		case _STATE_START:
+			return c.writeState(p, next, c.startOffset)
+		}
+		err := c.writeState(p, next, offset)
+		offset += int64(c.format.size(len(next) - 1))
+		return err
+	}
+	for ngrams.ok {
+		r := ngrams.rec
+		if ctx := r.context(); !started || !bytes.Equal(ctx, context) {
+			if started {
+				if err := endState(); err != nil {
+					return err
+				}
+			}
+			context, started = append(context[:0], ctx...), true
+			next, folded = next[:0], folded[:0]
+			switch {
+			case n == 1:
+				p = _STATE_EMPTY
+			case n == 2 && c.isStart(ctx):
+				p = _STATE_START
+			default:
+				p = nextP
+				nextP++
+			}
+		}
+		x, w := r.Word(), r.Weight()
+		switch {
+		case x == c.eosId:
+			next = append(next, WordStateWeight{x, STATE_NIL, w})
+			folded = append(folded, 0)
+		default:
+			q := STATE_NIL
+			if n == 1 && x == c.bosId {
+				q = _STATE_START
+			} else if extensions != nil {
+				found, err := extensions.seekContext(r.ngram())
+				if err != nil {
+					return err
+				}
+				if found {
+					q = nextQ
+					nextQ++
+				}
+			}
+			bow := r.BackOff()
+			backoff := c.findBackOff(p, x, bow)
+			if q != STATE_NIL {
+				c.backoff[q] = backoff
+				c.links[q] = stateLink{p, x}
+				next = append(next, WordStateWeight{x, q, w})
+				folded = append(folded, 0)
+				if backoff.Weight != bow {
+					c.folded = append(c.folded, arpaEntry{p, x, w, bow})
+				}
+			} else {
+				// Pruned: pre-walk to the back-off state.
+				next = append(next, WordStateWeight{x, backoff.State, w + backoff.Weight})
+				folded = append(folded, backoff.Weight)
+				if backoff.Weight != 0 || bow != 0 {
+					c.folded = append(c.folded, arpaEntry{p, x, w, bow})
+				}
+			}
+		}
+		if err := ngrams.Next(); err != nil {
+			return err
+		}
+	}
+	if started {
+		return endState()
+	}
+	return nil
+}
+
+// findBackOff finds the final back-off transition of the n-gram that
+// extends p by x with back-off weight bow, in the same way as
+// Builder.linkTransition does.
+func (c *externalBuild) findBackOff(p StateId, x word.Id, bow Weight) StateWeight {
+	if p == _STATE_EMPTY {
+		return StateWeight{_STATE_EMPTY, bow}
+	}
+	pBack := c.backoff[p].State
+	xqw, folded, ok := c.findLow(pBack, x)
+	for !ok && pBack != _STATE_EMPTY {
+		pBack = c.backoff[pBack].State
+		xqw, folded, ok = c.findLow(pBack, x)
+	}
+	switch {
+	case !ok:
+		return StateWeight{_STATE_EMPTY, bow}
+	case c.stateOrder(xqw.State) <= c.stateOrder(pBack):
+		// The n-gram is a pruned state and the transition already leads
+		// to its back-off state.
+		return StateWeight{xqw.State, bow + folded}
+	case xqw.State == _STATE_START && c.startCount == 0:
+		// _STATE_START is never pruned but backs off like a pruned state.
+		start := c.backoff[_STATE_START]
+		return StateWeight{start.State, bow + start.Weight}
+	default:
+		return StateWeight{xqw.State, bow}
+	}
+}
+
+// findLow finds the lexical transition from p consuming x among the
+// states kept in memory.
+func (c *externalBuild) findLow(p StateId, x word.Id) (WordStateWeight, Weight, bool) {
+	lo, hi := c.lowOffsets[p], c.lowOffsets[p+1]-1
+	next := c.low[lo:hi]
+	i := sort.Search(len(next), func(i int) bool { return next[i].Word >= x })
+	if i < len(next) && next[i].Word == x {
+		return next[i], c.lowFolded[lo+int64(i)], true
+	}
+	return WordStateWeight{}, 0, false
+}
+
+// writeState writes the entries of p laid out from next at offset,
+// except for those of _STATE_EMPTY, which go to emptyEntries.
+func (c *externalBuild) writeState(p StateId, next []WordStateWeight, offset int64) error {
+	for _, xqw := range next[:len(next)-1] {
+		c.maxId = maxWordId(c.maxId, xqw.Word)
+	}
+	switch p {
+	case _STATE_EMPTY:
+		c.emptyNext = slices.Clone(next[:len(next)-1])
+		sparse := append(missingTransitions(c.emptyNext), next[len(next)-1])
+		c.emptyEntries = c.format.layout(sparse, c.format.size(len(sparse)-1))
+		return nil
+	case _STATE_START:
+		c.startNext = slices.Clone(next[:len(next)-1])
+	}
+	raw := c.format.layout(next, c.format.size(len(next)-1))
+	_, err := c.entries.WriteAt(raw, offset*_ENTRY_SIZE)
+	return err
+}
+
+// writeBinary writes out the binary in the same way as the WriteBinary
+// method of the models.
+func (c *externalBuild) writeBinary(out io.Writer) (int64, error) {
+	dense := newDenseStates(slices.Values(c.emptyNext), slices.Values(c.startNext), c.backoff[_STATE_START].Weight, c.opts.DenseStart)
+	header, err := encodeHeader(c.bos, c.eos, nil, append([]interface{}{len(c.stateOffsets) - 1, dense.header()}, c.format.header...)...)
+	if err != nil {
+		return 0, err
+	}
+	vocab, err := encodeModelVocab(c.vocab, c.maxId, c.bosId, c.eosId)
+	if err != nil {
+		return 0, err
+	}
+	info := c.info
+	info.Order = len(c.counts)
+	info.Counts = make([]int, len(c.counts))
+	for i, counts := range c.counts {
+		for _, count := range counts {
+			info.Counts[i] += int(count)
+		}
+	}
+	if len(c.counts) > 1 {
+		info.Counts[1] += int(c.startCount)
+	}
+	slices.SortFunc(c.folded, compareArpaEntries)
+	// Make room for the entries of _STATE_EMPTY before the others.
+	for i := range c.stateOffsets[1:] {
+		c.stateOffsets[i+1] += uint64(len(c.emptyEntries) / _ENTRY_SIZE)
+	}
+	entryBytes := int64(_OFFSET_SIZE*len(c.stateOffsets)+len(c.emptyEntries)) + _ENTRY_SIZE*c.numEntries + dense.numBytes()
+	return writeBinary(out, c.format.magic, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(offsetBytes(c.stateOffsets)); err != nil {
+			return err
+		}
+		if err := w.Append(c.emptyEntries); err != nil {
+			return err
+		}
+		// Copy from the temporary file.
+		if _, err := c.entries.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		buf := make([]byte, 1<<20)
+		for left := _ENTRY_SIZE * c.numEntries; left > 0; {
+			n := int64(len(buf))
+			if n > left {
+				n = left
+			}
+			if _, err := io.ReadFull(c.entries, buf[:n]); err != nil {
+				return err
+			}
+			if err := w.Append(buf[:n]); err != nil {
+				return err
+			}
+			left -= n
+		}
+		return dense.write(w)
+	}, c.links, c.folded)
+}
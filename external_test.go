@@ -0,0 +1,225 @@
+package fslm
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kho/easy"
+)
+
+func TestExternalBuilder(t *testing.T) {
+	for _, i := range []struct {
+		LM    []ngram
+		Sents [][]token
+	}{
+		{simpleTrigramLM, simpleTrigramSents},
+		{sparseFivegramLM, sparseFivegramSents},
+		{sparserFivegramLM, sparserFivegramSents},
+		{trickyBackOffLM, trickyBackOffSents},
+	} {
+		// A tiny chunk so that there are many runs to merge.
+		builder, err := NewExternalBuilder(nil, "", "", ExternalOptions{ChunkBytes: 64})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, j := range i.LM {
+			c, x, w, b := j.Params()
+			if err := builder.AddNgram(c, x, w, b); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		for _, model := range externalModels(builder, t) {
+			sentTest(model, i.Sents, t)
+			externalCheck(model, readyBuilder(i.LM).DumpHashed(0), t)
+		}
+		builder.Close()
+	}
+}
+
+func TestFromARPAExternal(t *testing.T) {
+	var arpas []string
+	for n := 1; n <= 5; n++ {
+		arpas = append(arpas, syntheticARPA(50, n, 500, int64(n)))
+	}
+	for _, i := range []string{"simple.3gram.arpa", "messy.3gram.arpa.gz"} {
+		in, err := easy.Open(path.Join("testdata", i))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var buf bytes.Buffer
+		buf.ReadFrom(in)
+		in.Close()
+		arpas = append(arpas, buf.String())
+	}
+	// <s> as a pruned state (without any extension) and not.
+	arpas = append(arpas, "\\data\\\n\\1-grams:\n-99 <s> -0.5\n-1 a -0.3\n-1 </s>\n\\2-grams:\n-2 a <s>\n-1 a </s>\n\\end\\\n")
+	arpas = append(arpas, "\\data\\\n\\1-grams:\n-99 <s> -0.5\n-1 a -0.3\n-1 </s>\n\\2-grams:\n-2 a <s>\n-1 <s> a\n\\end\\\n")
+	// Missing prefixes, duplicate n-grams and sections out of order.
+	arpas = append(arpas, "\\data\\\n\\3-grams:\n-1 a b c\n-2 a b c\n-1 <s> a b\n\\1-grams:\n-1 c -1\n-3 a\n\\2-grams:\n-1 b c -0.5\n-2 <s> a\n\\end\\\n")
+	for _, arpa := range arpas {
+		builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := builder.DumpSorted()
+		ext, err := FromARPAExternal(strings.NewReader(arpa), ARPAOptions{}, ExternalOptions{ChunkBytes: 1000})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, model := range externalModels(ext, t) {
+			externalCheck(model, expected, t)
+		}
+		ext.Close()
+	}
+}
+
+func TestFromARPAExternalModes(t *testing.T) {
+	for _, i := range arpaModeTests(t) {
+		builder, err := FromARPAExternal(strings.NewReader(i.ARPA), ARPAOptions{Mode: i.Mode}, ExternalOptions{})
+		checkARPAError(i, err, t)
+		if err == nil {
+			builder.Close()
+		}
+	}
+}
+
+func TestExternalBuilderClose(t *testing.T) {
+	dir := t.TempDir()
+	builder, err := FromARPAExternal(strings.NewReader(syntheticARPA(20, 3, 50, 1)), ARPAOptions{}, ExternalOptions{TempDir: dir, ChunkBytes: 100})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	externalModels(builder, t)
+	if err := builder.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("expect no temporary files left; got %v", left)
+	}
+}
+
+func TestExternalEytzinger(t *testing.T) {
+	arpa := syntheticARPA(100, 3, 1000, 1)
+	builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := builder.DumpSorted()
+	ext, err := FromARPAExternal(strings.NewReader(arpa), ARPAOptions{}, ExternalOptions{TempDir: t.TempDir(), Eytzinger: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ext.Close()
+	var buf bytes.Buffer
+	if _, err := ext.WriteSortedTo(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var loaded Sorted
+	if err := loaded.ParseBinary(buf.Bytes()); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if !loaded.eytzinger {
+		t.Errorf("expect the Eytzinger layout")
+	}
+	if err := checkSorted(&loaded); err != nil {
+		t.Errorf("check sorted failed with error %v", err)
+	}
+	externalCheck(&loaded, expected, t)
+}
+
+func TestExternalRobinHood(t *testing.T) {
+	arpa := syntheticARPA(100, 3, 1000, 1)
+	builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	builder.SetRobinHood(true)
+	expected := builder.DumpHashed(0)
+	ext, err := FromARPAExternal(strings.NewReader(arpa), ARPAOptions{}, ExternalOptions{TempDir: t.TempDir(), RobinHood: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ext.Close()
+	var buf bytes.Buffer
+	if _, err := ext.WriteHashedTo(&buf, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var loaded Hashed
+	if err := loaded.ParseBinary(buf.Bytes()); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if !loaded.RobinHood() {
+		t.Errorf("expect Robin Hood tables")
+	}
+	externalCheck(&loaded, expected, t)
+}
+
+// externalModels writes the models of builder and loads them back.
+func externalModels(builder *ExternalBuilder, t *testing.T) []ContextModel {
+	dir := t.TempDir()
+	hashedPath, sortedPath := filepath.Join(dir, "hashed"), filepath.Join(dir, "sorted")
+	if err := builder.WriteHashed(hashedPath, 0); err != nil {
+		t.Fatalf("error in writing hashed binary: %v", err)
+	}
+	if err := builder.WriteSorted(sortedPath); err != nil {
+		t.Fatalf("error in writing sorted binary: %v", err)
+	}
+	var hashed Hashed
+	var sorted Sorted
+	for _, i := range []struct {
+		Path  string
+		Parse func([]byte) error
+	}{
+		{hashedPath, hashed.UnsafeParseBinary},
+		{sortedPath, sorted.UnsafeParseBinary},
+	} {
+		raw, err := os.ReadFile(i.Path)
+		if err != nil {
+			t.Fatalf("error in reading binary: %v", err)
+		}
+		if err := i.Parse(raw); err != nil {
+			t.Fatalf("error in loading binary: %v", err)
+		}
+	}
+	if err := checkSorted(&sorted); err != nil {
+		t.Errorf("check sorted failed with error %v", err)
+	}
+	return []ContextModel{&hashed, &sorted}
+}
+
+// externalCheck checks that m is a valid model with exactly the same
+// n-grams as expected.
+func externalCheck(m ContextModel, expected ContextModel, t *testing.T) {
+	if err := checkModel(m); err != nil {
+		t.Errorf("check model failed with error %v", err)
+	}
+	if err := checkContexts(m); err != nil {
+		t.Errorf("check contexts failed with error %v", err)
+	}
+	if m.NumStates() != expected.NumStates() {
+		t.Errorf("expect %d states; got %d", expected.NumStates(), m.NumStates())
+	}
+	if info := m.(binaryModel).Info(); !reflect.DeepEqual(info.Counts, countNgrams(expected)) || info.Order != len(info.Counts) {
+		t.Errorf("expect counts %v; got order %d and counts %v", countNgrams(expected), info.Order, info.Counts)
+	}
+	if a, b := arpaLines(m, t), arpaLines(expected, t); strings.Join(a, "\n") != strings.Join(b, "\n") {
+		t.Errorf("expect n-grams\n%s\ngot\n%s", strings.Join(b, "\n"), strings.Join(a, "\n"))
+	}
+}
+
+// arpaLines returns the sorted lines of m as an ARPA file.
+func arpaLines(m IterableModel, t *testing.T) []string {
+	var buf bytes.Buffer
+	if err := WriteARPA(m, &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	sort.Strings(lines)
+	return lines
+}
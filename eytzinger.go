@@ -0,0 +1,75 @@
+package fslm
+
+// The Eytzinger layout of the lexical transitions of a Sorted state.
+//
+// The transitions of a state of n lexical transitions are laid out as
+// an implicit binary search tree in breadth-first order: the root at 0
+// and the children of k at 2k+1 and 2k+2. A search thus walks from the
+// start of the array towards its end, and the first few levels of the
+// trees of the states that are searched often stay in the cache,
+// whereas a binary search over a sorted array jumps all over it.
+
+import (
+	"github.com/kho/word"
+)
+
+// eytzinger lays out sorted, which is sorted by word, in the Eytzinger
+// layout.
+func eytzinger(sorted []WordStateWeight) {
+	tree := make([]WordStateWeight, len(sorted))
+	for i, k := 0, eytzingerFirst(len(tree)); k < len(tree); i, k = i+1, eytzingerNext(k, len(tree)) {
+		tree[k] = sorted[i]
+	}
+	copy(sorted, tree)
+}
+
+// eytzingerFirst returns the position of the smallest word in a tree
+// of n transitions, which is n when the tree is empty.
+func eytzingerFirst(n int) int {
+	if n == 0 {
+		return n
+	}
+	k := 0
+	for 2*k+1 < n {
+		k = 2*k + 1
+	}
+	return k
+}
+
+// eytzingerNext returns the position of the word following that at k
+// in a tree of n transitions, which is n when k has the largest word.
+func eytzingerNext(k, n int) int {
+	if 2*k+2 < n {
+		// The smallest word of the right subtree.
+		k = 2*k + 2
+		for 2*k+1 < n {
+			k = 2*k + 1
+		}
+		return k
+	}
+	// Go up until coming from a left child.
+	for k > 0 && k%2 == 0 {
+		k = (k - 1) / 2
+	}
+	if k == 0 {
+		return n
+	}
+	return (k - 1) / 2
+}
+
+// eytzingerSearch returns the transition consuming x in tree, or nil
+// if there is none.
+func eytzingerSearch(tree []WordStateWeight, x word.Id) *WordStateWeight {
+	k := 0
+	for k < len(tree) {
+		xk := tree[k].Word
+		if xk == x {
+			return &tree[k]
+		}
+		k = 2*k + 1
+		if xk < x {
+			k++
+		}
+	}
+	return nil
+}
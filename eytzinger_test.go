@@ -0,0 +1,42 @@
+package fslm
+
+import (
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestEytzinger(t *testing.T) {
+	for n := 0; n < 40; n++ {
+		sorted := make([]WordStateWeight, n)
+		for i := range sorted {
+			sorted[i] = WordStateWeight{word.Id(2*i + 1), StateId(i), Weight(i)}
+		}
+		tree := append([]WordStateWeight(nil), sorted...)
+		eytzinger(tree)
+		// The in-order walk visits every transition in sorted order.
+		i := 0
+		for k := eytzingerFirst(n); k < n; k = eytzingerNext(k, n) {
+			if i >= n {
+				t.Fatalf("n=%d: walk visits more than %d transitions", n, n)
+			}
+			if tree[k] != sorted[i] {
+				t.Errorf("n=%d: expect %v at %d of the walk; got %v", n, sorted[i], i, tree[k])
+			}
+			i++
+		}
+		if i != n {
+			t.Errorf("n=%d: walk visits %d transitions", n, i)
+		}
+		// Odd words are found and even ones are not.
+		for x := word.Id(0); x <= word.Id(2*n+1); x++ {
+			xqw := eytzingerSearch(tree, x)
+			switch {
+			case x%2 == 1 && int(x) < 2*n && (xqw == nil || xqw.Word != x):
+				t.Errorf("n=%d: expect to find %d; got %v", n, x, xqw)
+			case (x%2 == 0 || int(x) >= 2*n) && xqw != nil:
+				t.Errorf("n=%d: expect not to find %d; got %v", n, x, xqw)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package fslm
+
+// Loading binary models of any registered format.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/kho/byteblock"
+)
+
+// LoadedModel is a model loaded from a binary by Open. The concrete
+// type is that of the format (e.g. *Hashed for MODEL_HASHED), so the
+// faster typed methods are available through a type assertion.
+type LoadedModel interface {
+	IterableModel
+	// Close releases the memory backing the model, after which the
+	// model should not be used.
+	io.Closer
+	// Kind returns the kind of the model, one of MODEL_* for the
+	// formats of this package.
+	Kind() int
+	// Info returns the information of the binary.
+	Info() ModelInfo
+}
+
+// OpenOptions specifies how Open loads a binary.
+type OpenOptions struct {
+	// Validate the model (see Hashed.Validate) before returning it,
+	// which is for binaries from untrusted sources.
+	Validate bool
+	// Read the binary into memory instead of mapping it, e.g. on file
+	// systems that do not support mmap.
+	NoMmap bool
+}
+
+// Format is a binary format that Open recognizes by the magic block
+// the binary starts with.
+type Format struct {
+	Magic string
+	Kind  int
+	// Load loads a model from raw, which then backs the model. backing,
+	// when not nil, should be closed by the model's Close.
+	Load func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error)
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   = map[string]Format{}
+)
+
+// RegisterFormat registers a binary format, usually in an init
+// function. A later registration replaces the format with the same
+// magic.
+func RegisterFormat(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	formats[f.Magic] = f
+}
+
+func init() {
+	RegisterFormat(Format{MAGIC_HASHED, MODEL_HASHED, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Hashed{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+	RegisterFormat(Format{MAGIC_SORTED, MODEL_SORTED, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Sorted{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+	RegisterFormat(Format{MAGIC_QUANTIZED, MODEL_QUANTIZED, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Quantized{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+	RegisterFormat(Format{MAGIC_TRIE, MODEL_TRIE, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Trie{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+	RegisterFormat(Format{MAGIC_PROBING, MODEL_PROBING, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Probing{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+	RegisterFormat(Format{MAGIC_HYBRID, MODEL_HYBRID, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		m := &Hybrid{backing: backing}
+		return m, parseModel(m, raw, opts)
+	}})
+}
+
+// parseModel loads one of the built-in models.
+func parseModel(m interface {
+	UnsafeParseBinary([]byte) error
+	ParseBinary([]byte) error
+}, raw []byte, opts OpenOptions) error {
+	if opts.Validate {
+		return m.ParseBinary(raw)
+	}
+	return m.UnsafeParseBinary(raw)
+}
+
+// formatOf finds the registered format of raw.
+func formatOf(raw []byte) (Format, error) {
+	magic, err := byteblock.NewByteBlockSlicer(raw).Slice()
+	if err == nil {
+		formatsMu.RLock()
+		f, ok := formats[string(magic)]
+		formatsMu.RUnlock()
+		if ok {
+			return f, nil
+		}
+	}
+	return Format{}, errors.New("not an FSLM file")
+}
+
+// loadBinary loads raw with its registered format. backing is closed
+// on errors.
+func loadBinary(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+	f, err := formatOf(raw)
+	if err == nil {
+		var m LoadedModel
+		if m, err = f.Load(raw, backing, opts); err == nil {
+			return m, nil
+		}
+	}
+	if backing != nil {
+		backing.Close()
+	}
+	return nil, err
+}
+
+// Open loads the binary model at path, which is mapped into memory
+// unless opts.NoMmap is set. The model should be closed after use.
+func Open(path string, opts OpenOptions) (LoadedModel, error) {
+	if opts.NoMmap {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := readAligned(f, stat.Size())
+		if err != nil {
+			return nil, fmt.Errorf("error in reading %s: %v", path, err)
+		}
+		return loadBinary(raw, nil, opts)
+	}
+	m, err := OpenMappedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadBinary(m.data, m, opts)
+}
@@ -0,0 +1,116 @@
+package fslm
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kho/byteblock"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	for i, dump := range dumps {
+		path := filepath.Join(dir, "lm")
+		if err := dump(readyBuilder(simpleTrigramLM)).WriteBinary(path); err != nil {
+			t.Fatalf("error in writing binary: %v", err)
+		}
+		for _, opts := range []OpenOptions{{}, {NoMmap: true}, {Validate: true}, {Validate: true, NoMmap: true}} {
+			model, err := Open(path, opts)
+			if err != nil {
+				t.Fatalf("%+v: error in loading binary: %v", opts, err)
+			}
+			switch m := model.(type) {
+			case *Hashed:
+				if i != 0 || m.Kind() != MODEL_HASHED {
+					t.Errorf("%+v: unexpected hashed model of kind %d", opts, m.Kind())
+				}
+			case *Sorted:
+				if i != 1 || m.Kind() != MODEL_SORTED {
+					t.Errorf("%+v: unexpected sorted model of kind %d", opts, m.Kind())
+				}
+			default:
+				t.Errorf("%+v: unexpected model %T", opts, model)
+			}
+			if model.Info().Version != BINARY_VERSION {
+				t.Errorf("%+v: unexpected info %+v", opts, model.Info())
+			}
+			sentTest(model, simpleTrigramSents, t)
+			if err := model.Close(); err != nil {
+				t.Errorf("%+v: error in closing model: %v", opts, err)
+			}
+			if err := model.Close(); err != nil {
+				t.Errorf("%+v: error in closing model twice: %v", opts, err)
+			}
+		}
+	}
+	// Not a model.
+	path := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(path, []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, OpenOptions{}); err == nil {
+		t.Errorf("expect error on garbage")
+	}
+	if _, err := Open(filepath.Join(dir, "missing"), OpenOptions{}); err == nil {
+		t.Errorf("expect error on missing file")
+	}
+}
+
+// testFormatModel is a model of a registered test format.
+type testFormatModel struct {
+	*Sorted
+	closed *bool
+}
+
+func (m testFormatModel) Kind() int { return 100 }
+
+func (m testFormatModel) Close() error {
+	*m.closed = true
+	return nil
+}
+
+func TestRegisterFormat(t *testing.T) {
+	const magic = "#fslm.test"
+	// The test format only has the magic block and always gives the
+	// same model.
+	var sorted Sorted
+	if err := sorted.UnsafeParseBinary(binaryBytes(readyBuilder(simpleTrigramLM).DumpSorted(), t)); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	var closed bool
+	RegisterFormat(Format{magic, 100, func(raw []byte, backing io.Closer, opts OpenOptions) (LoadedModel, error) {
+		if backing != nil {
+			backing.Close()
+		}
+		return testFormatModel{&sorted, &closed}, nil
+	}})
+	defer func() {
+		formatsMu.Lock()
+		delete(formats, magic)
+		formatsMu.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	if err := byteblock.NewByteBlockWriter(&buf).WriteString(magic, 0); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "lm")
+	if err := os.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	model, err := Open(path, OpenOptions{})
+	if err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if model.Kind() != 100 {
+		t.Errorf("expect kind 100; got %d", model.Kind())
+	}
+	sentTest(model, simpleTrigramSents, t)
+	model.Close()
+	if !closed {
+		t.Errorf("expect model to be closed")
+	}
+}
@@ -3,7 +3,11 @@ package fslm
 // Common routines for testing a language model.
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -44,6 +48,14 @@ var simpleTrigramSents = [][]token{
 	{{"a", -1}, {"b", -1.5}, {"c", WEIGHT_LOG0}, {"</s>", -0.01}},
 }
 
+var simpleTrigramFragments = [][]token{
+	{{"a", -2}, {"b", -2}, {"</s>", -0.001}},
+	{{"b", -4}, {"a", -2 - 2}},
+	{{"a", -2}, {"a", -1 - 2}},
+	{{"</s>", -0.01}},
+	{},
+}
+
 var sparseFivegramLM = []ngram{
 	{"", "<s>", WEIGHT_LOG0, -1},
 	{"", "</s>", 0.1, 0},
@@ -91,24 +103,110 @@ var trickyBackOffSents = [][]token{
 	{{"a", -1}, {"b", 0}, {"c", 0}, {"e", -4}, {"</s>", 1 + 0.1}},
 }
 
+type prob struct {
+	Context, Word string
+	Weight        Weight
+	Order         int
+}
+
+var simpleTrigramProbs = []prob{
+	{"<s> a", "b", -1.5, 3},
+	{"a b", "</s>", -0.001, 3},
+	{"a", "b", -2, 2},
+	{"<s>", "a", -1, 2},
+	// "b" is never extended, so its back-off weight is folded into "b"
+	// by NextI but still counted here.
+	{"b", "a", -2 - 2, 1},
+	{"a b", "a", -1 - 2 - 2, 1},
+	{"<s> a", "a", -0.5 - 1 - 2, 1},
+	{"", "</s>", -0.01, 1},
+	{"c a", "b", -2, 2},
+	{"b a b", "</s>", -0.001, 3},
+	{"a", "c", WEIGHT_LOG0, 0},
+}
+
 const floatTol = 1e-7
 
+// syntheticARPA generates a random but valid ARPA file of the given
+// order over numWords words (besides <s> and </s>) with up to
+// numNgrams n-grams of each order above 1. Every n-gram has its prefix
+// in the file.
+func syntheticARPA(numWords, order, numNgrams int, seed int64) string {
+	r := rand.New(rand.NewSource(seed))
+	words := []string{"<s>", "</s>"}
+	for i := 0; i < numWords; i++ {
+		words = append(words, fmt.Sprintf("w%d", i))
+	}
+	ngrams := make([][]string, order)
+	for _, x := range words {
+		ngrams[0] = append(ngrams[0], x)
+	}
+	for n := 1; n < order; n++ {
+		seen := map[string]bool{}
+		for i := 0; i < 2*numNgrams && len(ngrams[n]) < numNgrams; i++ {
+			context := ngrams[n-1][r.Intn(len(ngrams[n-1]))]
+			if strings.HasSuffix(context, "</s>") {
+				continue
+			}
+			ngram := context + " " + words[1+r.Intn(len(words)-1)]
+			if !seen[ngram] {
+				seen[ngram] = true
+				ngrams[n] = append(ngrams[n], ngram)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("\\data\\\n")
+	for n, i := range ngrams {
+		fmt.Fprintf(&buf, "ngram %d=%d\n", n+1, len(i))
+	}
+	for n, i := range ngrams {
+		fmt.Fprintf(&buf, "\n\\%d-grams:\n", n+1)
+		for _, ngram := range i {
+			p := -r.Float64() * 5
+			if ngram == "<s>" {
+				p = -99
+			}
+			fmt.Fprintf(&buf, "%.4f\t%s", p, ngram)
+			if n+1 < order && !strings.HasSuffix(ngram, "</s>") {
+				fmt.Fprintf(&buf, "\t%.4f", -r.Float64())
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	buf.WriteString("\n\\end\\\n")
+	return buf.String()
+}
+
 func readyBuilder(lm []ngram) *Builder {
-	builder := NewBuilder(nil, "", "")
+	builder, err := NewBuilder(nil, "", "")
+	if err != nil {
+		panic(err)
+	}
 	for _, i := range lm {
 		c, x, w, b := i.Params()
-		builder.AddNgram(c, x, w, b)
+		if err := builder.AddNgram(c, x, w, b); err != nil {
+			panic(err)
+		}
 	}
 	return builder
 }
 
 func sentTest(model Model, sents [][]token, t *testing.T) {
+	scoreTest(model, model.Start(), sents, t)
+}
+
+func fragmentTest(model Model, fragments [][]token, t *testing.T) {
+	scoreTest(model, model.StartEmpty(), fragments, t)
+}
+
+func scoreTest(model Model, start StateId, sents [][]token, t *testing.T) {
 	for _, i := range sents {
 		var (
 			w0, w1 Weight
 			ws     []Weight
 		)
-		p := model.Start()
+		p := start
 		for _, x := range i {
 			var w Weight
 			if x.Word != "</s>" {
@@ -126,6 +224,19 @@ func sentTest(model Model, sents [][]token, t *testing.T) {
 	}
 }
 
+type probModel interface {
+	ProbS(context []string, x string) (Weight, int)
+}
+
+func probTest(model probModel, probs []prob, t *testing.T) {
+	for _, i := range probs {
+		w, order := model.ProbS(strings.Fields(i.Context), i.Word)
+		if i.Weight-w >= floatTol || w-i.Weight >= floatTol || order != i.Order {
+			t.Errorf("%q after %q: expected weight %g and order %d; got %g and %d", i.Word, i.Context, i.Weight, i.Order, w, order)
+		}
+	}
+}
+
 func checkModel(m IterableModel) error {
 	// All states should be reachable from _STATE_START.
 	uf := newUnionFind(m.NumStates())
@@ -170,6 +281,9 @@ func checkModel(m IterableModel) error {
 		for _ = range m.Transitions(p) {
 			n++
 		}
+		if n != m.NumTransitions(p) {
+			return fmt.Errorf("state %d has %d transitions but NumTransitions gives %d", p, n, m.NumTransitions(p))
+		}
 		if n > 0 {
 			internal[p] = true
 		}
@@ -187,6 +301,35 @@ func checkModel(m IterableModel) error {
 	return nil
 }
 
+func checkContexts(m ContextModel) error {
+	// Following the context from the empty state leads to the state
+	// itself.
+	for i := 0; i < m.NumStates(); i++ {
+		p := StateId(i)
+		context := m.StateContext(p)
+		if len(context) != m.StateOrder(p) {
+			return fmt.Errorf("state %d has context %v but order %d", p, context, m.StateOrder(p))
+		}
+		q := _STATE_EMPTY
+		for _, x := range context {
+			q, _ = m.NextI(q, x)
+		}
+		if q != p {
+			return fmt.Errorf("context %v of state %d leads to state %d", context, p, q)
+		}
+	}
+	// The stored contexts are the same as those recovered from the
+	// transitions.
+	links := findStateLinks(m)
+	for i := 0; i < m.NumStates(); i++ {
+		p := StateId(i)
+		if !reflect.DeepEqual(links.Context(p), m.StateContext(p)) {
+			return fmt.Errorf("state %d has context %v but %v is recovered", p, m.StateContext(p), links.Context(p))
+		}
+	}
+	return nil
+}
+
 type unionFind []int
 
 func newUnionFind(n int) unionFind {
@@ -1,12 +1,9 @@
 package fslm
 
 import (
-	"bytes"
-	"encoding/gob"
-	"errors"
-	"os"
-	"reflect"
-	"unsafe"
+	"fmt"
+	"io"
+	"iter"
 
 	"github.com/kho/byteblock"
 	"github.com/kho/word"
@@ -16,14 +13,17 @@ import (
 // using hash tables. A Hashed model is usually loaded from file or
 // constructed with a Builder.
 type Hashed struct {
-	// The vocabulary of the model. Don't modify this. If you need to
-	// have a vocab based on this, make a copy using Vocab.Copy().
-	vocab *word.Vocab
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from a builder or an old binary.
+	vocab *modelVocab
 	// Sentence boundary symbols.
 	bos, eos     string
 	bosId, eosId word.Id
-	// Buckets per state for out-going lexical transitions.
-	// There are three kinds of transitions:
+	// Buckets of all the states one after another for out-going
+	// lexical transitions; those of p are the hash table from
+	// offsets[p] to offsets[p+1] (see buckets). Both are backed by the
+	// binary when loaded from one. There are three kinds of
+	// transitions:
 	//
 	// (1) A lexical transition that consumes an actual word (i.e. any
 	// valid word other than <s> or </s>). This leads to a valid state
@@ -37,35 +37,141 @@ type Hashed struct {
 	// (3) Buckets with invalid keys (word.NIL) are all filled with
 	// back-off transitions so that we know the back-off transition
 	// immediately when the key cannot be found.
-	transitions []xqwBuckets
+	//
+	// With robinHood, the hash tables are Robin Hood tables instead,
+	// each after an entry of the back-off (see robinhood.go).
+	entries   []xqwEntry
+	offsets   []uint64
+	robinHood bool
+	// The transitions of _STATE_EMPTY and optionally _STATE_START as
+	// dense arrays, which NextI uses instead of their hash tables.
+	dense denseStates
+	// The context of each state.
+	links stateLinks
+	// The source weights of the n-grams whose weights are folded,
+	// sorted by context and then by word (see foldedNgrams).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+// buckets returns the hash table of p.
+func (m *Hashed) buckets(p StateId) xqwBuckets {
+	lo := m.offsets[p]
+	if m.robinHood {
+		lo++
+	}
+	return xqwBuckets(m.entries[lo:m.offsets[p+1]])
+}
+
+// findEntry returns the entry of the transition consuming x from p, or
+// one with word.NIL that holds the back-off of p.
+func (m *Hashed) findEntry(p StateId, x word.Id) *xqwEntry {
+	lo, hi := m.offsets[p], m.offsets[p+1]
+	if !m.robinHood {
+		return xqwBuckets(m.entries[lo:hi]).FindEntry(x)
+	}
+	return m.search(lo, hi, m.firstBucket(lo, hi, x), x)
+}
+
+// firstBucket returns the position of the first bucket a search for x
+// probes among the entries from lo to hi, those of a state.
+func (m *Hashed) firstBucket(lo, hi uint64, x word.Id) uint64 {
+	if !m.robinHood {
+		return lo + uint64(xqwBuckets(m.entries[lo:hi]).start(x))
+	}
+	return lo + 1 + uint64(robinHoodStart(x, int(hi-lo-1)))
+}
+
+// search is findEntry over the entries from lo to hi, those of a state,
+// probing from k as given by firstBucket.
+func (m *Hashed) search(lo, hi, k uint64, x word.Id) *xqwEntry {
+	if !m.robinHood {
+		for {
+			e := &m.entries[k]
+			if e.Key == x || e.Key == word.NIL {
+				return e
+			}
+			if k++; k == hi {
+				k = lo
+			}
+		}
+	}
+	if e, _ := robinHoodSearch(xqwBuckets(m.entries[lo+1:hi]), x, int(k-lo-1)); e != nil {
+		return e
+	}
+	return &m.entries[lo]
 }
 
 func (m *Hashed) Start() StateId {
 	return _STATE_START
 }
 
+func (m *Hashed) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
 func (m *Hashed) NextI(p StateId, i word.Id) (q StateId, w Weight) {
+	if p == _STATE_START && m.dense.start != nil {
+		return m.dense.start.next(i)
+	}
 	// Try backing off until we find the n-gram or hit empty state.
-	next := m.transitions[p].FindEntry(i)
-	for next.Key == word.NIL && p != _STATE_EMPTY {
+	for p != _STATE_EMPTY {
+		next := m.findEntry(p, i)
+		if next.Key != word.NIL {
+			return next.Value.State, w + next.Value.Weight
+		}
 		p = next.Value.State
 		w += next.Value.Weight
-		next = m.transitions[p].FindEntry(i)
 	}
-	if next.Key != word.NIL {
-		q = next.Value.State
-		w += next.Value.Weight
-	} else {
-		q = _STATE_EMPTY
-		w = WEIGHT_LOG0
+	if m.dense.empty != nil {
+		q, dw := m.dense.empty.next(i)
+		return q, w + dw
 	}
-	return
+	if next := m.findEntry(p, i); next.Key != word.NIL {
+		return next.Value.State, w + next.Value.Weight
+	}
+	return _STATE_EMPTY, WEIGHT_LOG0
 }
 
 func (m *Hashed) NextS(p StateId, s string) (q StateId, w Weight) {
 	return m.NextI(p, m.vocab.IdOf(s))
 }
 
+// Prob returns the weight of x following context and the order of the
+// matching n-gram (0 when x is an OOV) as SRILM computes them from the
+// source ARPA file: the weight of the longest n-gram ending in x whose
+// context is a suffix of context, plus the back-off weights of the
+// longer suffixes of context. context should not contain </s> and may
+// only have <s> as its first word. Unlike NextI, the back-off weight of
+// an n-gram that is never extended is not included in the weight of
+// that n-gram, but summing Prob over a sentence with full histories
+// still gives the sentence score.
+func (m *Hashed) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Hashed) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical returns the lexical transition of p consuming x without
+// backing off. At _STATE_EMPTY it looks up the dense array first, as
+// the sparse transitions only have what the array cannot tell from a
+// missing word (see denseMissing).
+func (m *Hashed) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	if p == _STATE_EMPTY {
+		if q, w, ok := m.dense.emptyLexical(x); ok {
+			return q, w, true
+		}
+	}
+	next := m.findEntry(p, x)
+	return next.Value.State, next.Value.Weight, next.Key != word.NIL
+}
+
 func (m *Hashed) Final(p StateId) Weight {
 	_, w := m.NextI(p, m.eosId)
 	return w
@@ -75,121 +181,211 @@ func (m *Hashed) BackOff(p StateId) (StateId, Weight) {
 	if p == _STATE_EMPTY {
 		return STATE_NIL, 0
 	}
-	backoff := m.transitions[p].FindEntry(word.NIL).Value
+	backoff := m.findEntry(p, word.NIL).Value
 	return backoff.State, backoff.Weight
 }
 
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf,
+// or VocabOf, to avoid that.
 func (m *Hashed) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
-	return m.vocab, m.bos, m.eos, m.bosId, m.eosId
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
 }
 
-func (m *Hashed) NumStates() int {
-	return len(m.transitions)
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Hashed) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
 }
 
-func (m *Hashed) Transitions(p StateId) chan WordStateWeight {
-	ch := make(chan WordStateWeight)
-	go func() {
-		for i := range m.transitions[p].Range() {
-			ch <- WordStateWeight{i.Key, i.Value.State, i.Value.Weight}
-		}
-		close(ch)
-	}()
-	return ch
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Hashed) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
 }
 
-func (m *Hashed) header() (header []byte, err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err = enc.Encode(m.vocab); err != nil {
-		return
-	}
-	if err = enc.Encode(m.bos); err != nil {
-		return
-	}
-	if err = enc.Encode(m.eos); err != nil {
-		return
-	}
-	numBuckets := make([]int, len(m.transitions))
-	for i, t := range m.transitions {
-		numBuckets[i] = len(t)
-	}
-	if err = enc.Encode(numBuckets); err != nil {
-		return
+func (m *Hashed) NumStates() int {
+	return len(m.offsets) - 1
+}
+
+// Transitions gives the transitions of p, which are sorted by word
+// when p is _STATE_EMPTY with a dense array.
+func (m *Hashed) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.transitions(m.sparseTransitions(p))
 	}
-	header = buf.Bytes()
-	return
+	return m.sparseTransitions(p)
 }
 
-func (m *Hashed) parseHeader(header []byte) (numBuckets []int, err error) {
-	dec := gob.NewDecoder(bytes.NewReader(header))
-	if err = dec.Decode(&m.vocab); err != nil {
-		return
+// sparseTransitions gives the transitions in the hash table of p.
+func (m *Hashed) sparseTransitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		for i := range m.buckets(p).Range() {
+			if !yield(WordStateWeight{i.Key, i.Value.State, i.Value.Weight}) {
+				return
+			}
+		}
 	}
-	if err = dec.Decode(&m.bos); err != nil {
-		return
+}
+
+// NumTransitions has to scan through the buckets of p and thus takes
+// time linear to the number of buckets, or to the size of the dense
+// array for _STATE_EMPTY.
+func (m *Hashed) NumTransitions(p StateId) int {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.numTransitions(m.sparseTransitions(p))
 	}
-	if err = dec.Decode(&m.eos); err != nil {
-		return
+	return m.buckets(p).Size()
+}
+
+// RobinHood tells whether m uses Robin Hood hashing (see
+// Builder.SetRobinHood).
+func (m *Hashed) RobinHood() bool {
+	return m.robinHood
+}
+
+// ProbeStats are the histograms of the number of buckets the look-ups
+// of a Hashed model probe, from which to choose the scale of its hash
+// tables (see Builder.DumpHashed).
+type ProbeStats struct {
+	// Hits[n] is the number of transitions that a look-up finds after
+	// probing n buckets.
+	Hits []int
+	// Misses[n] is the number of buckets from which a look-up of a
+	// word without a transition probes n buckets before giving up,
+	// i.e. the histogram of misses when words hash uniformly.
+	Misses []int
+}
+
+// ProbeStats returns the probe statistics of the hash tables of m,
+// which leave out the dense states. It takes a scan over the whole
+// model.
+func (m *Hashed) ProbeStats() ProbeStats {
+	var s ProbeStats
+	for p := 0; p < m.NumStates(); p++ {
+		buckets := m.buckets(StateId(p))
+		n := len(buckets)
+		free := -1
+		for i, e := range buckets {
+			if e.Key == word.NIL {
+				free = i
+				continue
+			}
+			if m.robinHood {
+				s.Hits = addProbes(s.Hits, robinHoodDistance(e.Key, i, n)+1)
+			} else {
+				s.Hits = addProbes(s.Hits, (i-buckets.start(e.Key)+n)%n+1)
+			}
+		}
+		if m.robinHood {
+			for i := range buckets {
+				_, probes := robinHoodSearch(buckets, word.NIL, i)
+				s.Misses = addProbes(s.Misses, probes)
+			}
+		} else if free >= 0 {
+			// A miss from bucket i probes up to the next free bucket,
+			// so count them backwards from one.
+			run := 0
+			for j := 0; j < n; j++ {
+				if i := (free - j + n) % n; buckets[i].Key == word.NIL {
+					run = 0
+				} else {
+					run++
+				}
+				s.Misses = addProbes(s.Misses, run+1)
+			}
+		}
 	}
-	if m.bosId = m.vocab.IdOf(m.bos); m.bosId == word.NIL {
-		err = errors.New(m.bos + " not in vocabulary")
-		return
+	return s
+}
+
+// addProbes counts a look-up of the given number of probes in h.
+func addProbes(h []int, probes int) []int {
+	for len(h) <= probes {
+		h = append(h, 0)
 	}
-	if m.eosId = m.vocab.IdOf(m.eos); m.eosId == word.NIL {
-		err = errors.New(m.eos + " not in vocabulary")
-		return
+	h[probes]++
+	return h
+}
+
+func (m *Hashed) StateContext(p StateId) []word.Id {
+	return m.links.Context(p)
+}
+
+func (m *Hashed) StateOrder(p StateId) int {
+	return m.links.Order(p)
+}
+
+// foldedNgrams returns the source weights of the n-grams whose
+// weights m folds back-off weights into, from which WriteARPA recovers
+// the source ARPA file.
+func (m *Hashed) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+func (m *Hashed) header() (header, vocab []byte, err error) {
+	maxId := m.dense.maxId()
+	for _, e := range m.entries {
+		maxId = maxWordId(maxId, e.Key)
 	}
-	if err = dec.Decode(&numBuckets); err != nil {
+	if header, err = encodeHeader(m.bos, m.eos, nil, m.NumStates(), m.dense.header(), m.robinHood); err != nil {
 		return
 	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
 	return
 }
 
-func (m *Hashed) WriteBinary(path string) (err error) {
-	w, err := os.Create(path)
-	if err != nil {
-		return
-	}
-	defer w.Close()
-	bw := byteblock.NewByteBlockWriter(w)
-	if err = bw.WriteString(MAGIC_HASHED, 0); err != nil {
-		return
-	}
-	// Header
-	header, err := m.header()
-	if err != nil {
-		return
-	}
-	if err = bw.Write(header, 0); err != nil {
-		return
-	}
-	// Raw entries.
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Hashed) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
 
-	// Go over the transitions to see how many entries there are in total.
-	numEntries := int64(0)
-	for _, i := range m.transitions {
-		numEntries += int64(len(i))
-	}
-	// Ask for a large new block and then incrementally write out the
-	// data.
-	align := int64(unsafe.Alignof(xqwEntry{}))
-	size := int64(unsafe.Sizeof(xqwEntry{}))
-	if err = bw.NewBlock(align, size*numEntries); err != nil {
-		return
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself).
+func (m *Hashed) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
 	}
-	for _, i := range m.transitions {
-		iHeader := (*reflect.SliceHeader)(unsafe.Pointer(&i))
-		var bytes []byte
-		bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
-		bytesHeader.Data = iHeader.Data
-		bytesHeader.Len = int(int64(iHeader.Len) * size)
-		bytesHeader.Cap = bytesHeader.Len
-		if err = bw.Append(bytes); err != nil {
-			return
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	entryBytes := int64(_OFFSET_SIZE*len(m.offsets)+_ENTRY_SIZE*len(m.entries)) + m.dense.numBytes()
+	return writeBinary(w, MAGIC_HASHED, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(offsetBytes(m.offsets)); err != nil {
+			return err
+		}
+		if err := w.Append(bucketBytes(m.entries)); err != nil {
+			return err
 		}
+		return m.dense.write(w)
+	}, m.links, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m comes from a builder.
+func (m *Hashed) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_HASHED.
+func (m *Hashed) Kind() int {
+	return MODEL_HASHED
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Hashed) Close() error {
+	if m.backing == nil {
+		return nil
 	}
-	return nil
+	err := m.backing.Close()
+	m.backing = nil
+	return err
 }
 
 func IsHashedBinary(raw []byte) bool {
@@ -198,42 +394,97 @@ func IsHashedBinary(raw []byte) bool {
 	return err == nil && string(magic) == MAGIC_HASHED
 }
 
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources. Since version 2, it takes constant time and
+// allocates nothing per state on little-endian hosts.
 func (m *Hashed) UnsafeParseBinary(raw []byte) error {
-	bs := byteblock.NewByteBlockSlicer(raw)
-
-	magic, err := bs.Slice()
+	blocks, err := sliceBinary(raw, MAGIC_HASHED)
 	if err != nil {
 		return err
 	}
-	if string(magic) != MAGIC_HASHED {
-		return errors.New("not a FSLM binary file")
-	}
+	m.info = blocks.info
 
-	header, err := bs.Slice()
+	// Binaries of version 1 always use linear probing.
+	m.robinHood = false
+	h, offsets, dense, err := blocks.parseEntries(0, func(raw []byte) int {
+		m.entries = parseBuckets(raw, blocks.info.Layout)
+		return len(m.entries)
+	}, &m.robinHood)
 	if err != nil {
 		return err
 	}
+	m.offsets, m.dense = offsets, dense
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+	if m.links, err = blocks.parseLinks(m, m.offsets, 0); err != nil {
+		return err
+	}
+	// Binaries written before folded n-grams were stored do not have
+	// them, in which case WriteARPA writes the weights as folded.
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
 
-	numBuckets, err := m.parseHeader(header)
-	if err != nil {
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Hashed) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
 		return err
 	}
+	return m.Validate()
+}
 
-	entryBytes, err := bs.Slice()
-	if err != nil {
+// Validate checks that m is safe to use: every state has a hash table
+// with a free bucket, which also holds the back-off unless it is a
+// Robin Hood table (whose words must then be in order), every
+// transition (including those of the dense states) consumes a word in
+// the vocabulary and leads to an existing state and the back-offs and
+// state links are free of cycles. It takes time linear to the size of
+// m.
+func (m *Hashed) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	if err := validateOffsets(m.offsets, 0); err != nil {
 		return err
 	}
-	var entrySlice []xqwEntry
-	entryBytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&entryBytes))
-	entrySliceHeader := (*reflect.SliceHeader)(unsafe.Pointer(&entrySlice))
-	entrySliceHeader.Data = entryBytesHeader.Data
-	entrySliceHeader.Len = entryBytesHeader.Len / int(unsafe.Sizeof(xqwEntry{}))
-	entrySliceHeader.Cap = entrySliceHeader.Len
-	m.transitions = make([]xqwBuckets, len(numBuckets))
-	low := 0
-	for i, n := range numBuckets {
-		m.transitions[i] = xqwBuckets(entrySlice[low : low+n])
-		low += n
+	numStates := m.NumStates()
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		if m.robinHood {
+			// The back-off and a table with a free bucket.
+			if m.offsets[p+1]-m.offsets[p] < 2 {
+				return fmt.Errorf("bad binary: state %d has no Robin Hood table", p)
+			}
+			if m.entries[m.offsets[p]].Key != word.NIL {
+				return fmt.Errorf("bad binary: state %d has no back-off", p)
+			}
+		}
+		buckets := m.buckets(p)
+		free := false
+		for j := range buckets {
+			e := &buckets[j]
+			if e.Key == word.NIL {
+				free = true
+				continue
+			}
+			if err := validateTransition(p, WordStateWeight{e.Key, e.Value.State, e.Value.Weight}, numStates, m.vocab.bound(), m.eosId); err != nil {
+				return err
+			}
+			if m.robinHood && !robinHoodInOrder(buckets, j) {
+				return fmt.Errorf("bad binary: Robin Hood table of state %d is out of order at %d", p, j)
+			}
+		}
+		if !free {
+			return fmt.Errorf("bad binary: hash table of state %d has no free bucket", p)
+		}
 	}
-	return nil
+	if err := m.dense.validate(numStates, m.vocab.bound(), m.eosId); err != nil {
+		return err
+	}
+	return validateStates(numStates, func(p StateId) StateId {
+		return m.findEntry(p, word.NIL).Value.State
+	}, m.links, m.vocab.bound())
 }
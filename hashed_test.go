@@ -2,6 +2,7 @@ package fslm
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -21,21 +22,91 @@ func TestHashedTrickyBackOff(t *testing.T) {
 	hashedTest(trickyBackOffLM, trickyBackOffSents, t)
 }
 
+func TestHashedFragment(t *testing.T) {
+	fragmentTest(readyBuilder(simpleTrigramLM).DumpHashed(0), simpleTrigramFragments, t)
+}
+
+func TestHashedProb(t *testing.T) {
+	probTest(readyBuilder(simpleTrigramLM).DumpHashed(0), simpleTrigramProbs, t)
+}
+
 func hashedTest(lm []ngram, sents [][]token, t *testing.T) {
-	builder := readyBuilder(lm)
+	for _, robinHood := range []bool{false, true} {
+		builder := readyBuilder(lm)
+		builder.SetRobinHood(robinHood)
+
+		var buf bytes.Buffer
+		buf.WriteString("builder LM:\n")
+		builder.Graphviz(&buf)
+		model := builder.DumpHashed(0)
 
-	var buf bytes.Buffer
-	buf.WriteString("builder LM:\n")
-	builder.Graphviz(&buf)
-	model := builder.DumpHashed(0)
+		buf.WriteString("model LM:\n")
+		Graphviz(model, &buf)
+		t.Log(buf.String())
 
-	buf.WriteString("model LM:\n")
-	Graphviz(model, &buf)
-	t.Log(buf.String())
+		var loaded Hashed
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("robinHood=%v: error in loading binary: %v", robinHood, err)
+		}
+		if loaded.RobinHood() != robinHood {
+			t.Errorf("robinHood=%v: loaded model has robinHood=%v", robinHood, loaded.RobinHood())
+		}
 
-	if err := checkModel(model); err != nil {
-		t.Errorf("check model failed with error %v", err)
+		for _, m := range []*Hashed{model, &loaded} {
+			if err := checkModel(m); err != nil {
+				t.Errorf("robinHood=%v: check model failed with error %v", robinHood, err)
+			}
+
+			if err := checkContexts(m); err != nil {
+				t.Errorf("robinHood=%v: check contexts failed with error %v", robinHood, err)
+			}
+
+			sentTest(m, sents, t)
+		}
 	}
+}
 
-	sentTest(model, sents, t)
+func TestHashedProbeStats(t *testing.T) {
+	arpa := syntheticARPA(300, 3, 3000, 1)
+	for _, robinHood := range []bool{false, true} {
+		for _, scale := range []float64{1.01, 1.5, 3} {
+			builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			builder.SetRobinHood(robinHood)
+			m := builder.DumpHashed(scale)
+			if err := m.Validate(); err != nil {
+				t.Errorf("robinHood=%v scale=%g: unexpected error: %v", robinHood, scale, err)
+			}
+			s := m.ProbeStats()
+			numHits, numMisses, maxHit := 0, 0, 0
+			for n, c := range s.Hits {
+				numHits += c
+				if c > 0 {
+					maxHit = n
+				}
+			}
+			for _, c := range s.Misses {
+				numMisses += c
+			}
+			// Only the transitions in the hash tables, not those of the
+			// dense empty state.
+			numTransitions, numBuckets := 0, 0
+			for p := 0; p < m.NumStates(); p++ {
+				numTransitions += m.buckets(StateId(p)).Size()
+				numBuckets += len(m.buckets(StateId(p)))
+			}
+			if numHits != numTransitions || numMisses != numBuckets {
+				t.Errorf("robinHood=%v scale=%g: expect %d hits and %d misses; got %d and %d", robinHood, scale, numTransitions, numBuckets, numHits, numMisses)
+			}
+			if s.Hits[0] != 0 || s.Misses[0] != 0 {
+				t.Errorf("robinHood=%v scale=%g: expect no look-up without probes", robinHood, scale)
+			}
+			// A miss ends once past the furthest word.
+			if robinHood && len(s.Misses)-1 > maxHit+1 {
+				t.Errorf("robinHood=%v scale=%g: expect at most %d probes per miss; got %d", robinHood, scale, maxHit+1, len(s.Misses)-1)
+			}
+		}
+	}
 }
@@ -0,0 +1,514 @@
+package fslm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"sort"
+
+	"github.com/kho/word"
+)
+
+// Hybrid is a finite-state representation of a n-gram language model
+// that lays out each state according to its number of lexical
+// transitions: a handful are scanned linearly, more are binary
+// searched like Sorted and the largest are hash tables like Hashed.
+// Most states only have a few transitions and thus avoid both the
+// load-factor slack of Hashed and the search steps of Sorted, while
+// the few states with a huge fan-out still take a single probe. Like
+// Hashed and Sorted, the empty state and optionally the start state
+// are also dense arrays. A Hybrid model is usually made with NewHybrid
+// or Builder.DumpHybrid, or loaded from file.
+type Hybrid struct {
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from the source model.
+	vocab *modelVocab
+	// Sentence boundary symbols.
+	bos, eos     string
+	bosId, eosId word.Id
+	// Entries of all the states one after another, those of p being
+	// from offsets[p] to offsets[p+1] (see next). Those of a state are
+	// its lexical transitions laid out as tags[p] says, followed by its
+	// back-off with word.NIL as the key.
+	entries []xqwEntry
+	offsets []uint64
+	tags    []byte
+	// See Hashed.
+	dense denseStates
+	// The context of each state.
+	links stateLinks
+	// The source weights of the n-grams whose weights are folded (see
+	// Hashed.folded).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+// Layouts of the lexical transitions of a state of Hybrid.
+const (
+	// Sorted by word and scanned from the start.
+	hybridLinear = iota
+	// Sorted by word and binary searched.
+	hybridSorted
+	// A hash table (see xqwBuckets) with at least one free bucket.
+	hybridHashed
+	numHybridLayouts
+)
+
+// HybridOptions specifies how NewHybrid lays out the states.
+type HybridOptions struct {
+	// States with at most MaxLinear lexical transitions are scanned
+	// linearly; <= 0 means 8.
+	MaxLinear int
+	// States with more than MaxLinear but at most MaxSorted lexical
+	// transitions are binary searched and those with more are hash
+	// tables; <= 0 means 64.
+	MaxSorted int
+	// The scale of the hash tables; see Builder.DumpHashed.
+	Scale float64
+	// Whether the start state is also a dense array; see
+	// Builder.SetDenseStart.
+	DenseStart bool
+}
+
+// NewHybrid makes a Hybrid model of m laid out as opts says.
+func NewHybrid(m ContextModel, opts HybridOptions) *Hybrid {
+	if opts.MaxLinear <= 0 {
+		opts.MaxLinear = 8
+	}
+	if opts.MaxSorted <= 0 {
+		opts.MaxSorted = 64
+	}
+	if opts.Scale <= 1 {
+		opts.Scale = 1.5
+	}
+	numStates := m.NumStates()
+	h := &Hybrid{}
+	var vocab *word.Vocab
+	vocab, h.bos, h.eos, h.bosId, h.eosId = m.Vocab()
+	h.vocab = &modelVocab{vocab: vocab}
+	if i, ok := m.(interface{ Info() ModelInfo }); ok {
+		h.info = i.Info()
+	}
+	if f, ok := m.(interface{ foldedNgrams() []arpaEntry }); ok {
+		// m may be backed by a binary closed after conversion.
+		h.folded = slices.Clone(f.foldedNgrams())
+	}
+	// _STATE_EMPTY only keeps sparse what its dense array cannot tell
+	// from missing words (see denseMissing).
+	empty := slices.Collect(m.Transitions(_STATE_EMPTY))
+	sparseEmpty := missingTransitions(empty)
+	h.tags = make([]byte, numStates)
+	h.offsets = make([]uint64, numStates+1)
+	for i := range h.tags {
+		n := m.NumTransitions(StateId(i))
+		if i == int(_STATE_EMPTY) {
+			n = len(sparseEmpty)
+		}
+		size := n
+		switch {
+		case n <= opts.MaxLinear:
+			h.tags[i] = hybridLinear
+		case n <= opts.MaxSorted:
+			h.tags[i] = hybridSorted
+		default:
+			h.tags[i] = hybridHashed
+			size = hashedSize(n, opts.Scale)
+		}
+		h.offsets[i+1] = h.offsets[i] + uint64(size) + 1
+	}
+	h.entries = make([]xqwEntry, h.offsets[numStates])
+	var next []WordStateWeight
+	for i, tag := range h.tags {
+		p := StateId(i)
+		entries := h.next(p)
+		if p == _STATE_EMPTY {
+			next = append(next[:0], sparseEmpty...)
+		} else {
+			next = slices.AppendSeq(next[:0], m.Transitions(p))
+		}
+		if tag == hybridHashed {
+			buckets := xqwBuckets(entries[:len(entries)-1])
+			for j := range buckets {
+				buckets[j].Key = word.NIL
+			}
+			for _, xqw := range next {
+				*buckets.nextAvailable(xqw.Word) = xqwEntry{xqw.Word, StateWeight{xqw.State, xqw.Weight}}
+			}
+		} else {
+			sort.Sort(byWord(next))
+			for j, xqw := range next {
+				entries[j] = xqwEntry{xqw.Word, StateWeight{xqw.State, xqw.Weight}}
+			}
+		}
+		q, w := m.BackOff(p)
+		entries[len(entries)-1] = xqwEntry{word.NIL, StateWeight{q, w}}
+	}
+	_, startBackOff := h.BackOff(_STATE_START)
+	h.dense = newDenseStates(slices.Values(empty), m.Transitions(_STATE_START), startBackOff, opts.DenseStart)
+	h.links = findStateLinks(m)
+	return h
+}
+
+// next returns the entries of p.
+func (m *Hybrid) next(p StateId) []xqwEntry {
+	return m.entries[m.offsets[p]:m.offsets[p+1]]
+}
+
+// findNext returns the lexical transition of p consuming x, or the
+// back-off of p when there is none. The dense states are not looked up
+// (see NextI and lexical).
+func (m *Hybrid) findNext(p StateId, x word.Id) *xqwEntry {
+	next := m.next(p)
+	lexical := next[:len(next)-1]
+	switch m.tags[p] {
+	case hybridLinear:
+		for i := range lexical {
+			if lexical[i].Key == x {
+				return &lexical[i]
+			}
+		}
+	case hybridSorted:
+		l, h := 0, len(lexical)
+		for l < h {
+			mid := l + (h-l)>>1
+			xMid := lexical[mid].Key
+			if xMid < x {
+				l = mid + 1
+			} else if xMid > x {
+				h = mid
+			} else {
+				return &lexical[mid]
+			}
+		}
+	default:
+		if e := xqwBuckets(lexical).FindEntry(x); e.Key != word.NIL {
+			return e
+		}
+	}
+	return &next[len(next)-1]
+}
+
+func (m *Hybrid) Start() StateId {
+	return _STATE_START
+}
+
+func (m *Hybrid) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
+func (m *Hybrid) NextI(p StateId, x word.Id) (q StateId, w Weight) {
+	if p == _STATE_START && m.dense.start != nil {
+		return m.dense.start.next(x)
+	}
+	for p != _STATE_EMPTY {
+		next := m.findNext(p, x)
+		if next.Key != word.NIL {
+			return next.Value.State, w + next.Value.Weight
+		}
+		p = next.Value.State
+		w += next.Value.Weight
+	}
+	if m.dense.empty != nil {
+		q, dw := m.dense.empty.next(x)
+		return q, w + dw
+	}
+	if next := m.findNext(p, x); next.Key != word.NIL {
+		return next.Value.State, w + next.Value.Weight
+	}
+	return _STATE_EMPTY, WEIGHT_LOG0
+}
+
+func (m *Hybrid) NextS(p StateId, s string) (q StateId, w Weight) {
+	return m.NextI(p, m.vocab.IdOf(s))
+}
+
+// Prob is the same as Hashed.Prob.
+func (m *Hybrid) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Hybrid) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical is the same as Hashed.lexical.
+func (m *Hybrid) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	if p == _STATE_EMPTY {
+		if q, w, ok := m.dense.emptyLexical(x); ok {
+			return q, w, true
+		}
+	}
+	next := m.findNext(p, x)
+	return next.Value.State, next.Value.Weight, next.Key != word.NIL
+}
+
+func (m *Hybrid) Final(p StateId) Weight {
+	_, w := m.NextI(p, m.eosId)
+	return w
+}
+
+func (m *Hybrid) BackOff(p StateId) (StateId, Weight) {
+	if p == _STATE_EMPTY {
+		return STATE_NIL, 0
+	}
+	next := m.next(p)
+	backoff := next[len(next)-1].Value
+	return backoff.State, backoff.Weight
+}
+
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf
+// to avoid that.
+func (m *Hybrid) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
+}
+
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Hybrid) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
+}
+
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Hybrid) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
+}
+
+func (m *Hybrid) NumStates() int {
+	return len(m.tags)
+}
+
+// Transitions gives the transitions of a state sorted by word unless
+// it is a hash table.
+func (m *Hybrid) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.transitions(m.sparseTransitions(p))
+	}
+	return m.sparseTransitions(p)
+}
+
+// sparseTransitions gives the transitions in the entries of p.
+func (m *Hybrid) sparseTransitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		next := m.next(p)
+		for _, e := range next[:len(next)-1] {
+			if e.Key != word.NIL && !yield(WordStateWeight{e.Key, e.Value.State, e.Value.Weight}) {
+				return
+			}
+		}
+	}
+}
+
+// NumTransitions takes time linear to the number of buckets of p when
+// p is a hash table, or to the size of the dense array for
+// _STATE_EMPTY.
+func (m *Hybrid) NumTransitions(p StateId) int {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.numTransitions(m.sparseTransitions(p))
+	}
+	next := m.next(p)
+	if m.tags[p] == hybridHashed {
+		return xqwBuckets(next[:len(next)-1]).Size()
+	}
+	return len(next) - 1
+}
+
+func (m *Hybrid) StateContext(p StateId) []word.Id {
+	return m.links.Context(p)
+}
+
+func (m *Hybrid) StateOrder(p StateId) int {
+	return m.links.Order(p)
+}
+
+// NumLayouts returns the number of states scanned linearly, binary
+// searched and laid out as hash tables in that order.
+func (m *Hybrid) NumLayouts() (linear, sorted, hashed int) {
+	var counts [numHybridLayouts]int
+	for _, tag := range m.tags {
+		counts[tag]++
+	}
+	return counts[hybridLinear], counts[hybridSorted], counts[hybridHashed]
+}
+
+// foldedNgrams is the same as Hashed.foldedNgrams.
+func (m *Hybrid) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+func (m *Hybrid) header() (header, vocab []byte, err error) {
+	maxId := m.dense.maxId()
+	for _, e := range m.entries {
+		maxId = maxWordId(maxId, e.Key)
+	}
+	if header, err = encodeHeader(m.bos, m.eos, nil, m.NumStates(), m.dense.header()); err != nil {
+		return
+	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
+	return
+}
+
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Hybrid) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
+
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself). The entry block is laid out
+// as that of Hashed followed by the tags of the states.
+func (m *Hybrid) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
+	}
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	entryBytes := int64(_OFFSET_SIZE*len(m.offsets)+_ENTRY_SIZE*len(m.entries)+len(m.tags)) + m.dense.numBytes()
+	return writeBinary(w, MAGIC_HYBRID, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(offsetBytes(m.offsets)); err != nil {
+			return err
+		}
+		if err := w.Append(bucketBytes(m.entries)); err != nil {
+			return err
+		}
+		if err := m.dense.write(w); err != nil {
+			return err
+		}
+		return w.Append(m.tags)
+	}, m.links, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m is made by NewHybrid.
+func (m *Hybrid) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_HYBRID.
+func (m *Hybrid) Kind() int {
+	return MODEL_HYBRID
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Hybrid) Close() error {
+	if m.backing == nil {
+		return nil
+	}
+	err := m.backing.Close()
+	m.backing = nil
+	return err
+}
+
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources. Like Hashed.UnsafeParseBinary, it takes
+// constant time.
+func (m *Hybrid) UnsafeParseBinary(raw []byte) error {
+	blocks, err := sliceBinary(raw, MAGIC_HYBRID)
+	if err != nil {
+		return err
+	}
+	m.info = blocks.info
+
+	var (
+		numStates int
+		dh        denseHeader
+	)
+	h, err := blocks.parseHeader(&numStates, &dh)
+	if err != nil {
+		return err
+	}
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+	if numStates < 0 || numStates > len(blocks.entries) {
+		return fmt.Errorf("bad binary: entry block of %d bytes for %d states", len(blocks.entries), numStates)
+	}
+	rest := blocks.entries[:len(blocks.entries)-numStates]
+	m.tags = blocks.entries[len(rest):]
+	if m.dense, rest, err = sliceDenseStates(rest, dh); err != nil {
+		return err
+	}
+	var entries []byte
+	if m.offsets, entries, err = sliceOffsets(rest, numStates, _ENTRY_SIZE); err != nil {
+		return err
+	}
+	m.entries = parseBuckets(entries, blocks.info.Layout)
+	if m.links = parseStateLinks(blocks.links, numStates, blocks.info.Layout); m.links == nil {
+		return errors.New("bad binary: missing state links")
+	}
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
+
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Hybrid) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// Validate checks that m is safe to use: every state has a known
+// layout and ends with its back-off, the transitions of a linear or
+// sorted state are uniquely sorted by word, a hash table has a free
+// bucket, every transition (including those of the dense states)
+// consumes a word in the vocabulary and leads to an existing state and
+// the back-offs and state links are free of cycles. It takes time
+// linear to the size of m.
+func (m *Hybrid) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	if err := validateOffsets(m.offsets, 1); err != nil {
+		return err
+	}
+	numStates := m.NumStates()
+	for i, tag := range m.tags {
+		p := StateId(i)
+		next := m.next(p)
+		if next[len(next)-1].Key != word.NIL {
+			return fmt.Errorf("bad binary: state %d has no back-off", p)
+		}
+		if tag >= numHybridLayouts {
+			return fmt.Errorf("bad binary: state %d has unknown layout %d", p, tag)
+		}
+		free := false
+		for j, e := range next[:len(next)-1] {
+			if tag == hybridHashed && e.Key == word.NIL {
+				free = true
+				continue
+			}
+			if tag != hybridHashed && j > 0 && next[j-1].Key >= e.Key {
+				return fmt.Errorf("bad binary: transitions of state %d are not uniquely sorted at %d", p, j)
+			}
+			if err := validateTransition(p, WordStateWeight{e.Key, e.Value.State, e.Value.Weight}, numStates, m.vocab.bound(), m.eosId); err != nil {
+				return err
+			}
+		}
+		if tag == hybridHashed && !free {
+			return fmt.Errorf("bad binary: hash table of state %d has no free bucket", p)
+		}
+	}
+	if err := m.dense.validate(numStates, m.vocab.bound(), m.eosId); err != nil {
+		return err
+	}
+	return validateStates(numStates, func(p StateId) StateId {
+		next := m.next(p)
+		return next[len(next)-1].Value.State
+	}, m.links, m.vocab.bound())
+}
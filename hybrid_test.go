@@ -0,0 +1,165 @@
+package fslm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestHybridSimple(t *testing.T) {
+	hybridTest(simpleTrigramLM, simpleTrigramSents, t)
+}
+
+func TestHybridSparse(t *testing.T) {
+	hybridTest(sparseFivegramLM, sparseFivegramSents, t)
+}
+
+func TestHybridSparser(t *testing.T) {
+	hybridTest(sparserFivegramLM, sparserFivegramSents, t)
+}
+
+func TestHybridTrickyBackOff(t *testing.T) {
+	hybridTest(trickyBackOffLM, trickyBackOffSents, t)
+}
+
+func TestHybridFragment(t *testing.T) {
+	fragmentTest(readyBuilder(simpleTrigramLM).DumpHybrid(HybridOptions{}), simpleTrigramFragments, t)
+}
+
+func TestHybridProb(t *testing.T) {
+	probTest(readyBuilder(simpleTrigramLM).DumpHybrid(HybridOptions{}), simpleTrigramProbs, t)
+}
+
+// hybridOptions lay out the states in every way: all linear, all
+// sorted, all hash tables and mixed.
+var hybridOptions = []HybridOptions{
+	{MaxLinear: 1 << 30},
+	{MaxLinear: 1, MaxSorted: 1 << 30},
+	{MaxLinear: 1, MaxSorted: 1},
+	{MaxLinear: 2, MaxSorted: 3, Scale: 4, DenseStart: true},
+}
+
+func hybridTest(lm []ngram, sents [][]token, t *testing.T) {
+	for _, opts := range hybridOptions {
+		model := readyBuilder(lm).DumpHybrid(opts)
+		var loaded Hybrid
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("%+v: error in loading binary: %v", opts, err)
+		}
+		for _, m := range []*Hybrid{model, &loaded} {
+			if err := checkModel(m); err != nil {
+				t.Errorf("%+v: check model failed with error %v", opts, err)
+			}
+			if err := checkContexts(m); err != nil {
+				t.Errorf("%+v: check contexts failed with error %v", opts, err)
+			}
+			sentTest(m, sents, t)
+		}
+	}
+}
+
+func TestHybridLayouts(t *testing.T) {
+	builder, err := FromARPA(strings.NewReader(syntheticARPA(1000, 4, 5000, 1)), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sorted := builder.DumpSorted()
+	opts := HybridOptions{MaxLinear: 2, MaxSorted: 10}
+	model := NewHybrid(sorted, opts)
+	for i, tag := range model.tags {
+		// Those of _STATE_EMPTY are all in its dense array.
+		n := len(sorted.next(StateId(i))) - 1
+		expected := byte(hybridHashed)
+		if n <= opts.MaxLinear {
+			expected = hybridLinear
+		} else if n <= opts.MaxSorted {
+			expected = hybridSorted
+		}
+		if tag != expected {
+			t.Errorf("state %d with %d transitions: expect layout %d; got %d", i, n, expected, tag)
+		}
+	}
+	if linear, sorted, hashed := model.NumLayouts(); linear == 0 || sorted == 0 || hashed == 0 {
+		t.Errorf("expect states of every layout; got %d, %d and %d", linear, sorted, hashed)
+	}
+	var loaded Hybrid
+	if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if got, want := arpaLines(&loaded, t), arpaLines(sorted, t); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("hybrid has different n-grams")
+	}
+}
+
+func TestHybridOpen(t *testing.T) {
+	path := t.TempDir() + "/lm"
+	if err := readyBuilder(simpleTrigramLM).DumpHybrid(HybridOptions{}).WriteBinary(path); err != nil {
+		t.Fatalf("error in writing binary: %v", err)
+	}
+	model, err := Open(path, OpenOptions{Validate: true})
+	if err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	defer model.Close()
+	if _, ok := model.(*Hybrid); !ok || model.Kind() != MODEL_HYBRID {
+		t.Errorf("unexpected model %T of kind %d", model, model.Kind())
+	}
+	sentTest(model, simpleTrigramSents, t)
+}
+
+func TestHybridValidate(t *testing.T) {
+	raw := binaryBytes(readyBuilder(simpleTrigramLM).DumpHybrid(HybridOptions{}), t)
+	// The last lexical transition of _STATE_START, so that its
+	// transitions stay sorted.
+	lexical := func(m *Hybrid) *xqwEntry {
+		next := m.next(_STATE_START)
+		return &next[len(next)-2]
+	}
+	for i, corrupt := range []func(*Hybrid){
+		func(m *Hybrid) { m.tags[_STATE_START] = numHybridLayouts },
+		func(m *Hybrid) { lexical(m).Value.State = StateId(m.NumStates()) },
+		func(m *Hybrid) { m.next(_STATE_START)[len(m.next(_STATE_START))-1].Value.State = _STATE_START },
+		func(m *Hybrid) { m.dense.empty[0].State = STATE_NIL },
+		// Word ids out of the vocabulary.
+		func(m *Hybrid) { lexical(m).Key = word.Id(m.vocab.block.numWords) },
+		func(m *Hybrid) { m.links[m.NumStates()-1].Word = word.Id(m.vocab.block.numWords) },
+	} {
+		var m Hybrid
+		if err := m.ParseBinary(append([]byte(nil), raw...)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestHybridCorrupt(t *testing.T) {
+	for _, opts := range hybridOptions {
+		raw := binaryBytes(readyBuilder(simpleTrigramLM).DumpHybrid(opts), t)
+		for j := range raw {
+			corrupt := append([]byte(nil), raw...)
+			corrupt[j] ^= 0xff
+			var m Hybrid
+			if m.ParseBinary(corrupt) != nil {
+				continue
+			}
+			// Anything that passes validation is safe to use.
+			for _, sent := range simpleTrigramSents {
+				p := m.Start()
+				for _, tok := range sent[:len(sent)-1] {
+					p, _ = m.NextS(p, tok.Word)
+				}
+				m.Final(p)
+			}
+			for p := 0; p < m.NumStates(); p++ {
+				m.StateContext(StateId(p))
+				m.BackOff(StateId(p))
+				for range m.Transitions(StateId(p)) {
+				}
+			}
+		}
+	}
+}
@@ -1,30 +1,131 @@
 package fslm
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"syscall"
+	"unsafe"
 
 	"github.com/kho/easy"
 	"github.com/kho/stream"
 )
 
-func FromARPA(in io.Reader) (*Builder, error) {
-	builder := NewBuilder(nil, "", "")
-	if err := stream.Run(stream.NewScanEnumeratorWith(in, lineSplit), arpaTop(builder)); err != nil {
+// FromARPA reads an ARPA file into a new Builder as specified by
+// opts. Errors in the content of the file are reported as *ARPAError.
+func FromARPA(in io.Reader, opts ARPAOptions) (*Builder, error) {
+	builder, err := NewBuilder(nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	builder.SetWorkers(opts.Workers)
+	if err := readARPA(in, &arpaState{sink: builder, builder: builder, opts: opts}, &builder.info); err != nil {
 		return nil, err
 	}
 	return builder, nil
 }
 
-func FromARPAFile(path string) (*Builder, error) {
+// readARPA parses an ARPA file into st.sink and records its size and
+// SHA-256 in info. Errors in the content of the file are reported as
+// *ARPAError.
+func readARPA(in io.Reader, st *arpaState, info *ModelInfo) error {
+	var lines lineCounter
+	st.lines = &lines
+	src := &sourceReader{in: in, hash: sha256.New()}
+	if err := stream.Run(stream.NewScanEnumeratorWith(src, lines.split), arpaTop(st)); err != nil {
+		// Errors found in a batch of entries already have their lines.
+		var arpaErr *ARPAError
+		if errors.As(err, &arpaErr) {
+			return arpaErr
+		}
+		return &ARPAError{lines.line, st.section, err}
+	}
+	info.SourceSize = src.size
+	info.SourceSHA256 = hex.EncodeToString(src.hash.Sum(nil))
+	return nil
+}
+
+// sourceReader computes the size and hash of what is read through it.
+type sourceReader struct {
+	in   io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.in.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+func FromARPAFile(path string, opts ARPAOptions) (*Builder, error) {
 	in, err := easy.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer in.Close()
-	return FromARPA(in)
+	builder, err := FromARPA(in, opts)
+	if err != nil {
+		return nil, err
+	}
+	builder.info.Source = path
+	return builder, nil
+}
+
+// writeFileAtomic writes a file at path with write so that the file
+// is either fully written or left as before: write writes to a
+// temporary file in the same directory, which is synced and then
+// renamed to path. The file keeps the permission of the file it
+// replaces, or gets 0644 when it is new.
+func writeFileAtomic(path string, write func(io.Writer) error) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(path); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		return
+	}
+	if err = write(f); err != nil {
+		return
+	}
+	if err = f.Sync(); err != nil {
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return
+	}
+	// Make the rename itself durable; not all systems support syncing
+	// a directory, hence the errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
 }
 
 type MappedFile struct {
@@ -49,6 +150,11 @@ func OpenMappedFile(path string) (m *MappedFile, err error) {
 	return
 }
 
+// Data returns the mapped content of the file.
+func (m *MappedFile) Data() []byte {
+	return m.data
+}
+
 func (m *MappedFile) Close() error {
 	err1 := syscall.Munmap(m.data)
 	err2 := m.file.Close()
@@ -58,24 +164,96 @@ func (m *MappedFile) Close() error {
 	return err2
 }
 
+// FromBinary maps the binary model at path into memory and loads it,
+// returning its kind (one of MODEL_*), the model and the mapped file,
+// which should be closed after use. Open does the same with a typed
+// result.
 func FromBinary(path string) (int, interface{}, *MappedFile, error) {
 	m, err := OpenMappedFile(path)
 	if err != nil {
 		return -1, nil, nil, err
 	}
-	if IsHashedBinary(m.data) {
-		var model Hashed
-		if err := model.UnsafeParseBinary(m.data); err != nil {
-			return -1, nil, nil, err
-		}
-		return MODEL_HASHED, &model, m, nil
-	} else if IsSortedBinary(m.data) {
-		var model Sorted
-		if err := model.UnsafeParseBinary(m.data); err != nil {
-			return -1, nil, nil, err
-		}
-		return MODEL_SORTED, &model, m, nil
-	} else {
-		return -1, nil, nil, errors.New("not an FSLM file")
+	kind, model, err := parseBinary(m.data)
+	if err != nil {
+		m.Close()
+		return -1, nil, nil, err
+	}
+	return kind, model, m, nil
+}
+
+// FromBinaryBytes loads a binary model from raw like FromBinary. raw
+// then backs the model and should not be modified, unless it is not
+// suitably aligned (e.g. a string converted with unsafe or embedded
+// with package embed), in which case it is first copied.
+func FromBinaryBytes(raw []byte) (int, interface{}, error) {
+	if uintptr(unsafe.Pointer(unsafe.SliceData(raw)))%_BINARY_ALIGN != 0 {
+		raw = append(alignedBytes(0, len(raw)), raw...)
+	}
+	return parseBinary(raw)
+}
+
+// FromBinaryReaderAt reads a binary model of size bytes from r into
+// memory and loads it like FromBinary.
+func FromBinaryReaderAt(r io.ReaderAt, size int64) (int, interface{}, error) {
+	raw, err := readAligned(r, size)
+	if err != nil {
+		return -1, nil, err
+	}
+	return parseBinary(raw)
+}
+
+// readAligned reads size bytes from r into a buffer from alignedBytes.
+func readAligned(r io.ReaderAt, size int64) ([]byte, error) {
+	if int64(int(size)) != size || size < 0 {
+		return nil, fmt.Errorf("bad binary size %d", size)
+	}
+	raw := alignedBytes(int(size), int(size))
+	// ReadAt may report io.EOF along with all the bytes.
+	if n, err := r.ReadAt(raw, 0); n < len(raw) {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// FromBinaryFS reads a binary model from the file name in fsys into
+// memory and loads it like FromBinary. This works with package embed.
+func FromBinaryFS(fsys fs.FS, name string) (int, interface{}, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return -1, nil, err
+	}
+	if r, ok := f.(io.ReaderAt); ok {
+		return FromBinaryReaderAt(r, stat.Size())
+	}
+	// The size is only a hint for files not supporting ReadAt.
+	buf := bytes.NewBuffer(alignedBytes(0, int(stat.Size())+bytes.MinRead))
+	if _, err := buf.ReadFrom(f); err != nil {
+		return -1, nil, err
+	}
+	return FromBinaryBytes(buf.Bytes())
+}
+
+// _BINARY_ALIGN is the alignment a binary model needs in memory, which
+// is the largest alignment of its blocks.
+const _BINARY_ALIGN = 8
+
+// alignedBytes allocates a byte slice whose data is aligned to
+// _BINARY_ALIGN.
+func alignedBytes(size, capacity int) []byte {
+	words := make([]uint64, (capacity+_BINARY_ALIGN-1)/_BINARY_ALIGN)
+	return unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(words))), len(words)*_BINARY_ALIGN)[:size:capacity]
+}
+
+// parseBinary loads a binary model of any registered format from raw.
+func parseBinary(raw []byte) (int, interface{}, error) {
+	model, err := loadBinary(raw, nil, OpenOptions{})
+	if err != nil {
+		return -1, nil, err
 	}
+	return model.Kind(), model, nil
 }
@@ -1,15 +1,23 @@
 package fslm
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestFromARPAFile(t *testing.T) {
 	for _, i := range []string{"simple.3gram.arpa", "messy.3gram.arpa.gz"} {
-		builder, err := FromARPAFile(path.Join("testdata", i))
+		builder, err := FromARPAFile(path.Join("testdata", i), ARPAOptions{})
 		if err != nil {
 			t.Errorf("unexpected error: %v", err)
 		}
@@ -44,6 +52,9 @@ func TestHashedBinary(t *testing.T) {
 	}
 
 	sentTest(modelI.(*Hashed), simpleTrigramSents, t)
+	if err := checkContexts(modelI.(*Hashed)); err != nil {
+		t.Errorf("check contexts failed with error %v", err)
+	}
 
 	modelI = nil
 	if err := backing.Close(); err != nil {
@@ -78,9 +89,149 @@ func TestSortedBinary(t *testing.T) {
 	}
 
 	sentTest(modelI.(*Sorted), simpleTrigramSents, t)
+	if err := checkContexts(modelI.(*Sorted)); err != nil {
+		t.Errorf("check contexts failed with error %v", err)
+	}
 
 	modelI = nil
 	if err := backing.Close(); err != nil {
 		t.Errorf("error in closing mapped file: %v", err)
 	}
 }
+
+// noReaderAtFS hides ReadAt of the files of an fs.FS.
+type noReaderAtFS struct{ fsys fs.FS }
+
+func (f noReaderAtFS) Open(name string) (fs.File, error) {
+	file, err := f.fsys.Open(name)
+	return struct{ fs.File }{file}, err
+}
+
+func TestFromBinaryInMemory(t *testing.T) {
+	for _, i := range []struct {
+		Kind int
+		Dump func(*Builder) binaryModel
+	}{
+		{MODEL_HASHED, dumps[0]},
+		{MODEL_SORTED, dumps[1]},
+	} {
+		raw := binaryBytes(i.Dump(readyBuilder(simpleTrigramLM)), t)
+		// A copy of raw that is not aligned.
+		misaligned := append(make([]byte, 1, len(raw)+1), raw...)[1:]
+		fsys := fstest.MapFS{"lm": &fstest.MapFile{Data: raw}}
+		for _, j := range []struct {
+			Name string
+			Load func() (int, interface{}, error)
+		}{
+			{"bytes", func() (int, interface{}, error) { return FromBinaryBytes(raw) }},
+			{"misaligned bytes", func() (int, interface{}, error) { return FromBinaryBytes(misaligned) }},
+			{"reader", func() (int, interface{}, error) { return FromBinaryReaderAt(bytes.NewReader(raw), int64(len(raw))) }},
+			{"fs", func() (int, interface{}, error) { return FromBinaryFS(fsys, "lm") }},
+			{"fs without ReadAt", func() (int, interface{}, error) { return FromBinaryFS(noReaderAtFS{fsys}, "lm") }},
+		} {
+			kind, modelI, err := j.Load()
+			if err != nil {
+				t.Fatalf("%s: error in loading binary: %v", j.Name, err)
+			}
+			if kind != i.Kind {
+				t.Fatalf("%s: expect kind %d; got %d", j.Name, i.Kind, kind)
+			}
+			model := modelI.(binaryModel)
+			sentTest(model, simpleTrigramSents, t)
+			if err := checkContexts(model); err != nil {
+				t.Errorf("%s: check contexts failed with error %v", j.Name, err)
+			}
+		}
+		if _, _, err := FromBinaryReaderAt(bytes.NewReader(raw), int64(len(raw))+1); err == nil {
+			t.Errorf("expect error when reading beyond the end")
+		}
+		if _, _, err := FromBinaryFS(fsys, "missing"); err == nil {
+			t.Errorf("expect error on missing file")
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	buildTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, dump := range dumps {
+		builder := readyBuilder(simpleTrigramLM)
+		builder.Info().BuildTime = buildTime
+		model := dump(builder)
+		var buf bytes.Buffer
+		n, err := model.(io.WriterTo).WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if n != int64(buf.Len()) {
+			t.Errorf("expect %d bytes written; got %d", buf.Len(), n)
+		}
+		if !bytes.Equal(buf.Bytes(), binaryBytes(model, t)) {
+			t.Errorf("WriteTo and WriteBinary give different binaries")
+		}
+	}
+
+	ext, err := FromARPAExternal(strings.NewReader(syntheticARPA(20, 3, 50, 1)), ARPAOptions{}, ExternalOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ext.Close()
+	ext.Info().BuildTime = buildTime
+	path := filepath.Join(t.TempDir(), "lm")
+	for _, i := range []struct {
+		Write   func(string) error
+		WriteTo func(io.Writer) (int64, error)
+	}{
+		{func(path string) error { return ext.WriteHashed(path, 0) }, func(w io.Writer) (int64, error) { return ext.WriteHashedTo(w, 0) }},
+		{ext.WriteSorted, ext.WriteSortedTo},
+	} {
+		var buf bytes.Buffer
+		if _, err := i.WriteTo(&buf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := i.Write(path); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if raw, _ := os.ReadFile(path); !bytes.Equal(buf.Bytes(), raw) {
+			t.Errorf("external builder writes different binaries to writers and files")
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lm")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A failed write leaves the old file.
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Errorf("expect error")
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != "old" {
+		t.Errorf("expect old content; got %q", raw)
+	}
+	// A successful write replaces the old file and keeps its
+	// permission.
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write([]byte("new"))
+		return err
+	}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != "new" {
+		t.Errorf("expect new content; got %q", raw)
+	}
+	if stat, err := os.Stat(path); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if stat.Mode().Perm() != 0600 {
+		t.Errorf("expect permission 0600; got %v", stat.Mode().Perm())
+	}
+	// No temporary files are left.
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expect only the written file; got %v", entries)
+	}
+}
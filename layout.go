@@ -0,0 +1,347 @@
+package fslm
+
+// The layout of entries and state links in binaries.
+//
+// In LAYOUT_LE32, an entry (a bucket of Hashed or a transition of
+// Sorted) is 12 bytes: the word, the state and the bits of the weight,
+// each as a little-endian uint32; a state link is 8 bytes: the parent
+// and the word, each as a little-endian uint32; a folded n-gram is 16
+// bytes: the context state, the word and the bits of the weight and of
+// the back-off weight, each as a little-endian uint32. On hosts where
+// this is also the layout in memory (see nativeLE32), binaries are
+// written from and loaded into memory as is; on other hosts they are
+// converted on the fly.
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"unsafe"
+
+	"github.com/kho/word"
+)
+
+// Layouts for ModelInfo.Layout.
+const (
+	// The memory layout of the host writing the binary, which is what
+	// binaries of version 1 have.
+	LAYOUT_NATIVE = ""
+	// The little-endian layout with 32-bit fields described above.
+	LAYOUT_LE32 = "le32"
+)
+
+// Sizes of an entry, a state link and a folded n-gram in LAYOUT_LE32,
+// and the alignment of the blocks of them.
+const (
+	_ENTRY_SIZE      = 12
+	_LINK_SIZE       = 8
+	_ARPA_ENTRY_SIZE = 16
+	_LAYOUT_ALIGN    = 4
+)
+
+// Size of an offset of the entries of a state, which is a
+// little-endian uint64 in any layout and is also the alignment of the
+// entry blocks.
+const _OFFSET_SIZE = 8
+
+// Sizes of a bucket of Probing and of a StateWeight (a back-off of
+// Probing or an entry of a dense state) in LAYOUT_LE32. A bucket is
+// the state and the word of its key followed by the next state and the
+// bits of the weight; a StateWeight is the state and the bits of the
+// weight. Both are only written in LAYOUT_LE32.
+const (
+	_PROBING_BUCKET_SIZE = 16
+	_STATE_WEIGHT_SIZE   = 8
+)
+
+// nativeLE32 tells whether entries, state links, folded n-grams and
+// the buckets and back-offs of Probing in memory are laid out as in
+// LAYOUT_LE32. It is a variable so that tests can exercise the
+// conversion.
+var nativeLE32 = isNativeLE32()
+
+func isNativeLE32() bool {
+	one := uint32(1)
+	little := *(*byte)(unsafe.Pointer(&one)) == 1
+	return little &&
+		unsafe.Sizeof(word.Id(0)) == 4 && unsafe.Sizeof(StateId(0)) == 4 && unsafe.Sizeof(Weight(0)) == 4 &&
+		unsafe.Sizeof(xqwEntry{}) == _ENTRY_SIZE && unsafe.Sizeof(WordStateWeight{}) == _ENTRY_SIZE &&
+		unsafe.Offsetof(xqwEntry{}.Value) == 4 && unsafe.Offsetof(WordStateWeight{}.State) == 4 &&
+		unsafe.Sizeof(stateLink{}) == _LINK_SIZE && unsafe.Offsetof(stateLink{}.Word) == 4 &&
+		unsafe.Sizeof(arpaEntry{}) == _ARPA_ENTRY_SIZE && unsafe.Offsetof(arpaEntry{}.Word) == 4 &&
+		unsafe.Offsetof(arpaEntry{}.Weight) == 8 && unsafe.Offsetof(arpaEntry{}.BackOff) == 12 &&
+		unsafe.Sizeof(probingEntry{}) == _PROBING_BUCKET_SIZE && unsafe.Offsetof(probingEntry{}.Value) == 8 &&
+		unsafe.Offsetof(probingEntry{}.Key.Word) == 4 &&
+		unsafe.Sizeof(StateWeight{}) == _STATE_WEIGHT_SIZE && unsafe.Offsetof(StateWeight{}.Weight) == 4
+}
+
+// rawBytes returns the memory of the slice at s with elements of the
+// given size.
+func rawBytes(s unsafe.Pointer, size uintptr) []byte {
+	var bytes []byte
+	sHeader := (*reflect.SliceHeader)(s)
+	bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
+	bytesHeader.Data = sHeader.Data
+	bytesHeader.Len = sHeader.Len * int(size)
+	bytesHeader.Cap = bytesHeader.Len
+	return bytes
+}
+
+// sliceRaw makes the slice at s of n elements backed by raw.
+func sliceRaw(raw []byte, s unsafe.Pointer, n int) {
+	rawHeader := (*reflect.SliceHeader)(unsafe.Pointer(&raw))
+	sHeader := (*reflect.SliceHeader)(s)
+	sHeader.Data = rawHeader.Data
+	sHeader.Len = n
+	sHeader.Cap = n
+}
+
+func putEntry(b []byte, x word.Id, q StateId, w Weight) {
+	binary.LittleEndian.PutUint32(b, uint32(x))
+	binary.LittleEndian.PutUint32(b[4:], uint32(q))
+	binary.LittleEndian.PutUint32(b[8:], math.Float32bits(float32(w)))
+}
+
+func getEntry(b []byte) (word.Id, StateId, Weight) {
+	return word.Id(binary.LittleEndian.Uint32(b)),
+		StateId(binary.LittleEndian.Uint32(b[4:])),
+		Weight(math.Float32frombits(binary.LittleEndian.Uint32(b[8:])))
+}
+
+// bucketBytes returns buckets in LAYOUT_LE32.
+func bucketBytes(buckets []xqwEntry) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&buckets), _ENTRY_SIZE)
+	}
+	raw := make([]byte, len(buckets)*_ENTRY_SIZE)
+	for i, e := range buckets {
+		putEntry(raw[i*_ENTRY_SIZE:], e.Key, e.Value.State, e.Value.Weight)
+	}
+	return raw
+}
+
+// transitionBytes returns transitions in LAYOUT_LE32.
+func transitionBytes(transitions []WordStateWeight) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&transitions), _ENTRY_SIZE)
+	}
+	raw := make([]byte, len(transitions)*_ENTRY_SIZE)
+	for i, e := range transitions {
+		putEntry(raw[i*_ENTRY_SIZE:], e.Word, e.State, e.Weight)
+	}
+	return raw
+}
+
+// linkBytes returns links in LAYOUT_LE32.
+func linkBytes(links stateLinks) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&links), _LINK_SIZE)
+	}
+	raw := make([]byte, len(links)*_LINK_SIZE)
+	for i, l := range links {
+		binary.LittleEndian.PutUint32(raw[i*_LINK_SIZE:], uint32(l.Parent))
+		binary.LittleEndian.PutUint32(raw[i*_LINK_SIZE+4:], uint32(l.Word))
+	}
+	return raw
+}
+
+// offsetBytes returns offsets as little-endian uint64s.
+func offsetBytes(offsets []uint64) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&offsets), _OFFSET_SIZE)
+	}
+	raw := make([]byte, 0, len(offsets)*_OFFSET_SIZE)
+	for _, o := range offsets {
+		raw = binary.LittleEndian.AppendUint64(raw, o)
+	}
+	return raw
+}
+
+// parseOffsets returns the little-endian uint64s in raw, which are
+// backed by raw unless they have to be converted.
+func parseOffsets(raw []byte) []uint64 {
+	n := len(raw) / _OFFSET_SIZE
+	var offsets []uint64
+	if nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&offsets), n)
+		return offsets
+	}
+	offsets = make([]uint64, n)
+	for i := range offsets {
+		offsets[i] = binary.LittleEndian.Uint64(raw[i*_OFFSET_SIZE:])
+	}
+	return offsets
+}
+
+// probingBucketBytes returns the buckets of Probing in LAYOUT_LE32.
+func probingBucketBytes(buckets []probingEntry) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&buckets), _PROBING_BUCKET_SIZE)
+	}
+	raw := make([]byte, len(buckets)*_PROBING_BUCKET_SIZE)
+	for i, e := range buckets {
+		b := raw[i*_PROBING_BUCKET_SIZE:]
+		binary.LittleEndian.PutUint32(b, uint32(e.Key.State))
+		putEntry(b[4:], e.Key.Word, e.Value.State, e.Value.Weight)
+	}
+	return raw
+}
+
+// stateWeightBytes returns the back-offs of Probing or a dense state in
+// LAYOUT_LE32.
+func stateWeightBytes(sws []StateWeight) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&sws), _STATE_WEIGHT_SIZE)
+	}
+	raw := make([]byte, len(sws)*_STATE_WEIGHT_SIZE)
+	for i, b := range sws {
+		binary.LittleEndian.PutUint32(raw[i*_STATE_WEIGHT_SIZE:], uint32(b.State))
+		binary.LittleEndian.PutUint32(raw[i*_STATE_WEIGHT_SIZE+4:], math.Float32bits(float32(b.Weight)))
+	}
+	return raw
+}
+
+// parseProbingBuckets returns the buckets of Probing in raw, which are
+// backed by raw unless they have to be converted.
+func parseProbingBuckets(raw []byte) []probingEntry {
+	n := len(raw) / _PROBING_BUCKET_SIZE
+	var buckets []probingEntry
+	if nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&buckets), n)
+		return buckets
+	}
+	buckets = make([]probingEntry, n)
+	for i := range buckets {
+		b := raw[i*_PROBING_BUCKET_SIZE:]
+		x, q, w := getEntry(b[4:])
+		buckets[i] = probingEntry{probingKey{StateId(binary.LittleEndian.Uint32(b)), x}, StateWeight{q, w}}
+	}
+	return buckets
+}
+
+// parseStateWeights is parseProbingBuckets for the back-offs of
+// Probing or a dense state.
+func parseStateWeights(raw []byte) []StateWeight {
+	n := len(raw) / _STATE_WEIGHT_SIZE
+	var sws []StateWeight
+	if nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&sws), n)
+		return sws
+	}
+	sws = make([]StateWeight, n)
+	for i := range sws {
+		b := raw[i*_STATE_WEIGHT_SIZE:]
+		sws[i] = StateWeight{StateId(binary.LittleEndian.Uint32(b)), Weight(math.Float32frombits(binary.LittleEndian.Uint32(b[4:])))}
+	}
+	return sws
+}
+
+// parseBuckets returns the buckets in raw of the given layout, which
+// are backed by raw unless they have to be converted.
+func parseBuckets(raw []byte, layout string) []xqwEntry {
+	n := len(raw) / _ENTRY_SIZE
+	var buckets []xqwEntry
+	if layout == LAYOUT_NATIVE {
+		n = len(raw) / int(unsafe.Sizeof(xqwEntry{}))
+	}
+	if layout == LAYOUT_NATIVE || nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&buckets), n)
+		return buckets
+	}
+	buckets = make([]xqwEntry, n)
+	for i := range buckets {
+		x, q, w := getEntry(raw[i*_ENTRY_SIZE:])
+		buckets[i] = xqwEntry{x, StateWeight{q, w}}
+	}
+	return buckets
+}
+
+// parseTransitions is parseBuckets for the transitions of Sorted.
+func parseTransitions(raw []byte, layout string) []WordStateWeight {
+	n := len(raw) / _ENTRY_SIZE
+	var transitions []WordStateWeight
+	if layout == LAYOUT_NATIVE {
+		n = len(raw) / int(unsafe.Sizeof(WordStateWeight{}))
+	}
+	if layout == LAYOUT_NATIVE || nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&transitions), n)
+		return transitions
+	}
+	transitions = make([]WordStateWeight, n)
+	for i := range transitions {
+		x, q, w := getEntry(raw[i*_ENTRY_SIZE:])
+		transitions[i] = WordStateWeight{x, q, w}
+	}
+	return transitions
+}
+
+// parseStateLinks tries to slice out links of numStates states of the
+// given layout from raw. Returns nil when raw is of the wrong size or
+// nil, which is the case for binaries written before links were
+// stored.
+func parseStateLinks(raw []byte, numStates int, layout string) stateLinks {
+	size := _LINK_SIZE
+	if layout == LAYOUT_NATIVE {
+		size = int(unsafe.Sizeof(stateLink{}))
+	}
+	if len(raw) != numStates*size {
+		return nil
+	}
+	var links stateLinks
+	if layout == LAYOUT_NATIVE || nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&links), numStates)
+		return links
+	}
+	links = make(stateLinks, numStates)
+	for i := range links {
+		links[i].Parent = StateId(binary.LittleEndian.Uint32(raw[i*_LINK_SIZE:]))
+		links[i].Word = word.Id(binary.LittleEndian.Uint32(raw[i*_LINK_SIZE+4:]))
+	}
+	return links
+}
+
+// arpaEntryBytes returns entries in LAYOUT_LE32.
+func arpaEntryBytes(entries []arpaEntry) []byte {
+	if nativeLE32 {
+		return rawBytes(unsafe.Pointer(&entries), _ARPA_ENTRY_SIZE)
+	}
+	raw := make([]byte, len(entries)*_ARPA_ENTRY_SIZE)
+	for i, e := range entries {
+		b := raw[i*_ARPA_ENTRY_SIZE:]
+		binary.LittleEndian.PutUint32(b, uint32(e.Context))
+		binary.LittleEndian.PutUint32(b[4:], uint32(e.Word))
+		binary.LittleEndian.PutUint32(b[8:], math.Float32bits(float32(e.Weight)))
+		binary.LittleEndian.PutUint32(b[12:], math.Float32bits(float32(e.BackOff)))
+	}
+	return raw
+}
+
+// parseArpaEntries returns the folded n-grams in raw of the given
+// layout like parseBuckets. Returns nil when raw is of the wrong size
+// or nil, which is the case for binaries written before folded n-grams
+// were stored.
+func parseArpaEntries(raw []byte, layout string) []arpaEntry {
+	size := _ARPA_ENTRY_SIZE
+	if layout == LAYOUT_NATIVE {
+		size = int(unsafe.Sizeof(arpaEntry{}))
+	}
+	if len(raw)%size != 0 {
+		return nil
+	}
+	var entries []arpaEntry
+	if layout == LAYOUT_NATIVE || nativeLE32 {
+		sliceRaw(raw, unsafe.Pointer(&entries), len(raw)/size)
+		return entries
+	}
+	entries = make([]arpaEntry, len(raw)/size)
+	for i := range entries {
+		b := raw[i*_ARPA_ENTRY_SIZE:]
+		entries[i] = arpaEntry{
+			StateId(binary.LittleEndian.Uint32(b)),
+			word.Id(binary.LittleEndian.Uint32(b[4:])),
+			Weight(math.Float32frombits(binary.LittleEndian.Uint32(b[8:]))),
+			Weight(math.Float32frombits(binary.LittleEndian.Uint32(b[12:]))),
+		}
+	}
+	return entries
+}
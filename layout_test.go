@@ -0,0 +1,99 @@
+package fslm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kho/byteblock"
+)
+
+func TestLayoutConversion(t *testing.T) {
+	if !nativeLE32 {
+		t.Skip("host is not compatible with LAYOUT_LE32")
+	}
+	defer func() { nativeLE32 = true }()
+	buildTime := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	arpa := syntheticARPA(50, 3, 300, 1)
+	// Binaries written and loaded with and without conversion.
+	write := func(native bool) [][]byte {
+		nativeLE32 = native
+		var raws [][]byte
+		for _, dump := range dumps {
+			builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			builder.Info().BuildTime = buildTime
+			raws = append(raws, binaryBytes(dump(builder), t))
+		}
+		ext, err := FromARPAExternal(strings.NewReader(arpa), ARPAOptions{}, ExternalOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer ext.Close()
+		ext.Info().BuildTime = buildTime
+		var hashed, sorted bytes.Buffer
+		if _, err := ext.WriteHashedTo(&hashed, 0); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := ext.WriteSortedTo(&sorted); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return append(raws, hashed.Bytes(), sorted.Bytes())
+	}
+	native, converted := write(true), write(false)
+	for i := range native {
+		if !bytes.Equal(native[i], converted[i]) {
+			t.Errorf("binary %d differs when converted", i)
+		}
+	}
+
+	expected, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := arpaLines(expected.DumpSorted(), t)
+	for _, native := range []bool{true, false} {
+		nativeLE32 = native
+		for i, loaded := range []binaryModel{new(Hashed), new(Sorted), new(Hashed), new(Sorted)} {
+			if err := loaded.ParseBinary(converted[i]); err != nil {
+				t.Fatalf("error in loading binary %d (native = %t): %v", i, native, err)
+			}
+			if err := checkContexts(loaded); err != nil {
+				t.Errorf("check contexts failed with error %v", err)
+			}
+			if got := arpaLines(loaded, t); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("binary %d (native = %t) has different n-grams", i, native)
+			}
+		}
+	}
+}
+
+func TestUnsupportedLayout(t *testing.T) {
+	blocks, err := sliceBinary(binaryBytes(readyBuilder(simpleTrigramLM).DumpSorted(), t), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info := blocks.info
+	info.Layout = "be64"
+	info.Checksum = CHECKSUM_NONE
+	var infoBlock bytes.Buffer
+	infoBlock.WriteString(MAGIC_INFO)
+	if err := gob.NewEncoder(&infoBlock).Encode(info); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := byteblock.NewByteBlockWriter(&buf)
+	w.Write(blocks.magic, 0)
+	w.Write(infoBlock.Bytes(), 0)
+	w.Write(blocks.header, 0)
+	w.Write(blocks.entries, _LAYOUT_ALIGN)
+	w.Write(blocks.links, _LAYOUT_ALIGN)
+	var m Sorted
+	if err := m.UnsafeParseBinary(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "be64") {
+		t.Errorf("expect error on unsupported layout; got %v", err)
+	}
+}
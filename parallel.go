@@ -0,0 +1,57 @@
+package fslm
+
+// Helpers for running independent pieces of work in parallel.
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// numWorkers turns a worker count from options into the actual
+// number of goroutines to use; n <= 0 means runtime.GOMAXPROCS(0).
+func numWorkers(n int) int {
+	if n <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+// parallelFor calls f on consecutive ranges [lo, hi) covering [0, n)
+// from the given number of goroutines (see numWorkers). The ranges are
+// handed out on demand so that skewed pieces of work are still
+// balanced. f must be safe to call concurrently on disjoint ranges.
+func parallelFor(n, workers int, f func(lo, hi int)) {
+	workers = numWorkers(workers)
+	// A few ranges per worker for balancing, but not too small.
+	chunk := n/(workers*8) + 1
+	if chunk < 64 {
+		chunk = 64
+	}
+	if workers == 1 || n <= chunk {
+		if n > 0 {
+			f(0, n)
+		}
+		return
+	}
+	var next int64
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				lo := int(atomic.AddInt64(&next, int64(chunk))) - chunk
+				if lo >= n {
+					return
+				}
+				hi := lo + chunk
+				if hi > n {
+					hi = n
+				}
+				f(lo, hi)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,83 @@
+package fslm
+
+// Querying n-gram probabilities by explicit context.
+
+import (
+	"slices"
+
+	"github.com/kho/word"
+)
+
+// lexicalModel is a model whose lexical transitions can be looked up
+// without backing off, which is what ngramProb needs.
+type lexicalModel interface {
+	ContextModel
+	// lexical returns the lexical transition of p consuming x, or false
+	// when p has none.
+	lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool)
+	foldedNgrams() []arpaEntry
+}
+
+// ngramProb implements Prob of the models following SRILM: it sums the
+// back-off weights of the suffixes of context, longest first, until
+// one of them followed by x is an n-gram of the model, and adds the
+// weight of that n-gram. The weights come from the folded n-grams
+// when the model has them, so that they are the weights of the source
+// ARPA file rather than the ones NextI uses.
+func ngramProb(m lexicalModel, context []word.Id, x word.Id) (w Weight, order int) {
+	folded := m.foldedNgrams()
+	find := func(p StateId, x word.Id) (arpaEntry, bool) {
+		j, ok := slices.BinarySearchFunc(folded, arpaEntry{p, x, 0, 0}, compareArpaEntries)
+		if !ok {
+			return arpaEntry{}, false
+		}
+		return folded[j], true
+	}
+	for i := 0; i <= len(context); i++ {
+		// Find the state of context[i:] and its back-off weight. Only a
+		// kept n-gram is ever extended, so a context with a prefix that
+		// is not a state of its own is not in the model at all.
+		suffix := context[i:]
+		p, kept := _STATE_EMPTY, true
+		var bow Weight
+		for j, c := range suffix {
+			q, _, ok := m.lexical(p, c)
+			if !ok {
+				kept = false
+				break
+			}
+			own := q != STATE_NIL && m.StateOrder(q) == j+1
+			if j == len(suffix)-1 {
+				if e, ok := find(p, c); ok {
+					bow = e.BackOff
+				} else if own {
+					_, bow = m.BackOff(q)
+				}
+			}
+			if !own {
+				kept = false
+				break
+			}
+			p = q
+		}
+		if kept {
+			if _, xw, ok := m.lexical(p, x); ok {
+				if e, ok := find(p, x); ok {
+					xw = e.Weight
+				}
+				return w + xw, len(suffix) + 1
+			}
+		}
+		w += bow
+	}
+	return WEIGHT_LOG0, 0
+}
+
+// idsOf looks up the ids of words in vocab.
+func idsOf(vocab Vocabulary, words []string) []word.Id {
+	ids := make([]word.Id, len(words))
+	for i, s := range words {
+		ids[i] = vocab.IdOf(s)
+	}
+	return ids
+}
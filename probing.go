@@ -0,0 +1,450 @@
+package fslm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"slices"
+	"sync"
+
+	"github.com/kho/word"
+)
+
+// Probing is a finite-state representation of a n-gram language model
+// in the spirit of KenLM's probing model: the lexical transitions of
+// all states are in a single open-addressing hash table keyed on the
+// state and the word, and the back-offs are in an array indexed by
+// state. Unlike Hashed, a state does not cost its own slice header and
+// load-factor slack, which matters for the many states with only a few
+// transitions. Its buckets are larger as they also hold the state, so
+// a binary is usually larger than that of Hashed of the same scale, but
+// loading it allocates nothing per state and look-ups are a little
+// slower. A Probing model is usually made with NewProbing or
+// Builder.DumpProbing, or loaded from file.
+type Probing struct {
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from a builder.
+	vocab *modelVocab
+	// Sentence boundary symbols.
+	bos, eos     string
+	bosId, eosId word.Id
+	// The hash table of lexical transitions (including final
+	// transitions consuming </s>). Free buckets have word.NIL as the
+	// word of their keys; there is always at least one.
+	buckets []probingEntry
+	// The back-off of each state. That of _STATE_EMPTY is never
+	// followed.
+	backOffs []StateWeight
+	// The number of lexical transitions.
+	numEntries int
+	// Built on demand for Transitions and NumTransitions.
+	index *probingIndex
+	// The context of each state.
+	links stateLinks
+	// The source weights of the n-grams whose weights are folded (see
+	// Hashed.folded).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+type probingKey struct {
+	State StateId
+	Word  word.Id
+}
+
+type probingEntry struct {
+	Key   probingKey
+	Value StateWeight
+}
+
+// probingIndex lists the buckets of the lexical transitions of each
+// state, since they are scattered all over the hash table.
+type probingIndex struct {
+	once sync.Once
+	// starts[p] is the position in buckets of the first transition of
+	// p; the transitions of the last state end at starts[len(starts)-1].
+	starts, buckets []int
+}
+
+// probingHeader is the header of a Probing binary.
+type probingHeader struct {
+	NumStates, NumBuckets, NumEntries int
+}
+
+// NewProbing makes a Probing model of m whose hash table has scale
+// times as many buckets as there are lexical transitions (see
+// Builder.DumpHashed).
+func NewProbing(m ContextModel, scale float64) *Probing {
+	if scale <= 1 {
+		scale = 1.5
+	}
+	numStates := m.NumStates()
+	p := &Probing{index: new(probingIndex)}
+	var vocab *word.Vocab
+	vocab, p.bos, p.eos, p.bosId, p.eosId = m.Vocab()
+	p.vocab = &modelVocab{vocab: vocab}
+	if i, ok := m.(interface{ Info() ModelInfo }); ok {
+		p.info = i.Info()
+	}
+	if f, ok := m.(interface{ foldedNgrams() []arpaEntry }); ok {
+		// m may be backed by a binary closed after conversion.
+		p.folded = slices.Clone(f.foldedNgrams())
+	}
+	for i := 0; i < numStates; i++ {
+		p.numEntries += m.NumTransitions(StateId(i))
+	}
+	numBuckets := max(int(float64(p.numEntries)*scale), p.numEntries+1)
+	p.buckets = make([]probingEntry, numBuckets)
+	for i := range p.buckets {
+		p.buckets[i].Key = probingKey{STATE_NIL, word.NIL}
+	}
+	p.backOffs = make([]StateWeight, numStates)
+	for i := range p.backOffs {
+		s := StateId(i)
+		for xqw := range m.Transitions(s) {
+			e := &p.buckets[p.free(s, xqw.Word)]
+			*e = probingEntry{probingKey{s, xqw.Word}, StateWeight{xqw.State, xqw.Weight}}
+		}
+		q, w := m.BackOff(s)
+		p.backOffs[i] = StateWeight{q, w}
+	}
+	p.links = findStateLinks(m)
+	return p
+}
+
+func probingHash(p StateId, x word.Id) uint64 {
+	// Same as WordIdHash over both halves of the key.
+	h := uint64(p)<<32 | uint64(x)
+	h ^= h >> 23
+	h *= 0x2127599bf4325c37
+	h ^= h >> 47
+	return h
+}
+
+func (m *Probing) start(p StateId, x word.Id) int {
+	return int(probingHash(p, x) % uint64(len(m.buckets)))
+}
+
+// free returns the bucket to insert a new key to.
+func (m *Probing) free(p StateId, x word.Id) int {
+	i := m.start(p, x)
+	for m.buckets[i].Key.Word != word.NIL {
+		i++
+		if i == len(m.buckets) {
+			i = 0
+		}
+	}
+	return i
+}
+
+// find returns the transition of p consuming x, or nil if there is
+// none.
+func (m *Probing) find(p StateId, x word.Id) *StateWeight {
+	key := probingKey{p, x}
+	i := m.start(p, x)
+	for {
+		e := &m.buckets[i]
+		if e.Key.Word == word.NIL {
+			return nil
+		}
+		if e.Key == key {
+			return &e.Value
+		}
+		i++
+		if i == len(m.buckets) {
+			i = 0
+		}
+	}
+}
+
+func (m *Probing) Start() StateId {
+	return _STATE_START
+}
+
+func (m *Probing) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
+func (m *Probing) NextI(p StateId, x word.Id) (q StateId, w Weight) {
+	next := m.find(p, x)
+	for next == nil && p != _STATE_EMPTY {
+		backOff := m.backOffs[p]
+		p = backOff.State
+		w += backOff.Weight
+		next = m.find(p, x)
+	}
+	if next != nil {
+		q = next.State
+		w += next.Weight
+	} else {
+		q = _STATE_EMPTY
+		w = WEIGHT_LOG0
+	}
+	return
+}
+
+func (m *Probing) NextS(p StateId, s string) (q StateId, w Weight) {
+	return m.NextI(p, m.vocab.IdOf(s))
+}
+
+// Prob is the same as Hashed.Prob.
+func (m *Probing) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Probing) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical returns the lexical transition of p consuming x without
+// backing off.
+func (m *Probing) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	if next := m.find(p, x); next != nil {
+		return next.State, next.Weight, true
+	}
+	return STATE_NIL, 0, false
+}
+
+func (m *Probing) Final(p StateId) Weight {
+	_, w := m.NextI(p, m.eosId)
+	return w
+}
+
+func (m *Probing) BackOff(p StateId) (StateId, Weight) {
+	if p == _STATE_EMPTY {
+		return STATE_NIL, 0
+	}
+	backOff := m.backOffs[p]
+	return backOff.State, backOff.Weight
+}
+
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf,
+// or VocabOf, to avoid that.
+func (m *Probing) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
+}
+
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Probing) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
+}
+
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Probing) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
+}
+
+func (m *Probing) NumStates() int {
+	return len(m.backOffs)
+}
+
+// buildIndex builds m.index on the first call, which takes a pass over
+// the hash table and 8 bytes per state and lexical transition.
+func (m *Probing) buildIndex() *probingIndex {
+	index := m.index
+	index.once.Do(func() {
+		index.starts = make([]int, len(m.backOffs)+1)
+		for _, e := range m.buckets {
+			if e.Key.Word != word.NIL {
+				index.starts[e.Key.State+1]++
+			}
+		}
+		for i := 1; i < len(index.starts); i++ {
+			index.starts[i] += index.starts[i-1]
+		}
+		index.buckets = make([]int, m.numEntries)
+		next := append([]int(nil), index.starts[:len(m.backOffs)]...)
+		for i, e := range m.buckets {
+			if e.Key.Word != word.NIL {
+				index.buckets[next[e.Key.State]] = i
+				next[e.Key.State]++
+			}
+		}
+	})
+	return index
+}
+
+// Transitions needs the transitions of every state, which are found
+// by a pass over the hash table on the first call (see buildIndex).
+func (m *Probing) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		index := m.buildIndex()
+		for _, i := range index.buckets[index.starts[p]:index.starts[p+1]] {
+			e := m.buckets[i]
+			if !yield(WordStateWeight{e.Key.Word, e.Value.State, e.Value.Weight}) {
+				return
+			}
+		}
+	}
+}
+
+// NumTransitions is subject to the same first call cost as
+// Transitions.
+func (m *Probing) NumTransitions(p StateId) int {
+	index := m.buildIndex()
+	return index.starts[p+1] - index.starts[p]
+}
+
+func (m *Probing) StateContext(p StateId) []word.Id {
+	return m.links.Context(p)
+}
+
+func (m *Probing) StateOrder(p StateId) int {
+	return m.links.Order(p)
+}
+
+// foldedNgrams is the same as Hashed.foldedNgrams.
+func (m *Probing) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+func (m *Probing) header() (header, vocab []byte, err error) {
+	maxId := word.NIL
+	for _, e := range m.buckets {
+		maxId = maxWordId(maxId, e.Key.Word)
+	}
+	ph := probingHeader{len(m.backOffs), len(m.buckets), m.numEntries}
+	if header, err = encodeHeader(m.bos, m.eos, nil, ph); err != nil {
+		return
+	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
+	return
+}
+
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Probing) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
+
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself). The entry block is the
+// back-offs followed by the hash table.
+func (m *Probing) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
+	}
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	entryBytes := int64(_STATE_WEIGHT_SIZE*len(m.backOffs) + _PROBING_BUCKET_SIZE*len(m.buckets))
+	return writeBinary(w, MAGIC_PROBING, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(stateWeightBytes(m.backOffs)); err != nil {
+			return err
+		}
+		return w.Append(probingBucketBytes(m.buckets))
+	}, m.links, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m is made by NewProbing.
+func (m *Probing) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_PROBING.
+func (m *Probing) Kind() int {
+	return MODEL_PROBING
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Probing) Close() error {
+	if m.backing == nil {
+		return nil
+	}
+	err := m.backing.Close()
+	m.backing = nil
+	return err
+}
+
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources.
+func (m *Probing) UnsafeParseBinary(raw []byte) error {
+	blocks, err := sliceBinary(raw, MAGIC_PROBING)
+	if err != nil {
+		return err
+	}
+	m.info = blocks.info
+
+	var ph probingHeader
+	h, err := blocks.parseHeader(&ph)
+	if err != nil {
+		return err
+	}
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+
+	if ph.NumStates < 0 || uint64(ph.NumStates) >= uint64(STATE_NIL) || ph.NumBuckets <= ph.NumEntries || ph.NumEntries < 0 ||
+		uint64(ph.NumBuckets) > uint64(len(blocks.entries))/_PROBING_BUCKET_SIZE {
+		return fmt.Errorf("bad binary: %d states, %d buckets and %d entries", ph.NumStates, ph.NumBuckets, ph.NumEntries)
+	}
+	backOffBytes := _STATE_WEIGHT_SIZE * ph.NumStates
+	if backOffBytes+_PROBING_BUCKET_SIZE*ph.NumBuckets != len(blocks.entries) {
+		return fmt.Errorf("bad binary: entry block of %d bytes for %d states and %d buckets", len(blocks.entries), ph.NumStates, ph.NumBuckets)
+	}
+	m.backOffs = parseStateWeights(blocks.entries[:backOffBytes])
+	m.buckets = parseProbingBuckets(blocks.entries[backOffBytes:])
+	m.numEntries = ph.NumEntries
+	m.index = new(probingIndex)
+	if m.links = parseStateLinks(blocks.links, ph.NumStates, blocks.info.Layout); m.links == nil {
+		return errors.New("bad binary: missing state links")
+	}
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
+
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Probing) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// Validate checks that m is safe to use: the hash table has as many
+// transitions as the header says and a free bucket, every transition
+// leaves and leads to an existing state and consumes a word in the
+// vocabulary and the back-offs and state links are free of cycles. It takes time linear to the size of m.
+func (m *Probing) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	numStates, numEntries := len(m.backOffs), 0
+	for _, e := range m.buckets {
+		if e.Key.Word == word.NIL {
+			continue
+		}
+		p := e.Key.State
+		if int64(p) >= int64(numStates) {
+			return fmt.Errorf("bad binary: transition consuming %d leaves state %d, out of %d states", e.Key.Word, p, numStates)
+		}
+		if err := validateTransition(p, WordStateWeight{e.Key.Word, e.Value.State, e.Value.Weight}, numStates, m.vocab.bound(), m.eosId); err != nil {
+			return err
+		}
+		numEntries++
+	}
+	if numEntries != m.numEntries {
+		return fmt.Errorf("bad binary: header has %d entries but the hash table has %d", m.numEntries, numEntries)
+	}
+	// The header has more buckets than entries, so there is a free
+	// bucket.
+	return validateStates(numStates, func(p StateId) StateId {
+		return m.backOffs[p].State
+	}, m.links, m.vocab.bound())
+}
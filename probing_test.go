@@ -0,0 +1,241 @@
+package fslm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kho/word"
+)
+
+func TestProbingSimple(t *testing.T) {
+	probingTest(simpleTrigramLM, simpleTrigramSents, t)
+}
+
+func TestProbingSparse(t *testing.T) {
+	probingTest(sparseFivegramLM, sparseFivegramSents, t)
+}
+
+func TestProbingSparser(t *testing.T) {
+	probingTest(sparserFivegramLM, sparserFivegramSents, t)
+}
+
+func TestProbingTrickyBackOff(t *testing.T) {
+	probingTest(trickyBackOffLM, trickyBackOffSents, t)
+}
+
+func TestProbingFragment(t *testing.T) {
+	fragmentTest(readyBuilder(simpleTrigramLM).DumpProbing(0), simpleTrigramFragments, t)
+}
+
+func TestProbingProb(t *testing.T) {
+	probTest(readyBuilder(simpleTrigramLM).DumpProbing(0), simpleTrigramProbs, t)
+}
+
+func probingTest(lm []ngram, sents [][]token, t *testing.T) {
+	for _, scale := range []float64{0, 1.01, 4} {
+		model := readyBuilder(lm).DumpProbing(scale)
+		var loaded Probing
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("scale %g: error in loading binary: %v", scale, err)
+		}
+		for _, m := range []*Probing{model, &loaded} {
+			if err := checkModel(m); err != nil {
+				t.Errorf("scale %g: check model failed with error %v", scale, err)
+			}
+			if err := checkContexts(m); err != nil {
+				t.Errorf("scale %g: check contexts failed with error %v", scale, err)
+			}
+			sentTest(m, sents, t)
+		}
+	}
+}
+
+func TestProbingNgrams(t *testing.T) {
+	arpa := syntheticARPA(1000, 4, 5000, 1)
+	builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sorted := builder.DumpSorted()
+	var loaded Probing
+	if err := loaded.ParseBinary(binaryBytes(NewProbing(sorted, 1.5), t)); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if got, want := arpaLines(&loaded, t), arpaLines(sorted, t); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("probing has different n-grams")
+	}
+	// At least one free bucket even with the smallest scale.
+	if p := NewProbing(sorted, 1.0001); len(p.buckets) <= p.numEntries {
+		t.Errorf("expect a free bucket; got %d buckets for %d entries", len(p.buckets), p.numEntries)
+	}
+}
+
+func TestProbingLayoutConversion(t *testing.T) {
+	if !nativeLE32 {
+		t.Skip("host is not compatible with LAYOUT_LE32")
+	}
+	defer func() { nativeLE32 = true }()
+	builder, err := FromARPA(strings.NewReader(syntheticARPA(50, 3, 300, 1)), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	builder.Info().BuildTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	model := builder.DumpProbing(0)
+	native := binaryBytes(model, t)
+	nativeLE32 = false
+	converted := binaryBytes(model, t)
+	if !bytes.Equal(native, converted) {
+		t.Errorf("binary differs when converted")
+	}
+	var loaded Probing
+	if err := loaded.ParseBinary(converted); err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	if got, want := arpaLines(&loaded, t), arpaLines(model, t); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("converted binary has different n-grams")
+	}
+}
+
+func TestProbingOpen(t *testing.T) {
+	path := t.TempDir() + "/lm"
+	if err := readyBuilder(simpleTrigramLM).DumpProbing(0).WriteBinary(path); err != nil {
+		t.Fatalf("error in writing binary: %v", err)
+	}
+	model, err := Open(path, OpenOptions{Validate: true})
+	if err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	defer model.Close()
+	if _, ok := model.(*Probing); !ok || model.Kind() != MODEL_PROBING {
+		t.Errorf("unexpected model %T of kind %d", model, model.Kind())
+	}
+	sentTest(model, simpleTrigramSents, t)
+}
+
+func TestProbingCorrupt(t *testing.T) {
+	raw := binaryBytes(readyBuilder(simpleTrigramLM).DumpProbing(0), t)
+	for j := range raw {
+		corrupt := append([]byte(nil), raw...)
+		corrupt[j] ^= 0xff
+		var m Probing
+		if m.ParseBinary(corrupt) != nil {
+			continue
+		}
+		// Anything that passes validation is safe to use.
+		for _, sent := range simpleTrigramSents {
+			p := m.Start()
+			for _, tok := range sent[:len(sent)-1] {
+				p, _ = m.NextS(p, tok.Word)
+			}
+			m.Final(p)
+		}
+		for p := 0; p < m.NumStates(); p++ {
+			m.StateContext(StateId(p))
+			m.BackOff(StateId(p))
+			for range m.Transitions(StateId(p)) {
+			}
+		}
+	}
+}
+
+func TestProbingValidate(t *testing.T) {
+	raw := binaryBytes(readyBuilder(simpleTrigramLM).DumpProbing(0), t)
+	lexical := func(m *Probing) *probingEntry {
+		for i := range m.buckets {
+			if m.buckets[i].Key.Word != word.NIL {
+				return &m.buckets[i]
+			}
+		}
+		panic("no lexical transition")
+	}
+	for i, corrupt := range []func(*Probing){
+		func(m *Probing) { lexical(m).Key.State = StateId(m.NumStates()) },
+		func(m *Probing) { lexical(m).Value.State = StateId(m.NumStates()) },
+		func(m *Probing) { m.backOffs[_STATE_START].State = _STATE_START },
+		func(m *Probing) { m.numEntries++ },
+		// Word ids out of the vocabulary.
+		func(m *Probing) { lexical(m).Key.Word = word.Id(m.vocab.block.numWords) },
+		func(m *Probing) { m.links[m.NumStates()-1].Word = word.Id(m.vocab.block.numWords) },
+	} {
+		var m Probing
+		if err := m.ParseBinary(append([]byte(nil), raw...)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
+
+// BenchmarkProbing compares Probing with Hashed of the same scale on a
+// synthetic 4-gram model. Besides the time of each look-up, it reports
+// the size of the binary and the heap allocated when loading it.
+func BenchmarkProbing(b *testing.B) {
+	const numWords = 10000
+	arpa := syntheticARPA(numWords, 4, 300000, 1)
+	builder := func() *Builder {
+		builder, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		return builder
+	}
+	r := rand.New(rand.NewSource(1))
+	words := make([]string, 1<<16)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", r.Intn(numWords))
+	}
+	for _, c := range []struct {
+		name  string
+		model interface {
+			WriteTo(io.Writer) (int64, error)
+		}
+		load func(raw []byte) (Model, error)
+	}{
+		{"hash", builder().DumpHashed(1.5), func(raw []byte) (Model, error) {
+			m := new(Hashed)
+			return m, m.UnsafeParseBinary(raw)
+		}},
+		{"probe", builder().DumpProbing(1.5), func(raw []byte) (Model, error) {
+			m := new(Probing)
+			return m, m.UnsafeParseBinary(raw)
+		}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			if _, err := c.model.WriteTo(&buf); err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			raw := buf.Bytes()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			m, err := c.load(raw)
+			if err != nil {
+				b.Fatalf("error in loading binary: %v", err)
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			xs := make([]word.Id, len(words))
+			for i, s := range words {
+				xs[i] = VocabOf(m).IdOf(s)
+			}
+			b.ResetTimer()
+			p := m.Start()
+			for i := 0; i < b.N; i++ {
+				p, _ = m.NextI(p, xs[i%len(xs)])
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(len(raw)), "binary-B")
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)), "load-B")
+			runtime.KeepAlive(m)
+		})
+	}
+}
@@ -0,0 +1,494 @@
+package fslm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/kho/word"
+)
+
+// Quantized is a finite-state representation of a n-gram language
+// model like Sorted, whose weights are quantized to 8 or 16 bits and
+// decoded on look-up with codebooks of the probabilities and back-off
+// weights of each order (see Codebook). A Quantized model is usually
+// made with Quantize or loaded from file.
+type Quantized struct {
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from Quantize or an old binary.
+	vocab *modelVocab
+	// Sentence boundary symbols.
+	bos, eos     string
+	bosId, eosId word.Id
+	// Entries of all the states one after another, each of which is
+	// the word and the state as little-endian uint32s followed by the
+	// code of the weight as a little-endian uint8 or uint16. As in
+	// Sorted, the entries of a state are sorted by word and end with
+	// the back-off entry consuming word.NIL.
+	entries   []byte
+	entrySize int
+	// The index of the first entry of each state as little-endian
+	// uint64s, followed by the number of entries as the end of the
+	// last state.
+	offsets []byte
+	// The order (context length) of each state, which selects the
+	// codebooks of its weights.
+	orders []uint8
+	// Weights of the codes of lexical transitions and back-offs by the
+	// order of the state they leave.
+	probs, backOffs [][]Weight
+	codebooks       []Codebook
+	// The context of each state.
+	links stateLinks
+	// The source weights of the n-grams whose weights are folded,
+	// which are not quantized (see Sorted.folded).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+// quantizedHeader is the header of a Quantized binary besides the
+// sentence boundary symbols, whose entry block has the offsets, the
+// entries and the orders of the NumStates states (see WriteTo).
+type quantizedHeader struct {
+	Bits      int
+	Codebooks []Codebook
+	NumStates int
+}
+
+// Quantize makes a Quantized model of m with weights of the given bits
+// (8 or 16; see makeCodebook for how weights are quantized).
+func Quantize(m ContextModel, bits int) (*Quantized, error) {
+	if bits != 8 && bits != 16 {
+		return nil, fmt.Errorf("cannot quantize weights to %d bits", bits)
+	}
+	numStates := m.NumStates()
+	q := &Quantized{entrySize: 8 + bits/8, orders: make([]uint8, numStates)}
+	var vocab *word.Vocab
+	vocab, q.bos, q.eos, q.bosId, q.eosId = m.Vocab()
+	q.vocab = &modelVocab{vocab: vocab}
+	if i, ok := m.(interface{ Info() ModelInfo }); ok {
+		q.info = i.Info()
+	}
+	if f, ok := m.(interface{ foldedNgrams() []arpaEntry }); ok {
+		// m may be backed by a binary closed after quantizing.
+		q.folded = slices.Clone(f.foldedNgrams())
+	}
+	// Collect the weights of each codebook.
+	var probs, backOffs [][]Weight
+	numEntries := 0
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		order := m.StateOrder(p)
+		if order > math.MaxUint8 {
+			return nil, fmt.Errorf("cannot quantize a model with states of order %d", order)
+		}
+		q.orders[p] = uint8(order)
+		for len(probs) <= order {
+			probs = append(probs, nil)
+			backOffs = append(backOffs, nil)
+		}
+		for xqw := range m.Transitions(p) {
+			probs[order] = append(probs[order], xqw.Weight)
+		}
+		if p != _STATE_EMPTY {
+			_, w := m.BackOff(p)
+			backOffs[order] = append(backOffs[order], w)
+		}
+		numEntries += m.NumTransitions(p) + 1
+	}
+	q.codebooks = makeCodebooks(probs, backOffs, 1<<bits)
+	q.probs, q.backOffs = indexCodebooks(q.codebooks)
+	// Encode the entries.
+	q.entries = make([]byte, 0, numEntries*q.entrySize)
+	q.offsets = make([]byte, 0, (numStates+1)*8)
+	var next []WordStateWeight
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		q.offsets = binary.LittleEndian.AppendUint64(q.offsets, uint64(len(q.entries)/q.entrySize))
+		next = slices.AppendSeq(next[:0], m.Transitions(p))
+		sort.Sort(byWord(next))
+		book := q.probs[q.orders[p]]
+		for _, xqw := range next {
+			q.entries = q.appendEntry(q.entries, xqw.Word, xqw.State, quantizeWeight(book, xqw.Weight))
+		}
+		backOff, w := m.BackOff(p)
+		code := 0
+		if p != _STATE_EMPTY {
+			code = quantizeWeight(q.backOffs[q.orders[p]], w)
+		}
+		q.entries = q.appendEntry(q.entries, word.NIL, backOff, code)
+	}
+	q.offsets = binary.LittleEndian.AppendUint64(q.offsets, uint64(numEntries))
+	q.links = findStateLinks(q)
+	return q, nil
+}
+
+func (m *Quantized) appendEntry(entries []byte, x word.Id, q StateId, code int) []byte {
+	entries = binary.LittleEndian.AppendUint32(entries, uint32(x))
+	entries = binary.LittleEndian.AppendUint32(entries, uint32(q))
+	if m.entrySize == 9 {
+		return append(entries, uint8(code))
+	}
+	return binary.LittleEndian.AppendUint16(entries, uint16(code))
+}
+
+// entry decodes entry i.
+func (m *Quantized) entry(i int) (x word.Id, q StateId, code int) {
+	e := m.entries[i*m.entrySize : (i+1)*m.entrySize]
+	x = word.Id(binary.LittleEndian.Uint32(e))
+	q = StateId(binary.LittleEndian.Uint32(e[4:]))
+	if m.entrySize == 9 {
+		code = int(e[8])
+	} else {
+		code = int(binary.LittleEndian.Uint16(e[8:]))
+	}
+	return
+}
+
+// start returns the index of the first entry of p, which is also the
+// end of the entries of p-1.
+func (m *Quantized) start(p StateId) int {
+	return int(binary.LittleEndian.Uint64(m.offsets[8*int(p):]))
+}
+
+func (m *Quantized) wordAt(i int) word.Id {
+	return word.Id(binary.LittleEndian.Uint32(m.entries[i*m.entrySize:]))
+}
+
+// find returns the index of the entry of p consuming x, or that of the
+// back-off entry of p when there is none.
+func (m *Quantized) find(p StateId, x word.Id) int {
+	l, h := m.start(p), m.start(p+1)-1
+	backOff := h
+	for l < h {
+		mid := l + (h-l)>>1
+		xMid := m.wordAt(mid)
+		if xMid < x {
+			l = mid + 1
+		} else if xMid > x {
+			h = mid
+		} else {
+			return mid
+		}
+	}
+	return backOff
+}
+
+func (m *Quantized) Start() StateId {
+	return _STATE_START
+}
+
+func (m *Quantized) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
+func (m *Quantized) NextI(p StateId, x word.Id) (q StateId, w Weight) {
+	y, next, code := m.entry(m.find(p, x))
+	for y == word.NIL && p != _STATE_EMPTY {
+		w += m.backOffs[m.orders[p]][code]
+		p = next
+		y, next, code = m.entry(m.find(p, x))
+	}
+	if y != word.NIL {
+		q = next
+		w += m.probs[m.orders[p]][code]
+	} else {
+		q = _STATE_EMPTY
+		w = WEIGHT_LOG0
+	}
+	return
+}
+
+func (m *Quantized) NextS(p StateId, s string) (q StateId, w Weight) {
+	return m.NextI(p, m.vocab.IdOf(s))
+}
+
+// Prob is the same as Sorted.Prob, with the quantized weights of the
+// n-grams other than the folded ones.
+func (m *Quantized) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Quantized) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical returns the lexical transition of p consuming x without
+// backing off.
+func (m *Quantized) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	y, q, code := m.entry(m.find(p, x))
+	if y == word.NIL {
+		return q, 0, false
+	}
+	return q, m.probs[m.orders[p]][code], true
+}
+
+func (m *Quantized) Final(p StateId) Weight {
+	_, w := m.NextI(p, m.eosId)
+	return w
+}
+
+func (m *Quantized) BackOff(p StateId) (StateId, Weight) {
+	if p == _STATE_EMPTY {
+		return STATE_NIL, 0
+	}
+	_, q, code := m.entry(m.start(p+1) - 1)
+	return q, m.backOffs[m.orders[p]][code]
+}
+
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf
+// to avoid that.
+func (m *Quantized) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
+}
+
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Quantized) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
+}
+
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Quantized) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
+}
+
+func (m *Quantized) NumStates() int {
+	return len(m.offsets)/8 - 1
+}
+
+func (m *Quantized) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		book := m.probs[m.orders[p]]
+		for i := m.start(p); i < m.start(p+1)-1; i++ {
+			x, q, code := m.entry(i)
+			if !yield(WordStateWeight{x, q, book[code]}) {
+				return
+			}
+		}
+	}
+}
+
+func (m *Quantized) NumTransitions(p StateId) int {
+	return m.start(p+1) - m.start(p) - 1
+}
+
+func (m *Quantized) StateContext(p StateId) []word.Id {
+	return m.links.Context(p)
+}
+
+func (m *Quantized) StateOrder(p StateId) int {
+	return int(m.orders[p])
+}
+
+// foldedNgrams returns the source weights of the n-grams whose
+// weights m folds back-off weights into (see Sorted.foldedNgrams).
+func (m *Quantized) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+// Bits returns the bits of each quantized weight.
+func (m *Quantized) Bits() int {
+	return (m.entrySize - 8) * 8
+}
+
+// Codebooks returns the codebooks of m, which should not be modified.
+func (m *Quantized) Codebooks() []Codebook {
+	return m.codebooks
+}
+
+func (m *Quantized) header() (header, vocab []byte, err error) {
+	maxId := word.NIL
+	for i := range len(m.entries) / m.entrySize {
+		maxId = maxWordId(maxId, m.wordAt(i))
+	}
+	if header, err = encodeHeader(m.bos, m.eos, nil, quantizedHeader{m.Bits(), m.codebooks, m.NumStates()}); err != nil {
+		return
+	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
+	return
+}
+
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Quantized) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
+
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself), whose entry block has the
+// offsets of the entries of each state, the entries and the order of
+// each state as a byte, all as they are in m.
+func (m *Quantized) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
+	}
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	entryBytes := int64(len(m.offsets) + len(m.entries) + len(m.orders))
+	return writeBinary(w, MAGIC_QUANTIZED, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(m.offsets); err != nil {
+			return err
+		}
+		if err := w.Append(m.entries); err != nil {
+			return err
+		}
+		return w.Append(m.orders)
+	}, m.links, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m is made by Quantize.
+func (m *Quantized) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_QUANTIZED.
+func (m *Quantized) Kind() int {
+	return MODEL_QUANTIZED
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Quantized) Close() error {
+	if m.backing == nil {
+		return nil
+	}
+	err := m.backing.Close()
+	m.backing = nil
+	return err
+}
+
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources.
+func (m *Quantized) UnsafeParseBinary(raw []byte) error {
+	blocks, err := sliceBinary(raw, MAGIC_QUANTIZED)
+	if err != nil {
+		return err
+	}
+	m.info = blocks.info
+
+	var qh quantizedHeader
+	h, err := blocks.parseHeader(&qh)
+	if err != nil {
+		return err
+	}
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+
+	if qh.Bits != 8 && qh.Bits != 16 {
+		return fmt.Errorf("bad binary: weights of %d bits", qh.Bits)
+	}
+	if err := checkCodebooks(qh.Codebooks); err != nil {
+		return err
+	}
+	m.entrySize = 8 + qh.Bits/8
+	m.codebooks = qh.Codebooks
+	m.probs, m.backOffs = indexCodebooks(m.codebooks)
+	// Only the end of the offsets is checked here; see Validate for
+	// the rest.
+	numStates, raw := qh.NumStates, blocks.entries
+	if numStates < 0 || numStates >= len(raw)/9 {
+		return fmt.Errorf("bad binary: entry block of %d bytes for %d states", len(raw), numStates)
+	}
+	m.offsets = raw[:(numStates+1)*8]
+	m.entries = raw[len(m.offsets) : len(raw)-numStates]
+	m.orders = raw[len(raw)-numStates:]
+	if end := m.start(StateId(numStates)); len(m.entries)%m.entrySize != 0 || end != len(m.entries)/m.entrySize {
+		return fmt.Errorf("bad binary: offsets end at %d but the entry block has %d bytes of entries", end, len(m.entries))
+	}
+	if m.links = parseStateLinks(blocks.links, numStates, blocks.info.Layout); m.links == nil {
+		return errors.New("bad binary: missing state links")
+	}
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
+
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Quantized) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// Validate checks that m is safe to use: besides what Sorted.Validate
+// checks, every code is in its codebook and the order of every state
+// is one more than that of its parent in the state links. It takes
+// time linear to the size of m.
+func (m *Quantized) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	numStates := m.NumStates()
+	if m.start(0) != 0 {
+		return fmt.Errorf("bad binary: entries start at %d", m.start(0))
+	}
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		if m.start(p+1) <= m.start(p) {
+			return fmt.Errorf("bad binary: state %d has entries from %d to %d", p, m.start(p), m.start(p+1))
+		}
+	}
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		order := int(m.orders[p])
+		if order >= len(m.probs) {
+			return fmt.Errorf("bad binary: no codebook for state %d of order %d", p, order)
+		}
+		last := m.start(p+1) - 1
+		for j := m.start(p); j < last; j++ {
+			x, q, code := m.entry(j)
+			if j > m.start(p) && m.wordAt(j-1) >= x {
+				return fmt.Errorf("bad binary: transitions of state %d are not uniquely sorted at %d", p, j-m.start(p))
+			}
+			if err := validateTransition(p, WordStateWeight{x, q, 0}, numStates, m.vocab.bound(), m.eosId); err != nil {
+				return err
+			}
+			if code >= len(m.probs[order]) {
+				return fmt.Errorf("bad binary: transition of state %d has code %d beyond its codebook", p, code)
+			}
+		}
+		x, _, code := m.entry(last)
+		if x != word.NIL {
+			return fmt.Errorf("bad binary: state %d has no back-off", p)
+		}
+		if p != _STATE_EMPTY && code >= len(m.backOffs[order]) {
+			return fmt.Errorf("bad binary: back-off of state %d has code %d beyond its codebook", p, code)
+		}
+	}
+	if err := validateStates(numStates, func(p StateId) StateId {
+		_, q, _ := m.entry(m.start(p+1) - 1)
+		return q
+	}, m.links, m.vocab.bound()); err != nil {
+		return err
+	}
+	if m.orders[_STATE_EMPTY] != 0 {
+		return errors.New("bad binary: the empty state has non-zero order")
+	}
+	for i := 1; i < numStates; i++ {
+		if m.orders[i] != m.orders[m.links[i].Parent]+1 {
+			return fmt.Errorf("bad binary: state %d has order %d but its parent has order %d", i, m.orders[i], m.orders[m.links[i].Parent])
+		}
+	}
+	return nil
+}
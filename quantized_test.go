@@ -0,0 +1,202 @@
+package fslm
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestQuantizedSimple(t *testing.T) {
+	quantizedTest(simpleTrigramLM, simpleTrigramSents, t)
+}
+
+func TestQuantizedSparse(t *testing.T) {
+	quantizedTest(sparseFivegramLM, sparseFivegramSents, t)
+}
+
+func TestQuantizedSparser(t *testing.T) {
+	quantizedTest(sparserFivegramLM, sparserFivegramSents, t)
+}
+
+func TestQuantizedTrickyBackOff(t *testing.T) {
+	quantizedTest(trickyBackOffLM, trickyBackOffSents, t)
+}
+
+func TestQuantizedFragment(t *testing.T) {
+	fragmentTest(quantizeOrDie(readyBuilder(simpleTrigramLM).DumpSorted(), 8, t), simpleTrigramFragments, t)
+}
+
+func TestQuantizedProb(t *testing.T) {
+	probTest(quantizeOrDie(readyBuilder(simpleTrigramLM).DumpSorted(), 8, t), simpleTrigramProbs, t)
+}
+
+// quantizedTest checks models with so few weights that they are
+// quantized without error.
+func quantizedTest(lm []ngram, sents [][]token, t *testing.T) {
+	for _, bits := range []int{8, 16} {
+		model := quantizeOrDie(readyBuilder(lm).DumpSorted(), bits, t)
+		for _, c := range model.Codebooks() {
+			if c.MaxError != 0 {
+				t.Errorf("%d bits: expect no error; got %+v", bits, c)
+			}
+		}
+		var loaded Quantized
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("%d bits: error in loading binary: %v", bits, err)
+		}
+		for _, m := range []*Quantized{model, &loaded} {
+			if err := checkModel(m); err != nil {
+				t.Errorf("%d bits: check model failed with error %v", bits, err)
+			}
+			if err := checkContexts(m); err != nil {
+				t.Errorf("%d bits: check contexts failed with error %v", bits, err)
+			}
+			sentTest(m, sents, t)
+			// Without error, the source ARPA file is recovered.
+			var buf bytes.Buffer
+			if err := WriteARPA(m, &buf); err != nil {
+				t.Fatalf("%d bits: unexpected error: %v", bits, err)
+			}
+			if err := checkARPAWeights(buf.String(), lm); err != nil {
+				t.Errorf("%d bits: %v\n%s", bits, err, buf.String())
+			}
+		}
+	}
+}
+
+func quantizeOrDie(m ContextModel, bits int, t *testing.T) *Quantized {
+	q, err := Quantize(m, bits)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return q
+}
+
+func TestQuantizeError(t *testing.T) {
+	builder, err := FromARPA(strings.NewReader(syntheticARPA(100, 3, 3000, 1)), ARPAOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sorted := builder.DumpSorted()
+	prevMax := math.Inf(1)
+	for _, bits := range []int{8, 16} {
+		model := quantizeOrDie(sorted, bits, t)
+		maxError := 0.0
+		for _, c := range model.Codebooks() {
+			if len(c.Weights) > 1<<bits {
+				t.Errorf("%d bits: %d weights in codebook", bits, len(c.Weights))
+			}
+			if c.MeanError > 0.01 {
+				t.Errorf("%d bits: unexpected mean error of %+v", bits, c)
+			}
+			maxError = max(maxError, c.MaxError)
+		}
+		if maxError >= prevMax {
+			t.Errorf("%d bits: unexpected max error %g", bits, maxError)
+		}
+		prevMax = maxError
+		// Every weight is within the max error of its codebook.
+		var loaded Quantized
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("%d bits: error in loading binary: %v", bits, err)
+		}
+		if loaded.Bits() != bits {
+			t.Errorf("expect %d bits; got %d", bits, loaded.Bits())
+		}
+		for i := 0; i < sorted.NumStates(); i++ {
+			p := StateId(i)
+			if loaded.NumTransitions(p) != sorted.NumTransitions(p) {
+				t.Fatalf("%d bits: state %d has %d transitions; expect %d", bits, p, loaded.NumTransitions(p), sorted.NumTransitions(p))
+			}
+			var expected []WordStateWeight
+			for xqw := range sorted.Transitions(p) {
+				expected = append(expected, xqw)
+			}
+			j := 0
+			for xqw := range loaded.Transitions(p) {
+				e := expected[j]
+				j++
+				if xqw.Word != e.Word || xqw.State != e.State || math.Abs(float64(xqw.Weight-e.Weight)) > maxError {
+					t.Errorf("%d bits: expect transition %+v from state %d; got %+v", bits, e, p, xqw)
+				}
+			}
+			if p == _STATE_EMPTY {
+				continue
+			}
+			q, w := loaded.BackOff(p)
+			eq, ew := sorted.BackOff(p)
+			if q != eq || math.Abs(float64(w-ew)) > maxError {
+				t.Errorf("%d bits: expect back-off (%d, %g) from state %d; got (%d, %g)", bits, eq, ew, p, q, w)
+			}
+		}
+	}
+	if _, err := Quantize(sorted, 4); err == nil {
+		t.Errorf("expect error on 4 bits")
+	}
+}
+
+func TestQuantizedOpen(t *testing.T) {
+	path := t.TempDir() + "/lm"
+	if err := quantizeOrDie(readyBuilder(simpleTrigramLM).DumpSorted(), 8, t).WriteBinary(path); err != nil {
+		t.Fatalf("error in writing binary: %v", err)
+	}
+	model, err := Open(path, OpenOptions{Validate: true})
+	if err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	defer model.Close()
+	if _, ok := model.(*Quantized); !ok || model.Kind() != MODEL_QUANTIZED {
+		t.Errorf("unexpected model %T of kind %d", model, model.Kind())
+	}
+	sentTest(model, simpleTrigramSents, t)
+}
+
+func TestQuantizedCorrupt(t *testing.T) {
+	raw := binaryBytes(quantizeOrDie(readyBuilder(simpleTrigramLM).DumpSorted(), 8, t), t)
+	for j := range raw {
+		corrupt := append([]byte(nil), raw...)
+		corrupt[j] ^= 0xff
+		var m Quantized
+		if m.ParseBinary(corrupt) != nil {
+			continue
+		}
+		// Anything that passes validation is safe to use.
+		for _, sent := range simpleTrigramSents {
+			p := m.Start()
+			for _, tok := range sent[:len(sent)-1] {
+				p, _ = m.NextS(p, tok.Word)
+			}
+			m.Final(p)
+		}
+		for p := 0; p < m.NumStates(); p++ {
+			m.StateContext(StateId(p))
+			m.BackOff(StateId(p))
+			for range m.Transitions(StateId(p)) {
+			}
+		}
+	}
+}
+
+func TestQuantizedValidate(t *testing.T) {
+	raw := binaryBytes(quantizeOrDie(readyBuilder(simpleTrigramLM).DumpSorted(), 8, t), t)
+	for i, corrupt := range []func(*Quantized){
+		// A state without even the back-off.
+		func(m *Quantized) { copy(m.offsets[8*(_STATE_START+1):], m.offsets[8*_STATE_START:8*(_STATE_START+1)]) },
+		func(m *Quantized) { m.entries[m.start(_STATE_EMPTY)*m.entrySize] = byte(m.vocab.block.numWords) },
+		func(m *Quantized) { m.entries[m.start(_STATE_EMPTY)*m.entrySize+4] = byte(m.NumStates()) },
+		func(m *Quantized) { m.orders[_STATE_START]++ },
+		func(m *Quantized) { m.links[m.NumStates()-1].Word = word.Id(m.vocab.block.numWords) },
+	} {
+		var m Quantized
+		if err := m.ParseBinary(append([]byte(nil), raw...)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
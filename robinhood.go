@@ -0,0 +1,110 @@
+package fslm
+
+// Robin Hood hashing of the hash tables of Hashed.
+//
+// Like xqwBuckets, a Robin Hood table probes linearly from the home
+// bucket of a word, but an insertion takes the bucket of any word that
+// is closer to its own home than the word being inserted is, which
+// then moves on instead. The words of a table are thus in the order of
+// their homes, and no word is much further from its home than the
+// others. A search can then give up as soon as it passes a word closer
+// to its home than x would be, rather than only at a free bucket, so
+// that a miss (which is common on the back-off path) takes about as
+// many probes as a hit and no more than the furthest word of the table
+// plus one. Like xqwBuckets, a table keeps at least one free bucket, so
+// that neither a miss nor an insertion goes round a table however full
+// it is.
+//
+// Since a search may end at a bucket with a word, the back-off of a
+// state does not come from the free buckets but from an entry before
+// its table, so that the entries of a state are
+//
+//	back-off | table
+//
+// with the back-off keyed by word.NIL.
+
+import (
+	"github.com/kho/word"
+)
+
+// robinHoodStart returns the home bucket of x in a table of n buckets,
+// which maps the hash to the buckets by a multiplication rather than a
+// division.
+func robinHoodStart(x word.Id, n int) int {
+	return int(uint64(uint32(WordIdHash(x))) * uint64(n) >> 32)
+}
+
+// robinHoodSize returns the number of entries of a state with n
+// lexical transitions in a Hashed model of the given scale: the
+// back-off and a table of as many buckets as with xqwBuckets.
+func robinHoodSize(n int, scale float64) int {
+	return 1 + hashedSize(n, scale)
+}
+
+// robinHoodDistance returns how far bucket i is from the home of x in
+// a table of n buckets.
+func robinHoodDistance(x word.Id, i, n int) int {
+	d := i - robinHoodStart(x, n)
+	if d < 0 {
+		d += n
+	}
+	return d
+}
+
+// robinHoodInsert inserts e into buckets, which must have a free
+// bucket.
+func robinHoodInsert(buckets xqwBuckets, e xqwEntry) {
+	n := len(buckets)
+	i, d := robinHoodStart(e.Key, n), 0
+	for buckets[i].Key != word.NIL {
+		if di := robinHoodDistance(buckets[i].Key, i, n); di < d {
+			buckets[i], e, d = e, buckets[i], di
+		}
+		i, d = i+1, d+1
+		if i == n {
+			i = 0
+		}
+	}
+	buckets[i] = e
+}
+
+// robinHoodSearch searches buckets for x from bucket i, the home of x,
+// and returns the entry of x, or nil if x is not in buckets, with the
+// number of buckets it probes. It probes no more than all of buckets
+// even when they are not a valid table.
+func robinHoodSearch(buckets xqwBuckets, x word.Id, i int) (*xqwEntry, int) {
+	n := len(buckets)
+	for d := 0; ; d++ {
+		e := &buckets[i]
+		if e.Key == word.NIL {
+			return nil, d + 1
+		}
+		if e.Key == x {
+			return e, d + 1
+		}
+		if robinHoodDistance(e.Key, i, n) < d {
+			return nil, d + 1
+		}
+		if i++; i == n {
+			i = 0
+		}
+	}
+}
+
+// robinHoodInOrder tells whether the word at bucket i is where
+// robinHoodInsert can put it, given the bucket before it: either at
+// its home or after a word at least as far from its own home, less
+// one. When this holds for every word of buckets, robinHoodSearch
+// finds them all.
+func robinHoodInOrder(buckets xqwBuckets, i int) bool {
+	n := len(buckets)
+	d := robinHoodDistance(buckets[i].Key, i, n)
+	if d == 0 {
+		return true
+	}
+	prev := i - 1
+	if prev < 0 {
+		prev = n - 1
+	}
+	return buckets[prev].Key != word.NIL && robinHoodDistance(buckets[prev].Key, prev, n) >= d-1
+}
@@ -0,0 +1,55 @@
+package fslm
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestRobinHood(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 1; n < 60; n++ {
+		for _, numKeys := range []int{0, n / 2, n - 1} {
+			buckets := xqwInitBuckets(n)
+			keys := map[word.Id]bool{}
+			for len(keys) < numKeys {
+				if x := word.Id(r.Intn(1000)); !keys[x] {
+					keys[x] = true
+					robinHoodInsert(buckets, xqwEntry{x, StateWeight{StateId(x), 0}})
+				}
+			}
+			maxDistance := 0
+			for i, e := range buckets {
+				if e.Key != word.NIL {
+					maxDistance = max(maxDistance, robinHoodDistance(e.Key, i, n))
+					if !robinHoodInOrder(buckets, i) {
+						t.Errorf("n=%d: word %d at %d is out of order", n, e.Key, i)
+					}
+				}
+			}
+			for x := word.Id(0); x < 1000; x++ {
+				e, probes := robinHoodSearch(buckets, x, robinHoodStart(x, n))
+				if keys[x] && (e == nil || e.Key != x) {
+					t.Errorf("n=%d: expect to find %d; got %v", n, x, e)
+				}
+				if !keys[x] && e != nil {
+					t.Errorf("n=%d: expect not to find %d; got %v", n, x, e)
+				}
+				if probes > maxDistance+2 || probes > n {
+					t.Errorf("n=%d: %d probes for %d with words at most %d from home", n, probes, x, maxDistance)
+				}
+			}
+		}
+		// A search ends even in a full table out of order.
+		buckets := make(xqwBuckets, n)
+		for i := range buckets {
+			buckets[i].Key = word.Id(r.Intn(1000))
+		}
+		for x := word.Id(0); x < 1000; x++ {
+			if _, probes := robinHoodSearch(buckets, x, robinHoodStart(x, n)); probes > n+1 {
+				t.Errorf("n=%d: %d probes for %d in a full table", n, probes, x)
+			}
+		}
+	}
+}
@@ -1,52 +1,93 @@
 package fslm
 
 import (
-	"bytes"
-	"encoding/gob"
-	"errors"
-	"os"
-	"reflect"
-	"unsafe"
+	"fmt"
+	"io"
+	"iter"
 
 	"github.com/kho/byteblock"
 	"github.com/kho/word"
 )
 
 type Sorted struct {
-	// The vocabulary of the model. Don't modify this. If you need to
-	// have a vocab based on this, make a copy using Vocab.Copy().
-	vocab *word.Vocab
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from a builder or an old binary.
+	vocab *modelVocab
 	// Sentence boundary symbols.
 	bos, eos     string
 	bosId, eosId word.Id
-	// Transitions indexed by state and sorted by label. Back-off
-	// transitions are stored as transitions consuming word.NIL.
-	transitions [][]WordStateWeight
+	// Transitions of all the states one after another, those of p
+	// being from offsets[p] to offsets[p+1] (see next) and sorted by
+	// label. Back-off transitions are stored as transitions consuming
+	// word.NIL. Both are backed by the binary when loaded from one.
+	entries []WordStateWeight
+	offsets []uint64
+	// Whether the lexical transitions of each state are in the
+	// Eytzinger layout (see eytzinger.go) instead of sorted, with the
+	// back-off still at the end.
+	eytzinger bool
+	// The transitions of _STATE_EMPTY and optionally _STATE_START as
+	// dense arrays, which NextI uses instead of searching them.
+	dense denseStates
+	// The context of each state.
+	links stateLinks
+	// The source weights of the n-grams whose weights are folded,
+	// sorted by context and then by word (see foldedNgrams).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+// next returns the transitions of p.
+func (m *Sorted) next(p StateId) []WordStateWeight {
+	return m.entries[m.offsets[p]:m.offsets[p+1]]
 }
 
 func (m *Sorted) Start() StateId {
 	return _STATE_START
 }
 
+func (m *Sorted) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
 func (m *Sorted) NextI(p StateId, x word.Id) (q StateId, w Weight) {
-	next := m.findNext(p, x)
-	for next.Word == word.NIL && p != _STATE_EMPTY {
+	if p == _STATE_START && m.dense.start != nil {
+		return m.dense.start.next(x)
+	}
+	for p != _STATE_EMPTY {
+		next := m.findNext(p, x)
+		if next.Word != word.NIL {
+			return next.State, w + next.Weight
+		}
 		p = next.State
 		w += next.Weight
-		next = m.findNext(p, x)
 	}
-	if next.Word != word.NIL {
-		q = next.State
-		w += next.Weight
-	} else {
-		q = _STATE_EMPTY
-		w = WEIGHT_LOG0
+	if m.dense.empty != nil {
+		q, dw := m.dense.empty.next(x)
+		return q, w + dw
 	}
-	return
+	if next := m.findNext(p, x); next.Word != word.NIL {
+		return next.State, w + next.Weight
+	}
+	return _STATE_EMPTY, WEIGHT_LOG0
 }
 
 func (m *Sorted) findNext(p StateId, x word.Id) *WordStateWeight {
-	next := m.transitions[p]
+	return m.search(m.next(p), x)
+}
+
+// search returns the transition consuming x in next, the transitions of
+// a state, or its back-off.
+func (m *Sorted) search(next []WordStateWeight, x word.Id) *WordStateWeight {
+	if m.eytzinger {
+		if xqw := eytzingerSearch(next[:len(next)-1], x); xqw != nil {
+			return xqw
+		}
+		return &next[len(next)-1]
+	}
 	// Search for x using binary search.
 	l, h := 0, len(next)
 	for l < h {
@@ -68,6 +109,38 @@ func (m *Sorted) NextS(p StateId, s string) (q StateId, w Weight) {
 	return m.NextI(p, m.vocab.IdOf(s))
 }
 
+// Prob returns the weight of x following context and the order of the
+// matching n-gram (0 when x is an OOV) as SRILM computes them from the
+// source ARPA file: the weight of the longest n-gram ending in x whose
+// context is a suffix of context, plus the back-off weights of the
+// longer suffixes of context. context should not contain </s> and may
+// only have <s> as its first word. Unlike NextI, the back-off weight of
+// an n-gram that is never extended is not included in the weight of
+// that n-gram, but summing Prob over a sentence with full histories
+// still gives the sentence score.
+func (m *Sorted) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Sorted) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical returns the lexical transition of p consuming x without
+// backing off. At _STATE_EMPTY it looks up the dense array first, as
+// the sparse transitions only have what the array cannot tell from a
+// missing word (see denseMissing).
+func (m *Sorted) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	if p == _STATE_EMPTY {
+		if q, w, ok := m.dense.emptyLexical(x); ok {
+			return q, w, true
+		}
+	}
+	next := m.findNext(p, x)
+	return next.State, next.Weight, next.Word != word.NIL
+}
+
 func (m *Sorted) Final(p StateId) Weight {
 	_, w := m.NextI(p, m.eosId)
 	return w
@@ -77,29 +150,72 @@ func (m *Sorted) BackOff(p StateId) (StateId, Weight) {
 	if p == _STATE_EMPTY {
 		return STATE_NIL, 0
 	}
-	next := m.transitions[p]
+	next := m.next(p)
 	backoff := next[len(next)-1]
 	return backoff.State, backoff.Weight
 }
 
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf,
+// or VocabOf, to avoid that.
 func (m *Sorted) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
-	return m.vocab, m.bos, m.eos, m.bosId, m.eosId
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
+}
+
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Sorted) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
+}
+
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Sorted) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
 }
 
 func (m *Sorted) NumStates() int {
-	return len(m.transitions)
+	return len(m.offsets) - 1
 }
 
-func (m *Sorted) Transitions(p StateId) chan WordStateWeight {
-	ch := make(chan WordStateWeight)
-	go func() {
-		next := m.transitions[p]
-		for _, i := range next[:len(next)-1] {
-			ch <- i
+// Transitions gives the transitions of p sorted by word in either
+// layout.
+func (m *Sorted) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.transitions(m.sparseTransitions(p))
+	}
+	return m.sparseTransitions(p)
+}
+
+// sparseTransitions gives the transitions in the entries of p.
+func (m *Sorted) sparseTransitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		next := m.next(p)
+		lexical := next[:len(next)-1]
+		if m.eytzinger {
+			n := len(lexical)
+			for k := eytzingerFirst(n); k < n; k = eytzingerNext(k, n) {
+				if !yield(lexical[k]) {
+					return
+				}
+			}
+			return
+		}
+		for _, i := range lexical {
+			if !yield(i) {
+				return
+			}
 		}
-		close(ch)
-	}()
-	return ch
+	}
+}
+
+// NumTransitions takes time linear to the size of the dense array for
+// _STATE_EMPTY and constant time otherwise.
+func (m *Sorted) NumTransitions(p StateId) int {
+	if p == _STATE_EMPTY && m.dense.empty != nil {
+		return m.dense.empty.numTransitions(m.sparseTransitions(p))
+	}
+	return int(m.offsets[p+1]-m.offsets[p]) - 1
 }
 
 type byWord []WordStateWeight
@@ -108,100 +224,84 @@ func (s byWord) Len() int           { return len(s) }
 func (s byWord) Less(i, j int) bool { return s[i].Word < s[j].Word }
 func (s byWord) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
-// FIXME: a lot of redundant code in binary IO.
+func (m *Sorted) StateContext(p StateId) []word.Id {
+	return m.links.Context(p)
+}
 
-func (m *Sorted) header() (header []byte, err error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	if err = enc.Encode(m.vocab); err != nil {
-		return
-	}
-	if err = enc.Encode(m.bos); err != nil {
-		return
-	}
-	if err = enc.Encode(m.eos); err != nil {
-		return
-	}
-	numTransitions := make([]int, m.NumStates())
-	for i, next := range m.transitions {
-		numTransitions[i] = len(next) - 1
-	}
-	if err = enc.Encode(numTransitions); err != nil {
-		return
-	}
-	header = buf.Bytes()
-	return
+func (m *Sorted) StateOrder(p StateId) int {
+	return m.links.Order(p)
 }
 
-func (m *Sorted) parseHeader(header []byte) (numTransitions []int, err error) {
-	dec := gob.NewDecoder(bytes.NewReader(header))
-	if err = dec.Decode(&m.vocab); err != nil {
-		return
-	}
-	if err = dec.Decode(&m.bos); err != nil {
-		return
-	}
-	if err = dec.Decode(&m.eos); err != nil {
-		return
-	}
-	if m.bosId = m.vocab.IdOf(m.bos); m.bosId == word.NIL {
-		err = errors.New(m.bos + " not in vocabulary")
-		return
-	}
-	if m.eosId = m.vocab.IdOf(m.eos); m.eosId == word.NIL {
-		err = errors.New(m.eos + " not in vocabulary")
-		return
+// foldedNgrams returns the source weights of the n-grams whose
+// weights m folds back-off weights into, from which WriteARPA recovers
+// the source ARPA file.
+func (m *Sorted) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+func (m *Sorted) header() (header, vocab []byte, err error) {
+	maxId := m.dense.maxId()
+	for _, e := range m.entries {
+		maxId = maxWordId(maxId, e.Word)
 	}
-	if err = dec.Decode(&numTransitions); err != nil {
+	if header, err = encodeHeader(m.bos, m.eos, nil, m.NumStates(), m.dense.header(), m.eytzinger); err != nil {
 		return
 	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
 	return
 }
 
-func (m *Sorted) WriteBinary(path string) (err error) {
-	w, err := os.Create(path)
-	if err != nil {
-		return
-	}
-	defer w.Close()
-	bw := byteblock.NewByteBlockWriter(w)
-	if err = bw.WriteString(MAGIC_SORTED, 0); err != nil {
-		return
-	}
-	// Header
-	header, err := m.header()
-	if err != nil {
-		return
-	}
-	if err = bw.Write(header, 0); err != nil {
-		return
-	}
-	// Raw entries.
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Sorted) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
 
-	// Go over the transitions to see how many entries there are in total.
-	numEntries := int64(0)
-	for _, i := range m.transitions {
-		numEntries += int64(len(i))
-	}
-	// Ask for a large new block and then incrementally write out the
-	// data.
-	align := int64(unsafe.Alignof(xqwEntry{}))
-	size := int64(unsafe.Sizeof(xqwEntry{}))
-	if err = bw.NewBlock(align, size*numEntries); err != nil {
-		return
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself).
+func (m *Sorted) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
 	}
-	for _, i := range m.transitions {
-		iHeader := (*reflect.SliceHeader)(unsafe.Pointer(&i))
-		var bytes []byte
-		bytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
-		bytesHeader.Data = iHeader.Data
-		bytesHeader.Len = int(int64(iHeader.Len) * size)
-		bytesHeader.Cap = bytesHeader.Len
-		if err = bw.Append(bytes); err != nil {
-			return
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	entryBytes := int64(_OFFSET_SIZE*len(m.offsets)+_ENTRY_SIZE*len(m.entries)) + m.dense.numBytes()
+	return writeBinary(w, MAGIC_SORTED, info, header, vocab, entryBytes, func(w *blockWriter) error {
+		if err := w.Append(offsetBytes(m.offsets)); err != nil {
+			return err
+		}
+		if err := w.Append(transitionBytes(m.entries)); err != nil {
+			return err
 		}
+		return m.dense.write(w)
+	}, m.links, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m comes from a builder.
+func (m *Sorted) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_SORTED.
+func (m *Sorted) Kind() int {
+	return MODEL_SORTED
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Sorted) Close() error {
+	if m.backing == nil {
+		return nil
 	}
-	return nil
+	err := m.backing.Close()
+	m.backing = nil
+	return err
 }
 
 func IsSortedBinary(raw []byte) bool {
@@ -210,42 +310,84 @@ func IsSortedBinary(raw []byte) bool {
 	return err == nil && string(magic) == MAGIC_SORTED
 }
 
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources. Like Hashed.UnsafeParseBinary, it takes
+// constant time since version 2.
 func (m *Sorted) UnsafeParseBinary(raw []byte) error {
-	bs := byteblock.NewByteBlockSlicer(raw)
-
-	magic, err := bs.Slice()
+	blocks, err := sliceBinary(raw, MAGIC_SORTED)
 	if err != nil {
 		return err
 	}
-	if string(magic) != MAGIC_SORTED {
-		return errors.New("not a FSLM binary file")
-	}
+	m.info = blocks.info
 
-	header, err := bs.Slice()
+	// Binaries of version 1 are always sorted.
+	m.eytzinger = false
+	h, offsets, dense, err := blocks.parseEntries(1, func(raw []byte) int {
+		m.entries = parseTransitions(raw, blocks.info.Layout)
+		return len(m.entries)
+	}, &m.eytzinger)
 	if err != nil {
 		return err
 	}
+	m.offsets, m.dense = offsets, dense
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+	if m.links, err = blocks.parseLinks(m, m.offsets, 1); err != nil {
+		return err
+	}
+	// Binaries written before folded n-grams were stored do not have
+	// them, in which case WriteARPA writes the weights as folded.
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
 
-	numTransitions, err := m.parseHeader(header)
-	if err != nil {
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Sorted) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
 		return err
 	}
+	return m.Validate()
+}
 
-	entryBytes, err := bs.Slice()
-	if err != nil {
+// Validate checks that m is safe to use: the transitions of every
+// state are uniquely sorted by word (in the order of Transitions) and
+// end with the back-off, every transition (including those of the
+// dense states) consumes a word in the vocabulary and leads to an
+// existing state and the back-offs and state links are free of cycles.
+// It takes time linear to the size of m.
+func (m *Sorted) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	if err := validateOffsets(m.offsets, 1); err != nil {
 		return err
 	}
-	var entrySlice []WordStateWeight
-	entryBytesHeader := (*reflect.SliceHeader)(unsafe.Pointer(&entryBytes))
-	entrySliceHeader := (*reflect.SliceHeader)(unsafe.Pointer(&entrySlice))
-	entrySliceHeader.Data = entryBytesHeader.Data
-	entrySliceHeader.Len = entryBytesHeader.Len / int(unsafe.Sizeof(WordStateWeight{}))
-	entrySliceHeader.Cap = entrySliceHeader.Len
-	m.transitions = make([][]WordStateWeight, len(numTransitions))
-	low := 0
-	for i, n := range numTransitions {
-		m.transitions[i] = entrySlice[low : low+n+1]
-		low += n + 1
+	numStates := m.NumStates()
+	for i := 0; i < numStates; i++ {
+		p := StateId(i)
+		next := m.next(p)
+		if next[len(next)-1].Word != word.NIL {
+			return fmt.Errorf("bad binary: state %d has no back-off", p)
+		}
+		j, prev := 0, word.NIL
+		for xqw := range m.sparseTransitions(p) {
+			if j > 0 && prev >= xqw.Word {
+				return fmt.Errorf("bad binary: transitions of state %d are not uniquely sorted at %d", p, j)
+			}
+			if err := validateTransition(p, xqw, numStates, m.vocab.bound(), m.eosId); err != nil {
+				return err
+			}
+			j, prev = j+1, xqw.Word
+		}
+	}
+	if err := m.dense.validate(numStates, m.vocab.bound(), m.eosId); err != nil {
+		return err
 	}
-	return nil
+	return validateStates(numStates, func(p StateId) StateId {
+		next := m.next(p)
+		return next[len(next)-1].State
+	}, m.links, m.vocab.bound())
 }
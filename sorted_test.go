@@ -3,6 +3,9 @@ package fslm
 import (
 	"bytes"
 	"errors"
+	"math/rand"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/kho/word"
@@ -24,45 +27,125 @@ func TestSortedTrickyBackOff(t *testing.T) {
 	sortedTest(trickyBackOffLM, trickyBackOffSents, t)
 }
 
+func TestSortedFragment(t *testing.T) {
+	fragmentTest(readyBuilder(simpleTrigramLM).DumpSorted(), simpleTrigramFragments, t)
+}
+
+func TestSortedProb(t *testing.T) {
+	probTest(readyBuilder(simpleTrigramLM).DumpSorted(), simpleTrigramProbs, t)
+}
+
 func sortedTest(lm []ngram, sents [][]token, t *testing.T) {
-	builder := readyBuilder(lm)
+	for _, layout := range []bool{false, true} {
+		builder := readyBuilder(lm)
+		builder.SetEytzinger(layout)
 
-	var buf bytes.Buffer
-	buf.WriteString("builder LM:\n")
-	builder.Graphviz(&buf)
-	model := builder.DumpSorted()
+		var buf bytes.Buffer
+		buf.WriteString("builder LM:\n")
+		builder.Graphviz(&buf)
+		model := builder.DumpSorted()
 
-	buf.WriteString("model LM:\n")
-	Graphviz(model, &buf)
-	t.Log(buf.String())
+		buf.WriteString("model LM:\n")
+		Graphviz(model, &buf)
+		t.Log(buf.String())
 
-	if err := checkSorted(model); err != nil {
-		t.Errorf("check sorted model failed with error %v", err)
-	}
+		var loaded Sorted
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("eytzinger=%v: error in loading binary: %v", layout, err)
+		}
+		if loaded.eytzinger != layout {
+			t.Errorf("eytzinger=%v: loaded model has eytzinger=%v", layout, loaded.eytzinger)
+		}
 
-	if err := checkModel(model); err != nil {
-		t.Errorf("check model failed with error %v", err)
-	}
+		for _, m := range []*Sorted{model, &loaded} {
+			if err := checkSorted(m); err != nil {
+				t.Errorf("eytzinger=%v: check sorted model failed with error %v", layout, err)
+			}
+
+			if err := checkModel(m); err != nil {
+				t.Errorf("eytzinger=%v: check model failed with error %v", layout, err)
+			}
 
-	sentTest(model, sents, t)
+			if err := checkContexts(m); err != nil {
+				t.Errorf("eytzinger=%v: check contexts failed with error %v", layout, err)
+			}
+
+			sentTest(m, sents, t)
+		}
+	}
 }
 
 func checkSorted(m *Sorted) error {
-	// Every slice should be uniquely sorted and have back-off as the last
-	// transition.
-	for _, next := range m.transitions {
+	// Every slice should be uniquely sorted (in the order of
+	// Transitions) and have back-off as the last transition.
+	for p := 0; p < m.NumStates(); p++ {
+		next := m.next(StateId(p))
 		if len(next) == 0 {
 			return errors.New("empty slice")
 		}
 		if next[len(next)-1].Word != word.NIL {
 			return errors.New("last transition is not back-off")
 		}
-		for i, cur := range next[1:] {
-			prev := next[i]
-			if prev.Word >= cur.Word {
+		n, prev := 0, word.NIL
+		for cur := range m.sparseTransitions(StateId(p)) {
+			if n > 0 && prev >= cur.Word {
 				return errors.New("not uniquely sorted by word")
 			}
+			n, prev = n+1, cur.Word
+		}
+		if n != len(next)-1 {
+			return errors.New("transitions missing from iteration")
 		}
 	}
 	return nil
 }
+
+func BenchmarkSortedSimple(b *testing.B) {
+	sortedBenchmark(func() (*Builder, error) {
+		return FromARPAFile(path.Join("testdata", "simple.3gram.arpa"), ARPAOptions{})
+	}, b)
+}
+
+func BenchmarkSortedSynthetic(b *testing.B) {
+	// About 200 transitions in each state of a unigram context.
+	arpa := syntheticARPA(1000, 3, 200000, 1)
+	sortedBenchmark(func() (*Builder, error) {
+		return FromARPA(strings.NewReader(arpa), ARPAOptions{})
+	}, b)
+}
+
+// sortedBenchmark compares the sorted and the Eytzinger layout of the
+// Sorted model from build by consuming random words with NextI.
+func sortedBenchmark(build func() (*Builder, error), b *testing.B) {
+	for _, i := range []struct {
+		Name      string
+		Eytzinger bool
+	}{{"binary", false}, {"eytzinger", true}} {
+		b.Run(i.Name, func(b *testing.B) {
+			builder, err := build()
+			if err != nil {
+				b.Fatalf("unexpected error: %v", err)
+			}
+			builder.SetEytzinger(i.Eytzinger)
+			m := builder.DumpSorted()
+			r := rand.New(rand.NewSource(1))
+			xs := make([]word.Id, 1<<16)
+			for j := range xs {
+				// Any word but </s>, so that the walk never ends.
+				for xs[j] = m.eosId; xs[j] == m.eosId; {
+					xs[j] = word.Id(r.Intn(len(m.dense.empty)))
+				}
+			}
+			b.ResetTimer()
+			p, w := m.Start(), Weight(0)
+			for j := 0; j < b.N; j++ {
+				var wj Weight
+				p, wj = m.NextI(p, xs[j%len(xs)])
+				w += wj
+			}
+			if w == 0 {
+				b.Errorf("expect some weight")
+			}
+		})
+	}
+}
@@ -0,0 +1,812 @@
+package fslm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"math/bits"
+	"slices"
+	"sort"
+
+	"github.com/kho/word"
+)
+
+// Trie is a finite-state representation of a n-gram language model
+// laid out like KenLM's trie. The states are numbered by order, then
+// by parent and then by word, so the children of a state (the states
+// whose contexts extend its own by one word) are consecutive, as are
+// its other lexical transitions (its leaves) in an array of their own.
+// The record of a state only tells where its children and its leaves
+// start, which is where those of the next state end. The next state of
+// a lexical transition is never stored either: that of a child is the
+// child itself and that of a leaf is found by backing off (see
+// leafNext). Unlike KenLM, whose states are the words of the context,
+// a Trie does store the back-off state of each state, to which NextI
+// backs off without searching. Every field takes only as many bits as
+// its largest value needs, and weights are codes of exact or quantized
+// codebooks of each order (see Codebook). Look-ups decode the fields
+// in place, so a Trie is the smallest model but also the slowest. A
+// Trie model is usually made with Builder.DumpTrie or NewTrie, or
+// loaded from file.
+type Trie struct {
+	// The vocabulary of the model, either a block of the binary looked
+	// up in place or a word.Vocab from a builder.
+	vocab *modelVocab
+	// Sentence boundary symbols.
+	bos, eos     string
+	bosId, eosId word.Id
+	// A record of each state followed by a sentinel record, each of
+	// which is its first child, its first leaf, the last word of its
+	// context, the code of the weight of the transition from its
+	// parent, its back-off state and the code of its back-off weight
+	// (see trieWidths for the bits of each). _STATE_START comes first
+	// among the children of _STATE_EMPTY, which are otherwise sorted by
+	// word like those of any other state.
+	states bitArray
+	// The word and the code of the weight of each leaf, sorted by word
+	// within a state.
+	leaves    bitArray
+	widths    trieWidths
+	numStates int
+	numLeaves uint64
+	// The first state of each order followed by numStates. The state
+	// links are implicit in the trie (see StateContext).
+	levels []StateId
+	// Weights of the codes of lexical transitions and back-offs by the
+	// order of the state they leave.
+	probs, backOffs [][]Weight
+	codebooks       []Codebook
+	// The source weights of the n-grams whose weights are folded (see
+	// Sorted.folded).
+	folded []arpaEntry
+	// See Info.
+	info ModelInfo
+	// What backs the model when loaded by Open; see Close.
+	backing io.Closer
+}
+
+// trieWidths are the bits of the fields of the records of a Trie.
+type trieWidths struct {
+	Word, State, Leaf, Prob, BackOff uint
+}
+
+func (w trieWidths) stateBits() uint {
+	return 2*w.State + w.Leaf + w.Word + w.Prob + w.BackOff
+}
+
+func (w trieWidths) leafBits() uint {
+	return w.Word + w.Prob
+}
+
+// trieHeader is the header of a Trie binary besides the sentence
+// boundary symbols.
+type trieHeader struct {
+	Widths               trieWidths
+	NumStates, NumLeaves int
+	Codebooks            []Codebook
+}
+
+// trieRecord is the decoded record of a state.
+type trieRecord struct {
+	Child       StateId
+	Leaf        uint64
+	Word        word.Id
+	Prob        int
+	BackOff     StateId
+	BackOffCode int
+}
+
+// bitArray is an array of bit fields packed in little-endian order and
+// followed by 8 bytes of padding, so that any field of up to
+// _MAX_FIELD_BITS bits (including an empty one at the end) is read
+// with a single unaligned 64-bit load.
+type bitArray []byte
+
+const _MAX_FIELD_BITS = 57
+
+// bitArrayBytes returns the bytes of a bitArray of n fields of the
+// given bits, or false when it is too large.
+func bitArrayBytes(n uint64, width uint) (uint64, bool) {
+	hi, lo := bits.Mul64(n, uint64(width))
+	if hi != 0 || lo > math.MaxInt64-16 {
+		return 0, false
+	}
+	return (lo+7)/8 + 8, true
+}
+
+func newBitArray(n uint64, width uint) bitArray {
+	size, ok := bitArrayBytes(n, width)
+	if !ok || size > math.MaxInt {
+		panic("bit array too large")
+	}
+	return make(bitArray, size)
+}
+
+// get returns the field of the given bits at bit offset off.
+func (a bitArray) get(off uint64, width uint) uint64 {
+	return binary.LittleEndian.Uint64(a[off/8:]) >> (off % 8) & (1<<width - 1)
+}
+
+// set sets the field of the given bits at bit offset off to v.
+func (a bitArray) set(off uint64, width uint, v uint64) {
+	b := a[off/8:]
+	shift := off % 8
+	mask := uint64(1<<width-1) << shift
+	binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)&^mask|v<<shift&mask)
+}
+
+// bitsFor returns the bits needed by values up to n.
+func bitsFor(n uint64) uint {
+	return uint(bits.Len64(n))
+}
+
+// trieSource is what a Trie is made of: the transitions and the
+// back-offs of the states of a model, which the Trie renumbers.
+type trieSource interface {
+	NumStates() int
+	Transitions(p StateId) iter.Seq[WordStateWeight]
+	BackOff(p StateId) (StateId, Weight)
+}
+
+// NewTrie makes a Trie model of m, whose states are renumbered. Weights
+// are kept exact when bits is 0 and are otherwise quantized to the
+// given bits (up to 16; see makeCodebook for how weights are
+// quantized). The lexical transitions of m must lead where backing off
+// does (see leafNext), as they do in any model made from n-grams.
+func NewTrie(m ContextModel, bits int) (*Trie, error) {
+	t := new(Trie)
+	var vocab *word.Vocab
+	vocab, t.bos, t.eos, t.bosId, t.eosId = m.Vocab()
+	t.vocab = &modelVocab{vocab: vocab}
+	if i, ok := m.(interface{ Info() ModelInfo }); ok {
+		t.info = i.Info()
+	}
+	var folded []arpaEntry
+	if f, ok := m.(interface{ foldedNgrams() []arpaEntry }); ok {
+		folded = f.foldedNgrams()
+	}
+	if err := t.build(m, findStateLinks(m), folded, bits); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// build lays out the states of m, whose contexts are given by links, in
+// t, whose vocabulary and sentence boundary symbols are already set.
+// folded are the folded n-grams of m, which are copied.
+func (t *Trie) build(m trieSource, links stateLinks, folded []arpaEntry, bits int) error {
+	if bits < 0 || bits > 16 {
+		return fmt.Errorf("cannot quantize weights to %d bits", bits)
+	}
+	size := math.MaxInt
+	if bits > 0 {
+		size = 1 << bits
+	}
+	numStates := m.NumStates()
+	if uint64(numStates) >= uint64(STATE_NIL) {
+		return fmt.Errorf("too many states: %d", numStates)
+	}
+	if numStates <= int(_STATE_START) || links[_STATE_START] != (stateLink{_STATE_EMPTY, t.bosId}) {
+		return fmt.Errorf("state %d is not the start state", _STATE_START)
+	}
+	t.numStates = numStates
+	isChild := func(p StateId, xqw WordStateWeight) bool {
+		q := xqw.State
+		return q != _STATE_EMPTY && int64(q) < int64(numStates) && links[q] == stateLink{p, xqw.Word}
+	}
+
+	// Number the states level by level, collecting the weights of each
+	// order on the way.
+	var (
+		states          = []StateId{_STATE_EMPTY} // The state of m of each state of t.
+		newIds          = make([]StateId, numStates)
+		into            = make([]Weight, numStates) // The weight from the parent.
+		probs, backOffs [][]Weight
+		children        []WordStateWeight
+		numLeaves       uint64
+		maxId           = word.NIL
+	)
+	for i := range newIds {
+		newIds[i] = STATE_NIL
+	}
+	newIds[_STATE_EMPTY] = _STATE_EMPTY
+	for lo := 0; lo < len(states); {
+		hi, order := len(states), len(t.levels)
+		if order > math.MaxUint8 {
+			return fmt.Errorf("cannot make a trie of a model with states of order %d", order)
+		}
+		t.levels = append(t.levels, StateId(lo))
+		probs, backOffs = append(probs, nil), append(backOffs, nil)
+		for _, p := range states[lo:hi] {
+			children = children[:0]
+			for xqw := range m.Transitions(p) {
+				probs[order] = append(probs[order], xqw.Weight)
+				maxId = maxWordId(maxId, xqw.Word)
+				if isChild(p, xqw) {
+					children = append(children, xqw)
+					into[xqw.State] = xqw.Weight
+				} else {
+					numLeaves++
+				}
+			}
+			if p != _STATE_EMPTY {
+				_, w := m.BackOff(p)
+				backOffs[order] = append(backOffs[order], w)
+			}
+			sort.Sort(byWord(children))
+			if p == _STATE_EMPTY {
+				i := slices.IndexFunc(children, func(xqw WordStateWeight) bool { return xqw.State == _STATE_START })
+				if i < 0 {
+					return fmt.Errorf("state %d is not the start state", _STATE_START)
+				}
+				start := children[i]
+				copy(children[1:i+1], children[:i])
+				children[0] = start
+			}
+			for _, xqw := range children {
+				if newIds[xqw.State] != STATE_NIL {
+					return fmt.Errorf("state %d is reached twice by its link", xqw.State)
+				}
+				newIds[xqw.State] = StateId(len(states))
+				states = append(states, xqw.State)
+			}
+		}
+		lo = hi
+	}
+	t.levels = append(t.levels, StateId(numStates))
+	if len(states) != numStates {
+		return fmt.Errorf("%d of %d states are not reached by their links", numStates-len(states), numStates)
+	}
+	t.codebooks = makeCodebooks(probs, backOffs, size)
+	t.probs, t.backOffs = indexCodebooks(t.codebooks)
+	t.numLeaves = numLeaves
+
+	// Find out the widths.
+	w := &t.widths
+	if maxId != word.NIL {
+		w.Word = bitsFor(uint64(maxId))
+	}
+	w.State = bitsFor(uint64(numStates))
+	w.Leaf = bitsFor(numLeaves)
+	for _, book := range t.probs {
+		w.Prob = max(w.Prob, bitsFor(uint64(max(len(book)-1, 0))))
+	}
+	for _, book := range t.backOffs {
+		w.BackOff = max(w.BackOff, bitsFor(uint64(max(len(book)-1, 0))))
+	}
+
+	// Encode the records, whose children come one after another.
+	t.states = newBitArray(uint64(numStates+1), w.stateBits())
+	t.leaves = newBitArray(numLeaves, w.leafBits())
+	r := trieRecord{Child: _STATE_START}
+	var leaves []WordStateWeight
+	for i, p := range states {
+		n := StateId(i)
+		order := t.order(n)
+		r.Word, r.Prob, r.BackOff, r.BackOffCode = 0, 0, 0, 0
+		if n != _STATE_EMPTY {
+			q, bw := m.BackOff(p)
+			r.Word = links[p].Word
+			r.Prob = quantizeWeight(t.probs[order-1], into[p])
+			r.BackOff = newIds[q]
+			r.BackOffCode = quantizeWeight(t.backOffs[order], bw)
+		}
+		leaves = leaves[:0]
+		numChildren := StateId(0)
+		for xqw := range m.Transitions(p) {
+			if isChild(p, xqw) {
+				numChildren++
+			} else {
+				leaves = append(leaves, xqw)
+			}
+		}
+		t.setState(n, r)
+		sort.Sort(byWord(leaves))
+		for _, xqw := range leaves {
+			t.setLeaf(r.Leaf, xqw.Word, quantizeWeight(t.probs[order], xqw.Weight))
+			r.Leaf++
+		}
+		r.Child += numChildren
+	}
+	t.setState(StateId(numStates), trieRecord{Child: r.Child, Leaf: r.Leaf})
+
+	// The next states of the leaves are not stored, so check that
+	// backing off finds those of m.
+	for i, p := range states {
+		for xqw := range m.Transitions(p) {
+			if isChild(p, xqw) {
+				continue
+			}
+			q := xqw.State
+			if int64(q) < int64(numStates) {
+				q = newIds[q]
+			}
+			if t.leafNext(StateId(i), xqw.Word) != q {
+				return fmt.Errorf("transition of state %d consuming %d does not lead where backing off does", p, xqw.Word)
+			}
+		}
+	}
+
+	// The folded n-grams are sorted by the new state ids.
+	t.folded = make([]arpaEntry, len(folded))
+	for i, e := range folded {
+		e.Context = newIds[e.Context]
+		t.folded[i] = e
+	}
+	slices.SortFunc(t.folded, compareArpaEntries)
+	return nil
+}
+
+// setState encodes the record of p.
+func (m *Trie) setState(p StateId, r trieRecord) {
+	w := &m.widths
+	off := uint64(p) * uint64(w.stateBits())
+	for _, f := range []struct {
+		Width uint
+		Value uint64
+	}{
+		{w.State, uint64(r.Child)},
+		{w.Leaf, r.Leaf},
+		{w.Word, uint64(r.Word)},
+		{w.Prob, uint64(r.Prob)},
+		{w.State, uint64(r.BackOff)},
+		{w.BackOff, uint64(r.BackOffCode)},
+	} {
+		m.states.set(off, f.Width, f.Value)
+		off += uint64(f.Width)
+	}
+}
+
+func (m *Trie) setLeaf(i uint64, x word.Id, code int) {
+	off := i * uint64(m.widths.leafBits())
+	m.leaves.set(off, m.widths.Word, uint64(x))
+	m.leaves.set(off+uint64(m.widths.Word), m.widths.Prob, uint64(code))
+}
+
+// field decodes the field of the given bits at bit offset off of the
+// record of p.
+func (m *Trie) field(p StateId, off, width uint) uint64 {
+	return m.states.get(uint64(p)*uint64(m.widths.stateBits())+uint64(off), width)
+}
+
+// child returns the first child of p.
+func (m *Trie) child(p StateId) StateId {
+	return StateId(m.field(p, 0, m.widths.State))
+}
+
+// leaf returns the index of the first leaf of p.
+func (m *Trie) leaf(p StateId) uint64 {
+	return m.field(p, m.widths.State, m.widths.Leaf)
+}
+
+// stateWord returns the last word of the context of p.
+func (m *Trie) stateWord(p StateId) word.Id {
+	w := &m.widths
+	return word.Id(m.field(p, w.State+w.Leaf, w.Word))
+}
+
+// probCode returns the code of the weight of the transition to p from
+// its parent.
+func (m *Trie) probCode(p StateId) int {
+	w := &m.widths
+	return int(m.field(p, w.State+w.Leaf+w.Word, w.Prob))
+}
+
+// backOff returns the back-off state of p and the code of its weight.
+func (m *Trie) backOff(p StateId) (StateId, int) {
+	w := &m.widths
+	off := w.State + w.Leaf + w.Word + w.Prob
+	return StateId(m.field(p, off, w.State)), int(m.field(p, off+w.State, w.BackOff))
+}
+
+func (m *Trie) leafWord(i uint64) word.Id {
+	return word.Id(m.leaves.get(i*uint64(m.widths.leafBits()), m.widths.Word))
+}
+
+func (m *Trie) leafCode(i uint64) int {
+	w := &m.widths
+	return int(m.leaves.get(i*uint64(w.leafBits())+uint64(w.Word), w.Prob))
+}
+
+// order returns the order of p, i.e. the level of the trie it is on,
+// by a binary search of levels. Look-ups find it once for each state
+// they visit and pass it on.
+func (m *Trie) order(p StateId) int {
+	return sort.Search(len(m.levels)-1, func(i int) bool { return m.levels[i+1] > p })
+}
+
+// findChild returns the child of p consuming x.
+func (m *Trie) findChild(p StateId, x word.Id) (StateId, bool) {
+	l, h := m.child(p), m.child(p+1)
+	if p == _STATE_EMPTY {
+		if x == m.bosId {
+			return _STATE_START, true
+		}
+		l++
+	}
+	for l < h {
+		mid := l + (h-l)>>1
+		xMid := m.stateWord(mid)
+		if xMid < x {
+			l = mid + 1
+		} else if xMid > x {
+			h = mid
+		} else {
+			return mid, true
+		}
+	}
+	return 0, false
+}
+
+// findLeaf returns the index of the leaf of p consuming x.
+func (m *Trie) findLeaf(p StateId, x word.Id) (uint64, bool) {
+	l, h := m.leaf(p), m.leaf(p+1)
+	for l < h {
+		mid := l + (h-l)>>1
+		xMid := m.leafWord(mid)
+		if xMid < x {
+			l = mid + 1
+		} else if xMid > x {
+			h = mid
+		} else {
+			return mid, true
+		}
+	}
+	return 0, false
+}
+
+// leafNext returns the next state of the leaf of p consuming x: the
+// child consuming x of the first state after p along its back-off
+// chain that has one, as Builder.link finds it, or STATE_NIL for </s>.
+func (m *Trie) leafNext(p StateId, x word.Id) StateId {
+	if x == m.eosId {
+		return STATE_NIL
+	}
+	for p != _STATE_EMPTY {
+		p, _ = m.backOff(p)
+		if q, ok := m.findChild(p, x); ok {
+			return q
+		}
+	}
+	return _STATE_EMPTY
+}
+
+func (m *Trie) Start() StateId {
+	return _STATE_START
+}
+
+func (m *Trie) StartEmpty() StateId {
+	return _STATE_EMPTY
+}
+
+func (m *Trie) NextI(p StateId, x word.Id) (q StateId, w Weight) {
+	for {
+		order := m.order(p)
+		if q, ok := m.findChild(p, x); ok {
+			return q, w + m.probs[order][m.probCode(q)]
+		}
+		if i, ok := m.findLeaf(p, x); ok {
+			return m.leafNext(p, x), w + m.probs[order][m.leafCode(i)]
+		}
+		if p == _STATE_EMPTY {
+			return _STATE_EMPTY, WEIGHT_LOG0
+		}
+		next, code := m.backOff(p)
+		w += m.backOffs[order][code]
+		p = next
+	}
+}
+
+func (m *Trie) NextS(p StateId, s string) (q StateId, w Weight) {
+	return m.NextI(p, m.vocab.IdOf(s))
+}
+
+// Prob is the same as Sorted.Prob, with the weights of the codebooks
+// for the n-grams other than the folded ones.
+func (m *Trie) Prob(context []word.Id, x word.Id) (w Weight, order int) {
+	return ngramProb(m, context, x)
+}
+
+// ProbS is similar to Prob but takes strings.
+func (m *Trie) ProbS(context []string, x string) (w Weight, order int) {
+	return ngramProb(m, idsOf(m.vocab, context), m.vocab.IdOf(x))
+}
+
+// lexical returns the lexical transition of p consuming x without
+// backing off.
+func (m *Trie) lexical(p StateId, x word.Id) (q StateId, w Weight, ok bool) {
+	if q, ok := m.findChild(p, x); ok {
+		return q, m.probs[m.order(p)][m.probCode(q)], true
+	}
+	if i, ok := m.findLeaf(p, x); ok {
+		return m.leafNext(p, x), m.probs[m.order(p)][m.leafCode(i)], true
+	}
+	return STATE_NIL, 0, false
+}
+
+func (m *Trie) Final(p StateId) Weight {
+	_, w := m.NextI(p, m.eosId)
+	return w
+}
+
+func (m *Trie) BackOff(p StateId) (StateId, Weight) {
+	if p == _STATE_EMPTY {
+		return STATE_NIL, 0
+	}
+	q, code := m.backOff(p)
+	return q, m.backOffs[m.order(p)][code]
+}
+
+// Vocab returns the vocabulary of m, which has to be built on the
+// first call for a model loaded from a binary; use IdOf and StringOf,
+// or VocabOf, to avoid that.
+func (m *Trie) Vocab() (*word.Vocab, string, string, word.Id, word.Id) {
+	return m.vocab.Vocab(), m.bos, m.eos, m.bosId, m.eosId
+}
+
+// IdOf returns the id of s in the vocabulary of m, or word.NIL if s is
+// not in it.
+func (m *Trie) IdOf(s string) word.Id {
+	return m.vocab.IdOf(s)
+}
+
+// StringOf returns the word of id x in the vocabulary of m, which is
+// only valid until m is closed.
+func (m *Trie) StringOf(x word.Id) string {
+	return m.vocab.StringOf(x)
+}
+
+func (m *Trie) NumStates() int {
+	return m.numStates
+}
+
+// Transitions gives the children of p and then its leaves.
+func (m *Trie) Transitions(p StateId) iter.Seq[WordStateWeight] {
+	return func(yield func(WordStateWeight) bool) {
+		book := m.probs[m.order(p)]
+		for q, end := m.child(p), m.child(p+1); q < end; q++ {
+			if !yield(WordStateWeight{m.stateWord(q), q, book[m.probCode(q)]}) {
+				return
+			}
+		}
+		for i, end := m.leaf(p), m.leaf(p+1); i < end; i++ {
+			x := m.leafWord(i)
+			if !yield(WordStateWeight{x, m.leafNext(p, x), book[m.leafCode(i)]}) {
+				return
+			}
+		}
+	}
+}
+
+func (m *Trie) NumTransitions(p StateId) int {
+	return int(m.child(p+1)-m.child(p)) + int(m.leaf(p+1)-m.leaf(p))
+}
+
+// StateContext finds the context of p by walking up the trie.
+func (m *Trie) StateContext(p StateId) []word.Id {
+	context := make([]word.Id, m.order(p))
+	for i := len(context) - 1; i >= 0; i-- {
+		context[i] = m.stateWord(p)
+		p = m.parent(p, i+1)
+	}
+	return context
+}
+
+// parent returns the parent of p of the given order, i.e. the last
+// state of the order below whose children start no later than p.
+func (m *Trie) parent(p StateId, order int) StateId {
+	lo, hi := m.levels[order-1], m.levels[order]
+	return lo + StateId(sort.Search(int(hi-lo), func(i int) bool {
+		return m.child(lo+StateId(i)) > p
+	})) - 1
+}
+
+func (m *Trie) StateOrder(p StateId) int {
+	return m.order(p)
+}
+
+// foldedNgrams returns the source weights of the n-grams whose
+// weights m folds back-off weights into (see Sorted.foldedNgrams).
+func (m *Trie) foldedNgrams() []arpaEntry {
+	return m.folded
+}
+
+// Codebooks returns the codebooks of m, which should not be modified.
+func (m *Trie) Codebooks() []Codebook {
+	return m.codebooks
+}
+
+func (m *Trie) header() (header, vocab []byte, err error) {
+	maxId := word.NIL
+	for i := 1; i < m.numStates; i++ {
+		maxId = maxWordId(maxId, m.stateWord(StateId(i)))
+	}
+	for i := uint64(0); i < m.numLeaves; i++ {
+		maxId = maxWordId(maxId, m.leafWord(i))
+	}
+	th := trieHeader{m.widths, m.numStates, int(m.numLeaves), m.codebooks}
+	if header, err = encodeHeader(m.bos, m.eos, nil, th); err != nil {
+		return
+	}
+	vocab, err = encodeModelVocab(m.vocab, maxId, m.bosId, m.eosId)
+	return
+}
+
+// WriteBinary writes m to path in the binary format (see WriteTo).
+// The file at path is replaced atomically (see writeFileAtomic).
+func (m *Trie) WriteBinary(path string) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		_, err := m.WriteTo(w)
+		return err
+	})
+}
+
+// WriteTo writes m to w in the binary format (see ModelInfo for what
+// is recorded besides the model itself). The entries block holds the
+// state records followed by the leaves, and the links block is empty.
+func (m *Trie) WriteTo(w io.Writer) (int64, error) {
+	header, vocab, err := m.header()
+	if err != nil {
+		return 0, err
+	}
+	info := m.info
+	info.Counts = countNgrams(m)
+	info.Order = len(info.Counts)
+	return writeBinary(w, MAGIC_TRIE, info, header, vocab, int64(len(m.states)+len(m.leaves)), func(w *blockWriter) error {
+		if err := w.Append(m.states); err != nil {
+			return err
+		}
+		return w.Append(m.leaves)
+	}, nil, m.folded)
+}
+
+// Info returns the information of the binary m is loaded from, or
+// that will be written with m when m comes from a builder or NewTrie.
+func (m *Trie) Info() ModelInfo {
+	return m.info
+}
+
+// Kind returns MODEL_TRIE.
+func (m *Trie) Kind() int {
+	return MODEL_TRIE
+}
+
+// Close releases the memory backing m when m is loaded by Open, after
+// which m should not be used. It does nothing otherwise.
+func (m *Trie) Close() error {
+	if m.backing == nil {
+		return nil
+	}
+	err := m.backing.Close()
+	m.backing = nil
+	return err
+}
+
+// UnsafeParseBinary loads m from raw, which then backs m and thus
+// should not be modified. It only checks the structure of the blocks
+// and trusts the content of the model; use ParseBinary for binaries
+// from untrusted sources.
+func (m *Trie) UnsafeParseBinary(raw []byte) error {
+	blocks, err := sliceBinary(raw, MAGIC_TRIE)
+	if err != nil {
+		return err
+	}
+	m.info = blocks.info
+
+	var th trieHeader
+	h, err := blocks.parseHeader(&th)
+	if err != nil {
+		return err
+	}
+	m.vocab, m.bos, m.eos, m.bosId, m.eosId = h.vocab, h.bos, h.eos, h.bosId, h.eosId
+
+	w := th.Widths
+	if w.Word > 32 || w.State > 32 || w.Prob > 32 || w.BackOff > 32 || w.Leaf > _MAX_FIELD_BITS {
+		return fmt.Errorf("bad binary: fields of %+v bits", w)
+	}
+	if th.NumStates <= int(_STATE_START) || uint64(th.NumStates) >= uint64(STATE_NIL) || th.NumLeaves < 0 {
+		return fmt.Errorf("bad binary: %d states and %d leaves", th.NumStates, th.NumLeaves)
+	}
+	stateBytes, ok1 := bitArrayBytes(uint64(th.NumStates)+1, w.stateBits())
+	leafBytes, ok2 := bitArrayBytes(uint64(th.NumLeaves), w.leafBits())
+	if !ok1 || !ok2 || stateBytes+leafBytes != uint64(len(blocks.entries)) {
+		return fmt.Errorf("bad binary: entry block of %d bytes for %d states and %d leaves", len(blocks.entries), th.NumStates, th.NumLeaves)
+	}
+	if err := checkCodebooks(th.Codebooks); err != nil {
+		return err
+	}
+	m.widths, m.numStates, m.numLeaves, m.codebooks = w, th.NumStates, uint64(th.NumLeaves), th.Codebooks
+	m.probs, m.backOffs = indexCodebooks(m.codebooks)
+	m.states, m.leaves = blocks.entries[:stateBytes], blocks.entries[stateBytes:]
+	// Each order starts with the first child of the first state of the
+	// order below.
+	m.levels = []StateId{_STATE_EMPTY}
+	for p := _STATE_EMPTY; p != StateId(m.numStates); {
+		q := m.child(p)
+		if q <= p || q > StateId(m.numStates) || len(m.levels) > len(m.probs) {
+			return errors.New("bad binary: states are not grouped by order")
+		}
+		m.levels = append(m.levels, q)
+		p = q
+	}
+	if m.levels[1] != _STATE_START {
+		return errors.New("bad binary: the start state is not the first child of the empty state")
+	}
+	m.folded = parseArpaEntries(blocks.folded, blocks.info.Layout)
+	return nil
+}
+
+// ParseBinary is UnsafeParseBinary followed by Validate, so that a
+// corrupt binary gives an error rather than a crash or endless loop
+// later on. raw still backs m.
+func (m *Trie) ParseBinary(raw []byte) error {
+	if err := m.UnsafeParseBinary(raw); err != nil {
+		return err
+	}
+	return m.Validate()
+}
+
+// Validate checks that m is safe to use: the children and the leaves
+// of every state are within range, uniquely sorted by word, consume
+// words in the vocabulary and do not share words, the start state
+// consumes <s>, every code is in its codebook and the back-offs are
+// free of cycles. It takes time linear to the size of m.
+func (m *Trie) Validate() error {
+	if err := m.vocab.validate(); err != nil {
+		return err
+	}
+	end := StateId(m.numStates)
+	if m.child(end) != end || m.leaf(_STATE_EMPTY) != 0 || m.leaf(end) != m.numLeaves {
+		return errors.New("bad binary: the records do not cover all the states and leaves")
+	}
+	if m.stateWord(_STATE_START) != m.bosId {
+		return errors.New("bad binary: the start state does not consume <s>")
+	}
+	bound := m.vocab.bound()
+	for i := 0; i < m.numStates; i++ {
+		p := StateId(i)
+		lo, hi := m.child(p), m.child(p+1)
+		if hi < lo || m.leaf(p+1) < m.leaf(p) {
+			return fmt.Errorf("bad binary: children or leaves of state %d are out of range", p)
+		}
+		order := m.order(p)
+		book := m.probs[order]
+		for q := lo; q < hi; q++ {
+			x := m.stateWord(q)
+			if x == word.NIL || p == _STATE_EMPTY && q > _STATE_START && x == m.bosId || q > lo && q-1 != _STATE_START && m.stateWord(q-1) >= x {
+				return fmt.Errorf("bad binary: children of state %d are not uniquely sorted at %d", p, q-lo)
+			}
+			if x >= bound {
+				return fmt.Errorf("bad binary: state %d has a child consuming %d, out of %d words", p, x, bound)
+			}
+			if m.probCode(q) >= len(book) {
+				return fmt.Errorf("bad binary: transition to state %d has code %d beyond its codebook", q, m.probCode(q))
+			}
+		}
+		for j := m.leaf(p); j < m.leaf(p+1); j++ {
+			x := m.leafWord(j)
+			if x == word.NIL || j > m.leaf(p) && m.leafWord(j-1) >= x {
+				return fmt.Errorf("bad binary: leaves of state %d are not uniquely sorted at %d", p, j-m.leaf(p))
+			}
+			if x >= bound {
+				return fmt.Errorf("bad binary: state %d has a leaf consuming %d, out of %d words", p, x, bound)
+			}
+			if _, ok := m.findChild(p, x); ok {
+				return fmt.Errorf("bad binary: state %d has both a child and a leaf consuming %d", p, x)
+			}
+			if m.leafCode(j) >= len(book) {
+				return fmt.Errorf("bad binary: leaf of state %d has code %d beyond its codebook", p, m.leafCode(j))
+			}
+		}
+		if _, code := m.backOff(p); p != _STATE_EMPTY && code >= len(m.backOffs[order]) {
+			return fmt.Errorf("bad binary: back-off of state %d has code %d beyond its codebook", p, code)
+		}
+	}
+	return validateChains(m.numStates, "back-off", func(p StateId) StateId {
+		q, _ := m.backOff(p)
+		return q
+	})
+}
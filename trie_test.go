@@ -0,0 +1,211 @@
+package fslm
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestTrieSimple(t *testing.T) {
+	trieTest(simpleTrigramLM, simpleTrigramSents, t)
+}
+
+func TestTrieSparse(t *testing.T) {
+	trieTest(sparseFivegramLM, sparseFivegramSents, t)
+}
+
+func TestTrieSparser(t *testing.T) {
+	trieTest(sparserFivegramLM, sparserFivegramSents, t)
+}
+
+func TestTrieTrickyBackOff(t *testing.T) {
+	trieTest(trickyBackOffLM, trickyBackOffSents, t)
+}
+
+func TestTrieFragment(t *testing.T) {
+	fragmentTest(trieOrDie(readyBuilder(simpleTrigramLM), 0, t), simpleTrigramFragments, t)
+}
+
+func TestTrieProb(t *testing.T) {
+	probTest(trieOrDie(readyBuilder(simpleTrigramLM), 0, t), simpleTrigramProbs, t)
+}
+
+// trieTest checks models with so few weights that they are quantized
+// without error even with 8 bits.
+func trieTest(lm []ngram, sents [][]token, t *testing.T) {
+	for _, bits := range []int{0, 8} {
+		model := trieOrDie(readyBuilder(lm), bits, t)
+		var loaded Trie
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("%d bits: error in loading binary: %v", bits, err)
+		}
+		for _, m := range []*Trie{model, &loaded} {
+			if err := checkModel(m); err != nil {
+				t.Errorf("%d bits: check model failed with error %v", bits, err)
+			}
+			if err := checkContexts(m); err != nil {
+				t.Errorf("%d bits: check contexts failed with error %v", bits, err)
+			}
+			sentTest(m, sents, t)
+			var buf bytes.Buffer
+			if err := WriteARPA(m, &buf); err != nil {
+				t.Fatalf("%d bits: unexpected error: %v", bits, err)
+			}
+			if err := checkARPAWeights(buf.String(), lm); err != nil {
+				t.Errorf("%d bits: %v\n%s", bits, err, buf.String())
+			}
+		}
+	}
+}
+
+func trieOrDie(b *Builder, bits int, t *testing.T) *Trie {
+	m, err := b.DumpTrie(bits)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return m
+}
+
+func TestTrieExact(t *testing.T) {
+	arpa := syntheticARPA(1000, 4, 5000, 1)
+	builder := func() *Builder {
+		b, err := FromARPA(strings.NewReader(arpa), ARPAOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return b
+	}
+	sorted := builder().DumpSorted()
+	want := strings.Join(arpaLines(sorted, t), "\n")
+	sortedSize := len(binaryBytes(sorted, t))
+	dumped, err := builder().DumpTrie(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Made directly, from a model of the same states and from one with
+	// different state ids.
+	for i, m := range []ContextModel{dumped, sorted, builder().DumpHashed(0)} {
+		trie := dumped
+		if i > 0 {
+			if trie, err = NewTrie(m, 0); err != nil {
+				t.Fatalf("%d: unexpected error: %v", i, err)
+			}
+		}
+		var loaded Trie
+		raw := binaryBytes(trie, t)
+		if err := loaded.ParseBinary(raw); err != nil {
+			t.Fatalf("%d: error in loading binary: %v", i, err)
+		}
+		if !bytes.Equal(loaded.states, dumped.states) || !bytes.Equal(loaded.leaves, dumped.leaves) {
+			t.Errorf("%d: trie differs from the one made directly", i)
+		}
+		if got := strings.Join(arpaLines(&loaded, t), "\n"); got != want {
+			t.Errorf("%d: trie has different n-grams", i)
+		}
+		if size := len(raw); size >= sortedSize {
+			t.Errorf("%d: expect trie smaller than sorted; got %d >= %d bytes", i, size, sortedSize)
+		}
+	}
+	if _, err := NewTrie(sorted, 17); err == nil {
+		t.Errorf("expect error on 17 bits")
+	}
+}
+
+func TestTrieOpen(t *testing.T) {
+	path := t.TempDir() + "/lm"
+	if err := trieOrDie(readyBuilder(simpleTrigramLM), 0, t).WriteBinary(path); err != nil {
+		t.Fatalf("error in writing binary: %v", err)
+	}
+	model, err := Open(path, OpenOptions{Validate: true})
+	if err != nil {
+		t.Fatalf("error in loading binary: %v", err)
+	}
+	defer model.Close()
+	if _, ok := model.(*Trie); !ok || model.Kind() != MODEL_TRIE {
+		t.Errorf("unexpected model %T of kind %d", model, model.Kind())
+	}
+	sentTest(model, simpleTrigramSents, t)
+}
+
+func TestTrieCorrupt(t *testing.T) {
+	raw := binaryBytes(trieOrDie(readyBuilder(simpleTrigramLM), 0, t), t)
+	for j := range raw {
+		corrupt := append([]byte(nil), raw...)
+		corrupt[j] ^= 0xff
+		var m Trie
+		if m.ParseBinary(corrupt) != nil {
+			continue
+		}
+		// Anything that passes validation is safe to use.
+		for _, sent := range simpleTrigramSents {
+			p := m.Start()
+			for _, tok := range sent[:len(sent)-1] {
+				p, _ = m.NextS(p, tok.Word)
+			}
+			m.Final(p)
+		}
+		for p := 0; p < m.NumStates(); p++ {
+			m.StateContext(StateId(p))
+			m.BackOff(StateId(p))
+			for range m.Transitions(StateId(p)) {
+			}
+		}
+	}
+}
+
+func TestTrieValidate(t *testing.T) {
+	// A vocabulary whose size fits in the bits of its largest word id.
+	raw := binaryBytes(trieOrDie(readyBuilder(sparseFivegramLM), 0, t), t)
+	var m Trie
+	if err := m.UnsafeParseBinary(raw); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	numWords := uint64(m.vocab.block.numWords)
+	if bitsFor(numWords) > m.widths.Word {
+		t.Fatalf("%d words do not fit in %d bits", numWords, m.widths.Word)
+	}
+	w := m.widths
+	for i, corrupt := range []func(*Trie){
+		// The last child of the empty state and the last leaf, so that
+		// both stay sorted.
+		func(m *Trie) {
+			m.states.set(uint64(m.child(_STATE_EMPTY+1)-1)*uint64(w.stateBits())+uint64(w.State+w.Leaf), w.Word, numWords)
+		},
+		func(m *Trie) { m.leaves.set((m.numLeaves-1)*uint64(w.leafBits()), w.Word, numWords) },
+		func(m *Trie) {
+			m.states.set(uint64(_STATE_START)*uint64(w.stateBits())+uint64(w.State+w.Leaf), w.Word, uint64(m.eosId))
+		},
+		// The start state backs off to itself.
+		func(m *Trie) {
+			m.states.set(uint64(_STATE_START)*uint64(w.stateBits())+uint64(w.State+w.Leaf+w.Word+w.Prob), w.State, uint64(_STATE_START))
+		},
+	} {
+		var m Trie
+		if err := m.ParseBinary(append([]byte(nil), raw...)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		corrupt(&m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("case %d: expect error", i)
+		}
+	}
+}
+
+func TestBitArray(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, width := range []uint{0, 1, 7, 8, 13, 32, _MAX_FIELD_BITS} {
+		const n = 100
+		values := make([]uint64, n)
+		a := newBitArray(n, width)
+		for i := range values {
+			values[i] = r.Uint64() & (1<<width - 1)
+			a.set(uint64(i)*uint64(width), width, values[i])
+		}
+		for i, v := range values {
+			if got := a.get(uint64(i)*uint64(width), width); got != v {
+				t.Errorf("width %d: expect field %d to be %d; got %d", width, i, v, got)
+			}
+		}
+	}
+}
@@ -1,12 +1,18 @@
 #!/bin/sh -e
 
+# Generates probing_impl.go from probing_template.go.
+
+{
+	echo '// Code generated by update-probing.sh from probing_template.go; DO NOT EDIT.'
+	echo
+	sed -e '1,/^package /{/^package /!d;}' probing_template.go
+} > probing_impl.go
+
 gofmt -w -r '__Key -> word.Id' probing_impl.go
 gofmt -w -r '__Value -> StateWeight' probing_impl.go
 gofmt -w -r '__KEY_NIL -> word.NIL' probing_impl.go
 gofmt -w -r '__Hash -> WordIdHash' probing_impl.go
 gofmt -w -r '__Equal -> WordIdEqual' probing_impl.go
-sed -i '' -e 's/package probing/package fslm/' probing_impl.go
-sed -i '' -e 's/__/xqw/g' probing_impl.go
+sed -e 's/^package probing/package fslm/' -e 's/__/xqw/g' probing_impl.go > probing_impl.go.tmp
+mv probing_impl.go.tmp probing_impl.go
 gofmt -w -r 'NewxqwMap -> newXqwMap' probing_impl.go
-
-echo "Don't forget to import package word"
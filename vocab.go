@@ -0,0 +1,231 @@
+package fslm
+
+// The vocabulary block of binaries, which is looked up in place so
+// that loading a model does not have to build a word.Vocab.
+//
+// The block consists of little-endian uint32s followed by the bytes of
+// the words one after another:
+//
+//	numWords              the words have ids 0 to numWords - 1
+//	numBuckets            a power of 2 greater than numWords
+//	offsets[numWords+1]   where each word starts and the last ends
+//	buckets[numBuckets]   ids by hash, open addressing with linear
+//	                      probing; _VOCAB_EMPTY for empty buckets
+//	data                  the words
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/kho/word"
+)
+
+const _VOCAB_EMPTY = math.MaxUint32
+
+// vocabBlock is a vocabulary block sliced out of a binary.
+type vocabBlock struct {
+	numWords         int
+	offsets, buckets []byte
+	data             []byte
+	bucketMask       uint64
+}
+
+// fnv1a is the 64-bit FNV-1a hash of s.
+func fnv1a(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// encodeVocab encodes words, where the id of each is its index, as a
+// vocabulary block.
+func encodeVocab(words []string) ([]byte, error) {
+	numBuckets := 1
+	for numBuckets <= 2*len(words) {
+		numBuckets *= 2
+	}
+	size := 0
+	for _, w := range words {
+		size += len(w)
+	}
+	if size > math.MaxUint32 || numBuckets > math.MaxUint32 {
+		return nil, errors.New("vocabulary is too large")
+	}
+	raw := make([]byte, 4*(2+len(words)+1+numBuckets), 4*(2+len(words)+1+numBuckets)+size)
+	binary.LittleEndian.PutUint32(raw, uint32(len(words)))
+	binary.LittleEndian.PutUint32(raw[4:], uint32(numBuckets))
+	offsets, buckets := raw[8:8+4*(len(words)+1)], raw[8+4*(len(words)+1):]
+	for i := 0; i < numBuckets; i++ {
+		binary.LittleEndian.PutUint32(buckets[4*i:], _VOCAB_EMPTY)
+	}
+	mask := uint64(numBuckets - 1)
+	offset := 0
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(offsets[4*i:], uint32(offset))
+		offset += len(w)
+		raw = append(raw, w...)
+		j := fnv1a(w) & mask
+		for binary.LittleEndian.Uint32(buckets[4*j:]) != _VOCAB_EMPTY {
+			j = (j + 1) & mask
+		}
+		binary.LittleEndian.PutUint32(buckets[4*j:], uint32(i))
+	}
+	binary.LittleEndian.PutUint32(offsets[4*len(words):], uint32(offset))
+	return raw, nil
+}
+
+// parseVocab slices out a vocabulary block from raw. The content is
+// only checked by validate.
+func parseVocab(raw []byte) (*vocabBlock, error) {
+	if len(raw) < 8 {
+		return nil, errors.New("bad binary: truncated vocabulary")
+	}
+	numWords := uint64(binary.LittleEndian.Uint32(raw))
+	numBuckets := uint64(binary.LittleEndian.Uint32(raw[4:]))
+	if numBuckets <= numWords || numBuckets&(numBuckets-1) != 0 {
+		return nil, fmt.Errorf("bad binary: %d buckets for %d words", numBuckets, numWords)
+	}
+	dataStart := 8 + 4*(numWords+1+numBuckets)
+	if uint64(len(raw)) < dataStart {
+		return nil, errors.New("bad binary: truncated vocabulary")
+	}
+	return &vocabBlock{
+		numWords:   int(numWords),
+		offsets:    raw[8 : 8+4*(numWords+1)],
+		buckets:    raw[8+4*(numWords+1) : dataStart],
+		data:       raw[dataStart:],
+		bucketMask: numBuckets - 1,
+	}, nil
+}
+
+// validate checks that look-ups in v are safe: the words are within
+// the data and there is an empty bucket holding no word.
+func (v *vocabBlock) validate() error {
+	prev := uint32(0)
+	for i := 0; i <= v.numWords; i++ {
+		offset := binary.LittleEndian.Uint32(v.offsets[4*i:])
+		if offset < prev || int64(offset) > int64(len(v.data)) {
+			return fmt.Errorf("bad binary: word %d of the vocabulary is out of its data", i)
+		}
+		prev = offset
+	}
+	free := false
+	for i := 0; i < len(v.buckets); i += 4 {
+		if x := binary.LittleEndian.Uint32(v.buckets[i:]); x == _VOCAB_EMPTY {
+			free = true
+		} else if int64(x) >= int64(v.numWords) {
+			return fmt.Errorf("bad binary: word %d in the vocabulary buckets is out of range", x)
+		}
+	}
+	if !free {
+		return errors.New("bad binary: vocabulary has no empty bucket")
+	}
+	return nil
+}
+
+// StringOf returns the word of id x, which is backed by the block
+// itself, or "" when x is out of range. Look-ups never go out of the
+// block even if it is corrupt, so that the header can be parsed before
+// validation.
+func (v *vocabBlock) StringOf(x word.Id) string {
+	if int64(x) >= int64(v.numWords) {
+		return ""
+	}
+	low := binary.LittleEndian.Uint32(v.offsets[4*x:])
+	high := binary.LittleEndian.Uint32(v.offsets[4*x+4:])
+	if low >= high || int64(high) > int64(len(v.data)) {
+		return ""
+	}
+	return unsafe.String(&v.data[low], high-low)
+}
+
+// IdOf returns the id of s or word.NIL when s is not in v.
+func (v *vocabBlock) IdOf(s string) word.Id {
+	j := fnv1a(s) & v.bucketMask
+	for range v.bucketMask + 1 {
+		x := binary.LittleEndian.Uint32(v.buckets[4*j:])
+		if x == _VOCAB_EMPTY {
+			break
+		}
+		if v.StringOf(word.Id(x)) == s {
+			return word.Id(x)
+		}
+		j = (j + 1) & v.bucketMask
+	}
+	return word.NIL
+}
+
+// modelVocab is the vocabulary of a model, which is a word.Vocab for
+// a model from a builder or an old binary, or a vocabBlock for a model
+// loaded from a binary, from which a word.Vocab is only built when
+// asked for.
+type modelVocab struct {
+	block *vocabBlock
+	once  sync.Once
+	vocab *word.Vocab
+}
+
+func (v *modelVocab) IdOf(s string) word.Id {
+	if v.block != nil {
+		return v.block.IdOf(s)
+	}
+	return v.vocab.IdOf(s)
+}
+
+func (v *modelVocab) StringOf(x word.Id) string {
+	if v.block != nil {
+		return v.block.StringOf(x)
+	}
+	return v.vocab.StringOf(x)
+}
+
+// validate checks the block of v if there is one.
+func (v *modelVocab) validate() error {
+	if v.block == nil {
+		return nil
+	}
+	return v.block.validate()
+}
+
+// bound returns the number of words in v, beyond which no word id is
+// valid. Only a block has it; a word.Vocab comes from a builder or an
+// old binary and is trusted, so its bound is word.NIL.
+func (v *modelVocab) bound() word.Id {
+	if v.block != nil {
+		return word.Id(v.block.numWords)
+	}
+	return word.NIL
+}
+
+// Vocab returns the vocabulary as a word.Vocab, which is built from
+// the block on the first call and does not refer to the block.
+func (v *modelVocab) Vocab() *word.Vocab {
+	v.once.Do(func() {
+		if v.vocab == nil {
+			words := make([]string, v.block.numWords)
+			for i := range words {
+				words[i] = strings.Clone(v.block.StringOf(word.Id(i)))
+			}
+			v.vocab = word.NewVocab(words)
+		}
+	})
+	return v.vocab
+}
+
+// vocabWords returns the words of ids 0 to maxId in vocab. Words of
+// larger ids are not used by the model and thus would be OOVs anyway.
+func vocabWords(vocab interface{ StringOf(word.Id) string }, maxId word.Id) []string {
+	words := make([]string, int(maxId)+1)
+	for i := range words {
+		words[i] = vocab.StringOf(word.Id(i))
+	}
+	return words
+}
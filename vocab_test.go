@@ -0,0 +1,139 @@
+package fslm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/kho/word"
+)
+
+func TestVocabBlock(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 100} {
+		words := make([]string, n)
+		for i := range words {
+			words[i] = fmt.Sprintf("w%d", i)
+		}
+		if n > 1 {
+			// Empty words are kept but cannot be looked up.
+			words[1] = ""
+		}
+		raw, err := encodeVocab(words)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		v, err := parseVocab(raw)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := v.validate(); err != nil {
+			t.Errorf("%d words: unexpected error: %v", n, err)
+		}
+		for i, w := range words {
+			if got := v.StringOf(word.Id(i)); got != w {
+				t.Errorf("%d words: expect StringOf(%d) = %q; got %q", n, i, w, got)
+			}
+			if w == "" {
+				continue
+			}
+			if got := v.IdOf(w); got != word.Id(i) {
+				t.Errorf("%d words: expect IdOf(%q) = %d; got %d", n, w, i, got)
+			}
+		}
+		if got := v.IdOf("oov"); got != word.NIL {
+			t.Errorf("%d words: expect NIL for OOV; got %d", n, got)
+		}
+		if got := v.StringOf(word.Id(n)); got != "" {
+			t.Errorf("%d words: expect empty string out of range; got %q", n, got)
+		}
+	}
+}
+
+func TestVocabBlockCorrupt(t *testing.T) {
+	raw, err := encodeVocab([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, c := range []struct {
+		offset int
+		value  uint32
+		bad    string
+	}{
+		{0, 8, "parse"},            // numWords >= numBuckets
+		{4, 6, "parse"},            // numBuckets not a power of 2
+		{4, 1 << 20, "parse"},      // truncated
+		{8 + 4*1, 100, "validate"}, // offset out of data
+		{8 + 4*2, 0, "validate"},   // offsets not monotone
+		{8 + 4*4, 3, "validate"},   // id out of range
+	} {
+		corrupt := append([]byte(nil), raw...)
+		binary.LittleEndian.PutUint32(corrupt[c.offset:], c.value)
+		v, err := parseVocab(corrupt)
+		if (err != nil) != (c.bad == "parse") {
+			t.Errorf("case %d: unexpected parse error %v", i, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := v.validate(); (err != nil) != (c.bad == "validate") {
+			t.Errorf("case %d: unexpected validate error %v", i, err)
+		}
+		// Look-ups stay in the block anyway.
+		for x := word.Id(0); x < 4; x++ {
+			v.IdOf(v.StringOf(x))
+		}
+	}
+	// No empty bucket.
+	corrupt := append([]byte(nil), raw...)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(corrupt[8+4*4+4*i:], 0)
+	}
+	v, err := parseVocab(corrupt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := v.validate(); err == nil {
+		t.Errorf("expect error on full buckets")
+	}
+	if got := v.IdOf("b"); got != word.NIL {
+		t.Errorf("expect NIL on full buckets; got %d", got)
+	}
+}
+
+func TestLoadedVocab(t *testing.T) {
+	for i, dump := range dumps {
+		model := dump(readyBuilder(simpleTrigramLM))
+		expected, bos, eos, bosId, eosId := model.Vocab()
+		loaded := loadedModels()[i]
+		if err := loaded.ParseBinary(binaryBytes(model, t)); err != nil {
+			t.Fatalf("error in loading binary: %v", err)
+		}
+		vocab, gotBos, gotEos, gotBosId, gotEosId := loaded.Vocab()
+		if gotBos != bos || gotEos != eos || gotBosId != bosId || gotEosId != eosId {
+			t.Errorf("expect boundaries %q %q %d %d; got %q %q %d %d", bos, eos, bosId, eosId, gotBos, gotEos, gotBosId, gotEosId)
+		}
+		for _, w := range []string{"<s>", "</s>", "a", "b", "c", "<unk>", "x"} {
+			x := expected.IdOf(w)
+			if got := vocab.IdOf(w); got != x {
+				t.Errorf("expect %q to have id %d; got %d", w, x, got)
+			}
+			if x == word.NIL {
+				continue
+			}
+			if got := vocab.StringOf(x); got != w {
+				t.Errorf("expect id %d to be %q; got %q", x, w, got)
+			}
+		}
+		ids := loaded.(interface {
+			IdOf(string) word.Id
+			StringOf(word.Id) string
+		})
+		if got, want := ids.IdOf("a"), expected.IdOf("a"); got != want {
+			t.Errorf("expect IdOf(a) = %d; got %d", want, got)
+		}
+		if got := ids.StringOf(eosId); got != eos {
+			t.Errorf("expect StringOf(%d) = %q; got %q", eosId, eos, got)
+		}
+	}
+}